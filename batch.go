@@ -2,6 +2,7 @@ package KV
 
 import (
 	"KV/data"
+	"KV/index"
 	"encoding/binary"
 	"fmt"
 	"sync"
@@ -21,7 +22,7 @@ type WriteBatch struct {
 }
 
 func (db *DB) NewWriteBatch(options WriteBatchOptions) *WriteBatch {
-	if db.options.IndexType == BPTree && !db.seqNoFileExists && !db.isInitial {
+	if db.persistentIndex && !db.seqNoFileExists && !db.isInitial {
 		panic(fmt.Sprintf("cannot use write batch: %v", ErrWriteBatchCannotUse))
 	}
 	return &WriteBatch{
@@ -33,8 +34,11 @@ func (db *DB) NewWriteBatch(options WriteBatchOptions) *WriteBatch {
 }
 
 func (wb *WriteBatch) Put(key []byte, value []byte) error {
-	if len(key) == 0 {
-		return ErrKeyIsEmpty
+	if err := checkUserKey(key); err != nil {
+		return err
+	}
+	if err := wb.db.checkKeyValueSize(key, value); err != nil {
+		return err
 	}
 	wb.mu.Lock()
 	defer wb.mu.Unlock()
@@ -45,8 +49,8 @@ func (wb *WriteBatch) Put(key []byte, value []byte) error {
 }
 
 func (wb *WriteBatch) Delete(key []byte) error {
-	if len(key) == 0 {
-		return ErrKeyIsEmpty
+	if err := checkUserKey(key); err != nil {
+		return err
 	}
 	wb.mu.Lock()
 	defer wb.mu.Unlock()
@@ -77,21 +81,48 @@ func (wb *WriteBatch) Commit() error {
 	wb.db.mu.Lock()
 	defer wb.db.mu.Unlock()
 
-	// 获取序列号
-	seqNo := atomic.AddUint64(&wb.db.seqNo, 1)
-
-	// 开始写数据
-	positions := make(map[string]*data.LogRecordPos)
+	records := make([]*data.LogRecord, 0, len(wb.pendingWrites))
 	for _, record := range wb.pendingWrites {
-		logRecordPos, err := wb.db.appendLogRecord(&data.LogRecord{
-			Key:   logRecordKeyWithSeqNo(record.Key, seqNo),
-			Value: record.Value,
-			Type:  record.Type,
+		records = append(records, record)
+
+		// 二级索引的变更和数据在同一个事务中写入
+		indexRecords, err := wb.db.secondaryIndexRecords(record.Key, record.Value, record.Type)
+		if err != nil {
+			return err
+		}
+		records = append(records, indexRecords...)
+	}
+	records = append(records, wb.db.staleIndexDefRecords()...)
+	if err := wb.db.writeTransaction(records, wb.options.SyncWrites); err != nil {
+		return err
+	}
+
+	// 清空暂存数据
+	wb.pendingWrites = make(map[string]*data.LogRecord)
+
+	return nil
+}
+
+// 以事务的方式写入一组记录，写入事务完成标识之后才会更新索引
+// 在访问此方法前必须持有互斥锁
+func (db *DB) writeTransaction(records []*data.LogRecord, syncWrites bool) error {
+	// 获取序列号
+	seqNo := atomic.AddUint64(&db.seqNo, 1)
+
+	// 开始写数据，事务中的记录使用同一个写入时间
+	timestamp := db.now()
+	positions := make([]*data.LogRecordPos, len(records))
+	for i, record := range records {
+		logRecordPos, err := db.appendLogRecord(&data.LogRecord{
+			Key:       logRecordKeyWithSeqNo(record.Key, seqNo),
+			Value:     record.Value,
+			Type:      record.Type,
+			Timestamp: timestamp,
 		})
 		if err != nil {
 			return err
 		}
-		positions[string(record.Key)] = logRecordPos
+		positions[i] = logRecordPos
 	}
 
 	// 写标识事务完成的数据
@@ -99,31 +130,48 @@ func (wb *WriteBatch) Commit() error {
 		Key:  logRecordKeyWithSeqNo(txnFinKey, seqNo),
 		Type: data.LogRecordTxnFinished,
 	}
-	if _, err := wb.db.appendLogRecord(finishedRecord); err != nil {
+	finishedPos, err := db.appendLogRecord(finishedRecord)
+	if err != nil {
 		return err
 	}
 
 	// 根据配置持久化
-	if wb.options.SyncWrites && wb.db.activeFile != nil {
-		if err := wb.db.activeFile.Sync(); err != nil {
+	if syncWrites && db.activeFile != nil {
+		if err := db.syncBlobFile(); err != nil {
+			return err
+		}
+		if err := db.activeFile.Sync(); err != nil {
 			return err
 		}
 	}
 
-	// 更新内存索引
-	for _, record := range wb.pendingWrites {
-		pos := positions[string(record.Key)]
-		if record.Type == data.LogRecordNormal {
-			wb.db.index.Put(record.Key, pos)
-		}
-		if record.Type == data.LogRecordDeleted {
-			wb.db.index.Delete(record.Key)
+	// 范围删除的 key 在更新索引之前找出，持久化索引的事务中不能再读取索引
+	rangeKeys := make([][][]byte, len(records))
+	for i, record := range records {
+		if record.Type == data.LogRecordRangeDeleted {
+			end, _, _ := decodeRangeTombstone(record.Value)
+			rangeKeys[i] = db.rangeKeys(record.Key, end, nil)
 		}
 	}
 
-	// 清空暂存数据
-	wb.pendingWrites = make(map[string]*data.LogRecord)
-
+	// 更新内存索引，事务中所有记录的索引和高水位一起提交
+	err = db.batchIndex(finishedPos, func(batch index.Batch) error {
+		for i, record := range records {
+			switch record.Type {
+			case data.LogRecordNormal, data.LogRecordDeleted:
+				db.updateIndex(batch, record.Key, record.Type, positions[i])
+			case data.LogRecordRangeDeleted:
+				db.applyRangeTombstone(batch, rangeKeys[i], positions[i])
+			}
+		}
+		// 事务完成标识也是可以回收的
+		db.updateFileStats(nil, data.LogRecordTxnFinished, finishedPos)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	db.updateIndexDefs(records)
 	return nil
 }
 
@@ -0,0 +1,292 @@
+package KV
+
+import (
+	"KV/data"
+	"io"
+	"time"
+)
+
+// 较大的 value 写入单独的 blob 文件，数据文件中的记录只保存 value 在 blob 文件中的位置
+// merge 数据文件时只复制位置，不需要重写 value，blob 文件中无效的数据通过 BlobGC 单独回收
+
+// 将编码之后的记录写入活跃的 blob 文件，返回记录在 blob 文件中的位置，需要切换的 blob 文件已经切换
+// 在访问此方法前必须持有互斥锁
+func (db *DB) writeBlobRecord(encRecord []byte, size int64) (*data.LogRecordPos, error) {
+	writeOff := db.activeBlobFile.WriteOff
+	if err := db.activeBlobFile.Write(encRecord); err != nil {
+		return nil, err
+	}
+	// 数据文件中的记录持久化之前，blob 文件中的记录必须已经持久化
+	if db.options.SyncWrites {
+		if err := db.activeBlobFile.Sync(); err != nil {
+			return nil, err
+		}
+	}
+	return &data.LogRecordPos{Fid: db.activeBlobFile.FileId, Offset: writeOff, Size: uint32(size)}, nil
+}
+
+// 打开 blob 文件，读取时使用当前的编码方式解密记录
+func (db *DB) openBlobFile(fileId uint32) (*data.DataFile, error) {
+	blobFile, err := data.OpenBlobFile(db.options.DirPath, fileId)
+	if err != nil {
+		return nil, err
+	}
+	blobFile.Codec = db.codec
+	return blobFile, nil
+}
+
+// 根据 id 找到对应的 blob 文件，不存在时返回 nil
+func (db *DB) blobFileById(fileId uint32) *data.DataFile {
+	if db.activeBlobFile != nil && db.activeBlobFile.FileId == fileId {
+		return db.activeBlobFile
+	}
+	if file, ok := db.blobFiles[fileId]; ok {
+		return file
+	}
+	if retired, ok := db.retiredBlobFiles[fileId]; ok {
+		// 回收之前创建的迭代器仍然读取旧的 blob 文件
+		return retired.file
+	}
+	return nil
+}
+
+// 从 blob 文件中读取 value
+func (db *DB) readBlobValue(blobPos *data.LogRecordPos) ([]byte, error) {
+	blobFile := db.blobFileById(blobPos.Fid)
+	if blobFile == nil {
+		return nil, ErrDataFileNotFound
+	}
+	logRecord, _, err := blobFile.ReadLogRecord(blobPos.Offset)
+	if err != nil {
+		return nil, err
+	}
+	return logRecord.Value, nil
+}
+
+// 持久化活跃的 blob 文件
+// 在访问此方法前必须持有互斥锁
+func (db *DB) syncBlobFile() error {
+	if db.activeBlobFile == nil {
+		return nil
+	}
+	return db.activeBlobFile.Sync()
+}
+
+// 关闭活跃的和旧的 blob 文件
+func (db *DB) closeBlobFiles() error {
+	if db.activeBlobFile != nil {
+		if err := db.activeBlobFile.Close(); err != nil {
+			return err
+		}
+	}
+	for _, file := range db.blobFiles {
+		if err := file.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 启动时打开 manifest 中列出的 blob 文件，最后一个是活跃的 blob 文件
+func (db *DB) loadBlobFiles() error {
+	for i, fileId := range db.manifest.BlobFileIds {
+		blobFile, err := db.openBlobFile(fileId)
+		if err != nil {
+			return err
+		}
+		if i < len(db.manifest.BlobFileIds)-1 {
+			db.blobFiles[fileId] = blobFile
+			continue
+		}
+		size, err := blobFile.IoManager.Size()
+		if err != nil {
+			return err
+		}
+		blobFile.WriteOff = size
+		db.activeBlobFile = blobFile
+	}
+	return nil
+}
+
+// BlobGC 回收 blob 文件中的无效数据
+// 旧的 blob 文件中无效数据的比例达到 BlobGCRatio 时，将其中仍然有效的 value 写入活跃的 blob 文件，并删除旧的 blob 文件
+func (db *DB) BlobGC() error {
+	db.mu.Lock()
+	if db.failed {
+		db.mu.Unlock()
+		return ErrDatabaseFailed
+	}
+	if db.isBlobGC {
+		db.mu.Unlock()
+		return ErrBlobGCIsProgress
+	}
+	db.isBlobGC = true
+	blobFiles := make([]*data.DataFile, 0, len(db.blobFiles))
+	for _, blobFile := range db.blobFiles {
+		blobFiles = append(blobFiles, blobFile)
+	}
+	db.mu.Unlock()
+
+	defer func() {
+		db.mu.Lock()
+		db.isBlobGC = false
+		db.mu.Unlock()
+	}()
+
+	for _, blobFile := range blobFiles {
+		ratio, err := db.blobGarbageRatio(blobFile)
+		if err != nil {
+			return err
+		}
+		if ratio < db.options.BlobGCRatio {
+			continue
+		}
+		if err := db.rewriteBlobFile(blobFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 定期执行 BlobGC，回收无效数据的比例达到阈值的 blob 文件
+func (db *DB) runAutoBlobGCTask(interval time.Duration) {
+	defer db.bgWait.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			_ = db.BlobGC()
+		case <-db.closeCh:
+			return
+		}
+	}
+}
+
+// 统计 blob 文件中无效数据的比例
+func (db *DB) blobGarbageRatio(blobFile *data.DataFile) (float32, error) {
+	reader, err := blobFile.NewReader(0)
+	if err != nil {
+		return 0, err
+	}
+	var total, garbage int64
+	var offset int64 = 0
+	for {
+		logRecord, size, err := reader.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return 0, err
+		}
+		db.mu.RLock()
+		live, err := db.isBlobLive(logRecord.Key, &data.LogRecordPos{Fid: blobFile.FileId, Offset: offset})
+		db.mu.RUnlock()
+		if err != nil {
+			return 0, err
+		}
+		if !live {
+			garbage += size
+		}
+		total += size
+		offset += size
+	}
+	if total == 0 {
+		return 1, nil
+	}
+	return float32(garbage) / float32(total), nil
+}
+
+// 将 blob 文件中仍然有效的 value 重新写入，然后删除这个 blob 文件
+func (db *DB) rewriteBlobFile(blobFile *data.DataFile) error {
+	reader, err := blobFile.NewReader(0)
+	if err != nil {
+		return err
+	}
+	var offset int64 = 0
+	for {
+		logRecord, size, err := reader.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		if err := db.rewriteBlobRecord(logRecord, &data.LogRecordPos{Fid: blobFile.FileId, Offset: offset}); err != nil {
+			return err
+		}
+		offset += size
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.syncBlobFile(); err != nil {
+		return err
+	}
+	if err := db.activeFile.Sync(); err != nil {
+		return err
+	}
+	manifest := db.newManifest(db.activeFile.FileId, nil, nil)
+	for i, fileId := range manifest.BlobFileIds {
+		if fileId == blobFile.FileId {
+			manifest.BlobFileIds = append(manifest.BlobFileIds[:i], manifest.BlobFileIds[i+1:]...)
+			break
+		}
+	}
+	if err := db.writeManifest(manifest); err != nil {
+		return err
+	}
+
+	// 旧的 blob 文件可能仍然被之前创建的迭代器读取，等到没有迭代器引用之后再删除
+	db.fileEpoch++
+	delete(db.blobFiles, blobFile.FileId)
+	db.retiredBlobFiles[blobFile.FileId] = &retiredFile{file: blobFile, epoch: db.fileEpoch}
+	return db.releaseRetiredFiles()
+}
+
+// 如果 blob 记录仍然有效，写入新的 blob 记录，并追加指向它的数据记录
+func (db *DB) rewriteBlobRecord(logRecord *data.LogRecord, blobPos *data.LogRecordPos) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	live, err := db.isBlobLive(logRecord.Key, blobPos)
+	if err != nil || !live {
+		return err
+	}
+	realKey, _ := parseLogRecordKey(logRecord.Key)
+	// 保留原来的写入时间，修改了 blob 阈值时仍然写入 blob 文件
+	pos, err := db.appendRecord(&data.LogRecord{
+		Key:       logRecordKeyWithSeqNo(realKey, nonTransactionSeqNo),
+		Value:     logRecord.Value,
+		Type:      data.LogRecordNormal,
+		Timestamp: logRecord.Timestamp,
+	}, true)
+	if err != nil {
+		return err
+	}
+	return db.indexLogRecord(realKey, data.LogRecordNormal, pos)
+}
+
+// 判断 blob 记录是否仍然被索引中的数据记录引用
+// 在访问此方法前必须持有互斥锁
+func (db *DB) isBlobLive(key []byte, blobPos *data.LogRecordPos) (bool, error) {
+	realKey, _ := parseLogRecordKey(key)
+	pos := db.index.Get(realKey)
+	if pos == nil {
+		return false, nil
+	}
+	dataFile := db.dataFileById(pos.Fid)
+	if dataFile == nil {
+		return false, ErrDataFileNotFound
+	}
+	logRecord, _, err := dataFile.ReadLogRecord(pos.Offset)
+	if err != nil {
+		return false, err
+	}
+	if !logRecord.Blob {
+		return false, nil
+	}
+	ref := data.DecodeLogRecordPos(logRecord.Value)
+	return ref.Fid == blobPos.Fid && ref.Offset == blobPos.Offset, nil
+}
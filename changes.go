@@ -0,0 +1,146 @@
+package KV
+
+import (
+	"KV/data"
+	"bytes"
+	"io"
+	"time"
+)
+
+// Change 数据文件中记录的一次修改
+type Change struct {
+	Key       []byte
+	Deleted   bool      // 为 true 时表示 key 被删除
+	Timestamp time.Time // 写入时间
+
+	// 范围删除时 Key 为范围的起点，End 为范围的终点，不包含在范围内，为 nil 时没有终点
+	RangeDeleted bool
+	End          []byte
+}
+
+// Changes 遍历数据文件，找到 since 之后写入的记录，依次执行 fn，函数返回 false 时终止遍历
+// 按照重放数据文件的顺序遍历，同一个 key 可能出现多次，事务中的记录在事务完成之后才可见
+// merge 之后被覆盖或者删除的旧记录不再保留，之前版本写入的记录没有写入时间，不会被遍历到
+func (db *DB) Changes(since time.Time, fn func(change Change) bool) error {
+	return db.changes(since, nil, fn)
+}
+
+// ChangesInRange 和 Changes 相同，但是只遍历 key 在 [start, end) 范围内的修改，end 为空时没有上界
+// 范围删除只有起点在范围内时才会被遍历到，已经写入 footer 的旧数据文件中 key 的范围和它不相交时直接跳过
+func (db *DB) ChangesInRange(start, end []byte, since time.Time, fn func(change Change) bool) error {
+	if len(end) > 0 && bytes.Compare(start, end) >= 0 {
+		return ErrInvalidKeyRange
+	}
+	return db.changes(since, &keyRange{start: start, end: end}, fn)
+}
+
+// key 的范围 [start, end)，end 为空时没有上界
+type keyRange struct {
+	start []byte
+	end   []byte
+}
+
+func (kr *keyRange) contains(key []byte) bool {
+	return bytes.Compare(key, kr.start) >= 0 && (len(kr.end) == 0 || bytes.Compare(key, kr.end) < 0)
+}
+
+// 遍历数据文件中的修改，kr 不为空时只遍历范围内的 key
+func (db *DB) changes(since time.Time, kr *keyRange, fn func(change Change) bool) error {
+	db.mu.Lock()
+	if db.activeFile == nil {
+		db.mu.Unlock()
+		return nil
+	}
+	fileIds := make([]uint32, 0, len(db.olderFiles)+1)
+	dataFiles := make(map[uint32]*data.DataFile, len(db.olderFiles)+1)
+	for fileId, dataFile := range db.olderFiles {
+		fileIds = append(fileIds, fileId)
+		dataFiles[fileId] = dataFile
+	}
+	sortFileIds(fileIds)
+	fileIds = append(fileIds, db.activeFile.FileId)
+	dataFiles[db.activeFile.FileId] = db.activeFile
+
+	// 在持有锁时创建 reader，活跃文件只读取到当前写入的位置
+	readers := make([]*data.LogRecordReader, len(fileIds))
+	footers := make([]*data.Footer, len(fileIds))
+	for i, fileId := range fileIds {
+		reader, err := dataFiles[fileId].NewReader(0)
+		if err != nil {
+			db.mu.Unlock()
+			return err
+		}
+		readers[i] = reader
+		footers[i] = db.footers[fileId]
+	}
+	// 遍历期间 merge 替换掉的数据文件不会被删除
+	epoch := db.fileEpoch
+	db.readers[epoch]++
+	db.mu.Unlock()
+
+	defer func() {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		if db.readers[epoch]--; db.readers[epoch] <= 0 {
+			delete(db.readers, epoch)
+		}
+		_ = db.releaseRetiredFiles()
+	}()
+
+	sinceNano := since.UnixNano()
+	emit := func(key []byte, logRecord *data.LogRecord) bool {
+		if logRecord.Timestamp == 0 || logRecord.Timestamp <= sinceNano || isInternalKey(key) ||
+			kr != nil && !kr.contains(key) {
+			return true
+		}
+		change := Change{
+			Key:       key,
+			Deleted:   logRecord.Type == data.LogRecordDeleted,
+			Timestamp: time.Unix(0, logRecord.Timestamp),
+		}
+		if logRecord.Type == data.LogRecordRangeDeleted {
+			change.RangeDeleted = true
+			change.End, _, _ = decodeRangeTombstone(logRecord.Value)
+		}
+		return fn(change)
+	}
+
+	transactionRecords := make(map[uint64][]*data.LogRecord)
+	for i, reader := range readers {
+		// 事务可能跨越多个数据文件，还有范围内的事务没有完成时不能跳过，否则会错过事务完成的标记
+		if kr != nil && footers[i] != nil && !footers[i].Overlaps(kr.start, kr.end) && len(transactionRecords) == 0 {
+			continue
+		}
+		for {
+			logRecord, _, err := reader.Next()
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				return err
+			}
+
+			realKey, seqNo := parseLogRecordKey(logRecord.Key)
+			if seqNo == nonTransactionSeqNo {
+				if !emit(realKey, logRecord) {
+					return nil
+				}
+				continue
+			}
+			if logRecord.Type != data.LogRecordTxnFinished {
+				if kr == nil || kr.contains(realKey) {
+					logRecord.Key = realKey
+					transactionRecords[seqNo] = append(transactionRecords[seqNo], logRecord)
+				}
+				continue
+			}
+			for _, txnRecord := range transactionRecords[seqNo] {
+				if !emit(txnRecord.Key, txnRecord) {
+					return nil
+				}
+			}
+			delete(transactionRecords, seqNo)
+		}
+	}
+	return nil
+}
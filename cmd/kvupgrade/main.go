@@ -0,0 +1,45 @@
+// kvupgrade 离线转换数据库目录中记录的格式，转换期间不能打开数据库
+//
+//	kvupgrade -dir /tmp/bitcask-go -version 2
+//
+// 使用了加密的数据库需要提供密钥，直接调用 KV.UpgradeFormat
+package main
+
+import (
+	"KV"
+	"KV/data"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+)
+
+func main() {
+	dirPath := flag.String("dir", "", "数据库目录")
+	version := flag.Uint("version", uint(data.CurrentFormatVersion), "目标格式版本，1 为旧格式，2 为当前格式")
+	compress := flag.Bool("compress", false, "使用 flate 压缩较大的 value，只适用于版本 2")
+	flag.Parse()
+	if *dirPath == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *version > math.MaxUint8 {
+		fmt.Fprintf(os.Stderr, "kvupgrade: %v\n", data.ErrUnknownFormatVersion)
+		os.Exit(2)
+	}
+	// 旧格式不支持压缩
+	if *compress && data.FormatVersion(*version) == data.FormatV1 {
+		fmt.Fprintln(os.Stderr, "kvupgrade: -compress can not be used with -version 1")
+		os.Exit(2)
+	}
+
+	options := KV.DefaultOptions
+	options.DirPath = *dirPath
+	if *compress {
+		options.Compression = data.FlateCompressor
+	}
+	if err := KV.UpgradeFormat(options, data.FormatVersion(*version)); err != nil {
+		fmt.Fprintf(os.Stderr, "kvupgrade: %v\n", err)
+		os.Exit(1)
+	}
+}
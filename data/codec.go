@@ -0,0 +1,98 @@
+package data
+
+import (
+	"sync"
+)
+
+// Codec 数据文件中记录的编码方式，为 nil 时按照原始格式编码
+// 读取时根据每条记录 header 中的 flags 解码，同一个文件中可以混合不同编码方式的记录
+type Codec struct {
+	Compressor           Compressor  // 压缩算法，为 nil 时不压缩
+	CompressionThreshold int         // value 的长度达到该值时才压缩
+	KeyProvider          KeyProvider // 加密使用的密钥，为 nil 时不加密
+	EncryptKeys          bool        // 是否同时加密 key
+
+	aeads sync.Map // 每个密钥 id 对应的 cipher.AEAD
+}
+
+// EncodeLogRecord 对 LogRecord 进行编码
+// value 的长度达到阈值并且压缩之后变小时保存压缩之后的数据，配置了密钥时再对 value 以及 key 加密
+func (c *Codec) EncodeLogRecord(logRecord *LogRecord) ([]byte, int64, error) {
+	if c == nil {
+		encRecord, size := EncodeLogRecord(logRecord)
+		return encRecord, size, nil
+	}
+
+	key, value := logRecord.Key, logRecord.Value
+	var flags byte
+	if logRecord.Blob {
+		flags |= blobFlag
+	}
+	if c.Compressor != nil && !logRecord.Blob && len(value) > 0 && len(value) >= c.CompressionThreshold {
+		if compressed, err := c.Compressor.Compress(value); err == nil && len(compressed) < len(value) {
+			value, flags = compressed, c.Compressor.ID()&compressionFlagMask
+		}
+	}
+
+	if c.KeyProvider != nil {
+		// value 和明文的 key 绑定，不能被替换到其他的 key 上
+		var err error
+		if len(value) > 0 {
+			if value, err = c.encrypt(value, key); err != nil {
+				return nil, 0, err
+			}
+			flags |= valueEncryptedFlag
+		}
+		if c.EncryptKeys && len(key) > 0 {
+			if key, err = c.encrypt(key, nil); err != nil {
+				return nil, 0, err
+			}
+			flags |= keyEncryptedFlag
+		}
+	}
+
+	encRecord, size := encodeLogRecord(logRecord.Type, flags, logRecord.Timestamp, key, value)
+	return encRecord, size, nil
+}
+
+// MaxEncodedSize 长度为 keySize 和 valueSize 的记录编码之后的最大长度
+// 压缩之后变小时才保存压缩的数据，只需要考虑加密增加的长度
+func (c *Codec) MaxEncodedSize(keySize, valueSize int64) int64 {
+	size := maxLogRecordHeaderSize + keySize + valueSize
+	if c != nil && c.KeyProvider != nil {
+		size += 2 * maxEncryptionOverhead
+	}
+	return size
+}
+
+// 根据 header 中的 flags 还原 key 和 value
+func (c *Codec) decodeLogRecord(flags byte, logRecord *LogRecord) error {
+	var err error
+	if flags&keyEncryptedFlag != 0 {
+		if logRecord.Key, err = c.decrypt(logRecord.Key, nil); err != nil {
+			return err
+		}
+	}
+	if flags&valueEncryptedFlag != 0 {
+		if logRecord.Value, err = c.decrypt(logRecord.Value, logRecord.Key); err != nil {
+			return err
+		}
+	}
+	if id := flags & compressionFlagMask; id != 0 {
+		if logRecord.Value, err = c.decompress(id, logRecord.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 根据 header 中的算法标识解压 value
+func (c *Codec) decompress(id byte, value []byte) ([]byte, error) {
+	if c != nil && c.Compressor != nil && c.Compressor.ID() == id {
+		return c.Compressor.Decompress(value)
+	}
+	if id == FlateCompressionId {
+		return FlateCompressor.Decompress(value)
+	}
+	return nil, ErrUnsupportedCompression
+}
@@ -0,0 +1,78 @@
+package data
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"sync"
+)
+
+var (
+	ErrUnsupportedCompression = errors.New("unsupported compression, compressor is not configured")
+)
+
+const (
+	// 内置的 flate 压缩算法的标识
+	FlateCompressionId byte = 1
+	// 压缩算法标识的最大值，自定义的压缩算法使用 2 到 MaxCompressionId
+	MaxCompressionId byte = 7
+)
+
+// Compressor 压缩算法，压缩之后的记录在 header 中保存算法标识，读取时自动解压
+type Compressor interface {
+	// ID 算法标识，取值 1 到 MaxCompressionId，写入之后不能再修改
+	ID() byte
+
+	// Compress 压缩数据
+	Compress(src []byte) ([]byte, error)
+
+	// Decompress 解压数据
+	Decompress(src []byte) ([]byte, error)
+}
+
+// FlateCompressor 基于标准库 compress/flate 的压缩算法
+var FlateCompressor Compressor = &flateCompressor{
+	writers: sync.Pool{New: func() any {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	}},
+	readers: sync.Pool{New: func() any {
+		return flate.NewReader(nil)
+	}},
+}
+
+// 复用 flate 的 writer 和 reader，创建它们的开销比压缩一条记录还要大
+type flateCompressor struct {
+	writers sync.Pool
+	readers sync.Pool
+}
+
+func (fc *flateCompressor) ID() byte {
+	return FlateCompressionId
+}
+
+func (fc *flateCompressor) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := fc.writers.Get().(*flate.Writer)
+	defer fc.writers.Put(w)
+
+	w.Reset(&buf)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (fc *flateCompressor) Decompress(src []byte) ([]byte, error) {
+	r := fc.readers.Get().(io.ReadCloser)
+	defer fc.readers.Put(r)
+
+	if err := r.(flate.Resetter).Reset(bytes.NewReader(src), nil); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
@@ -0,0 +1,116 @@
+package data
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+// 测试用的自定义压缩算法，连续相同的字节只保存一次
+type runLengthCompressor struct{}
+
+func (runLengthCompressor) ID() byte { return 5 }
+
+func (runLengthCompressor) Compress(src []byte) ([]byte, error) {
+	var dst []byte
+	for i := 0; i < len(src); {
+		j := i
+		for j < len(src) && src[j] == src[i] && j-i < 255 {
+			j++
+		}
+		dst = append(dst, byte(j-i), src[i])
+		i = j
+	}
+	return dst, nil
+}
+
+func (runLengthCompressor) Decompress(src []byte) ([]byte, error) {
+	var dst []byte
+	for i := 0; i+1 < len(src); i += 2 {
+		dst = append(dst, bytes.Repeat([]byte{src[i+1]}, int(src[i]))...)
+	}
+	return dst, nil
+}
+
+func TestCodec_EncodeLogRecord(t *testing.T) {
+	codec := &Codec{Compressor: FlateCompressor, CompressionThreshold: 64}
+	value := bytes.Repeat([]byte(`{"name":"bitcask-kv-go","tags":["a","b"]},`), 100)
+
+	// 1.达到阈值的 value 被压缩
+	enc1, size1, err := codec.EncodeLogRecord(&LogRecord{Key: []byte("name"), Value: value})
+	assert.Nil(t, err)
+	assert.Less(t, size1, int64(len(value)/2))
+	header, headerSize := decodeLogRecordHeader(enc1)
+	assert.Equal(t, FlateCompressionId, header.flags&compressionFlagMask)
+	record, err := buildLogRecord(header, enc1[:headerSize], enc1[headerSize:], nil)
+	assert.Nil(t, err)
+	assert.Equal(t, value, record.Value)
+	assert.Equal(t, LogRecordNormal, record.Type)
+
+	// 2.没有达到阈值时和原来的格式相同
+	small := &LogRecord{Key: []byte("name"), Value: []byte("bitcask-kv-go"), Type: LogRecordDeleted}
+	enc2, _, err := codec.EncodeLogRecord(small)
+	assert.Nil(t, err)
+	enc3, _ := EncodeLogRecord(small)
+	assert.Equal(t, enc3, enc2)
+
+	// 3.压缩之后没有变小时不压缩
+	random := []byte("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ!@")
+	enc4, size4, err := codec.EncodeLogRecord(&LogRecord{Key: []byte("name"), Value: random})
+	assert.Nil(t, err)
+	enc5, size5 := EncodeLogRecord(&LogRecord{Key: []byte("name"), Value: random})
+	assert.Equal(t, enc5, enc4)
+	assert.Equal(t, size5, size4)
+}
+
+func TestDataFile_ReadCompressedLogRecord(t *testing.T) {
+	dataFile, err := OpenDataFile(os.TempDir(), 222)
+	assert.Nil(t, err)
+	defer func() {
+		_ = dataFile.Close()
+		_ = os.Remove(GetDataFileName(os.TempDir(), 222))
+	}()
+
+	// 同一个文件中混合写入压缩和没有压缩的记录
+	value := bytes.Repeat([]byte("aaaaaaaaaaaaaaaabbbbbbbbbbbbbbbb"), 50)
+	codecs := []*Codec{
+		nil,
+		{Compressor: FlateCompressor},
+		{Compressor: runLengthCompressor{}},
+		{Compressor: runLengthCompressor{}, CompressionThreshold: 4096},
+	}
+	var offsets []int64
+	for _, codec := range codecs {
+		enc, _, err := codec.EncodeLogRecord(&LogRecord{Key: []byte("name"), Value: value})
+		assert.Nil(t, err)
+		offsets = append(offsets, dataFile.WriteOff)
+		assert.Nil(t, dataFile.Write(enc))
+	}
+
+	// 1.没有配置自定义算法时只能读取内置算法压缩的记录
+	for i, offset := range offsets {
+		record, _, err := dataFile.ReadLogRecord(offset)
+		if i == 2 {
+			assert.Equal(t, ErrUnsupportedCompression, err)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, value, record.Value)
+	}
+
+	// 2.配置自定义算法之后全部可以读取，顺序读取的结果相同
+	dataFile.Codec = &Codec{Compressor: runLengthCompressor{}}
+	reader, err := dataFile.NewReader(0)
+	assert.Nil(t, err)
+	for _, offset := range offsets {
+		record, size, err := dataFile.ReadLogRecord(offset)
+		assert.Nil(t, err)
+		assert.Equal(t, value, record.Value)
+
+		record, readSize, err := reader.Next()
+		assert.Nil(t, err)
+		assert.Equal(t, value, record.Value)
+		assert.Equal(t, size, readSize)
+	}
+}
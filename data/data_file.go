@@ -4,18 +4,19 @@ import (
 	"KV/fio"
 	"errors"
 	"fmt"
-	"hash/crc32"
 	"io"
 	"path/filepath"
 )
 
 var (
-	ErrInvalidCRC = errors.New("invalid crc value, log record maybe corrupted")
+	ErrInvalidCRC        = errors.New("invalid crc value, log record maybe corrupted")
+	ErrInvalidRecordSize = errors.New("the log record size exceeds the rest of the file, log record maybe truncated")
 )
 
 const (
 	DataFileNameSuffix  = ".data"
-	HintFileName        = "hint-index"
+	HintFileNameSuffix  = ".hint"
+	BlobFileNameSuffix  = ".blob"
 	MergeFinishFileName = "merge-finished"
 	SeqNoFileName       = "seq-no"
 )
@@ -25,6 +26,7 @@ type DataFile struct {
 	FileId    uint32        // 文件id
 	WriteOff  int64         // 文件写到了哪个位置
 	IoManager fio.IOManager // io 读写管理
+	Codec     *Codec        // 记录的编码方式，读取时用于解压
 }
 
 // OpenDataFile 打开新的数据文件
@@ -33,9 +35,16 @@ func OpenDataFile(dirPath string, fileId uint32) (*DataFile, error) {
 	return NewDataFile(fileName, fileId)
 }
 
-func OpenHintFile(dirPath string) (*DataFile, error) {
-	fileName := filepath.Join(dirPath, HintFileName)
-	return NewDataFile(fileName, 0)
+// OpenHintFile 打开数据文件对应的 hint 文件
+func OpenHintFile(dirPath string, fileId uint32) (*DataFile, error) {
+	fileName := GetHintFileName(dirPath, fileId)
+	return NewDataFile(fileName, fileId)
+}
+
+// OpenBlobFile 打开保存较大 value 的 blob 文件，blob 文件和数据文件使用不同的 id
+func OpenBlobFile(dirPath string, fileId uint32) (*DataFile, error) {
+	fileName := GetBlobFileName(dirPath, fileId)
+	return NewDataFile(fileName, fileId)
 }
 
 func OpenMergeFinishFile(dirPath string) (*DataFile, error) {
@@ -53,6 +62,14 @@ func GetDataFileName(dirPath string, fileId uint32) string {
 	return filepath.Join(dirPath, fmt.Sprintf("%09d", fileId)+DataFileNameSuffix)
 }
 
+func GetHintFileName(dirPath string, fileId uint32) string {
+	return filepath.Join(dirPath, fmt.Sprintf("%09d", fileId)+HintFileNameSuffix)
+}
+
+func GetBlobFileName(dirPath string, fileId uint32) string {
+	return filepath.Join(dirPath, fmt.Sprintf("%09d", fileId)+BlobFileNameSuffix)
+}
+
 func NewDataFile(fileName string, fileId uint32) (*DataFile, error) {
 	ioManager, err := fio.NewIOManager(fileName)
 	if err != nil {
@@ -65,13 +82,29 @@ func NewDataFile(fileName string, fileId uint32) (*DataFile, error) {
 	}, nil
 }
 
-// ReadLogRecord 根据 offset 从数据文件中读取 LogRecord
+// ReadLogRecord 根据 offset 从数据文件中读取 LogRecord，读取到 footer 时返回 io.EOF
 func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
+	logRecord, size, err := df.readLogRecord(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	if logRecord.Type == LogRecordFooter {
+		return nil, 0, io.EOF
+	}
+	return logRecord, size, nil
+}
+
+func (df *DataFile) readLogRecord(offset int64) (*LogRecord, int64, error) {
 	fileSize, err := df.IoManager.Size()
 	if err != nil {
 		return nil, 0, err
 	}
 
+	// 读取位置已经到达文件末尾
+	if offset >= fileSize {
+		return nil, 0, io.EOF
+	}
+
 	// 如果读取的最大 header 长度已经超过了文件的长度，则只需要读取到文件的末尾即可
 	var headerBytes int64 = maxLogRecordHeaderSize
 	if offset+maxLogRecordHeaderSize > fileSize {
@@ -84,7 +117,7 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 		return nil, 0, err
 	}
 
-	header, headerSize := DecodeLogRecordHeader(headerBuf)
+	header, headerSize := decodeLogRecordHeader(headerBuf)
 	// 下面的两个条件表示读取到了文件末尾，直接返回 EOF 错误
 	if header == nil {
 		return nil, 0, io.EOF
@@ -96,27 +129,49 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 	// 取出对应的 key 和 value 的长度
 	keySize, valueSize := int64(header.keySize), int64(header.valueSize)
 	var recordSize = headerSize + keySize + valueSize
+	// header 中的长度超过了文件剩余的部分，说明记录没有写完整或者文件被截断，不需要按照这个长度分配内存
+	// 是否可以当作文件末尾处理由调用方决定
+	if recordSize > fileSize-offset {
+		return nil, 0, ErrInvalidRecordSize
+	}
 
-	logRecord := &LogRecord{Type: header.recordType}
 	// 开始读取用户实际存储的 key/value 数据
+	var kvBuf []byte
 	if keySize > 0 || valueSize > 0 {
-		kvBuf, err := df.readNBytes(keySize+valueSize, offset+headerSize)
+		kvBuf, err = df.readNBytes(keySize+valueSize, offset+headerSize)
 		if err != nil {
 			return nil, 0, err
 		}
-		//	解出 key 和 value
-		logRecord.Key = kvBuf[:keySize]
-		logRecord.Value = kvBuf[keySize:]
 	}
 
-	// 校验数据的有效性
-	crc := getLogRecordCRC(logRecord, headerBuf[crc32.Size:headerSize])
-	if crc != header.crc {
-		return nil, 0, ErrInvalidCRC
+	logRecord, err := buildLogRecord(header, headerBuf[:headerSize], kvBuf, df.Codec)
+	if err != nil {
+		return nil, 0, err
 	}
 	return logRecord, recordSize, nil
 }
 
+// NewReader 从 offset 开始顺序读取数据文件中的记录，读取到当前的文件末尾为止
+func (df *DataFile) NewReader(offset int64) (*LogRecordReader, error) {
+	fileSize, err := df.IoManager.Size()
+	if err != nil {
+		return nil, err
+	}
+	section := io.NewSectionReader(ioManagerReaderAt{df.IoManager}, offset, fileSize-offset)
+	reader := NewLogRecordReader(section)
+	reader.codec = df.Codec
+	return reader, nil
+}
+
+// 将 IOManager 转换为 io.ReaderAt
+type ioManagerReaderAt struct {
+	fio.IOManager
+}
+
+func (r ioManagerReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	return r.Read(b, off)
+}
+
 func (df *DataFile) Write(buf []byte) error {
 	n, err := df.IoManager.Write(buf)
 	if err != nil {
@@ -126,12 +181,18 @@ func (df *DataFile) Write(buf []byte) error {
 	return nil
 }
 
-func (df *DataFile) WriteHint(key []byte, pos *LogRecordPos) error {
+// WriteHint 写入 hint 记录，typ 为数据文件中对应记录的类型
+// hint 记录和数据文件中的记录使用相同的编码方式，加密时 key 同样不会以明文写入
+func (df *DataFile) WriteHint(key []byte, typ LogRecordType, pos *LogRecordPos) error {
 	record := &LogRecord{
 		Key:   key,
 		Value: EncodeLogRecordPos(pos),
+		Type:  typ,
+	}
+	encRecord, _, err := df.Codec.EncodeLogRecord(record)
+	if err != nil {
+		return err
 	}
-	encRecord, _ := EncodeLogRecord(record)
 	return df.Write(encRecord)
 }
 
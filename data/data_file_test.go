@@ -58,3 +58,29 @@ func TestDataFile_Sync(t *testing.T) {
 	err = dataFile.Sync()
 	assert.Nil(t, err)
 }
+
+func TestDataFile_WriteHint(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-hint")
+	defer os.RemoveAll(dir)
+
+	hintFile, err := OpenHintFile(dir, 7)
+	assert.Nil(t, err)
+	defer hintFile.Close()
+
+	pos := &LogRecordPos{Fid: 7, Offset: 100, Size: 20}
+	err = hintFile.WriteHint([]byte("key-a"), LogRecordNormal, pos)
+	assert.Nil(t, err)
+	err = hintFile.WriteHint([]byte("key-b"), LogRecordDeleted, pos)
+	assert.Nil(t, err)
+
+	record, size, err := hintFile.ReadLogRecord(0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key-a"), record.Key)
+	assert.Equal(t, LogRecordNormal, record.Type)
+	assert.Equal(t, pos, DecodeLogRecordPos(record.Value))
+
+	record, _, err = hintFile.ReadLogRecord(size)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key-b"), record.Key)
+	assert.Equal(t, LogRecordDeleted, record.Type)
+}
@@ -0,0 +1,116 @@
+package data
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	ErrMissingEncryptionKey  = errors.New("missing encryption key, key provider is not configured")
+	ErrEncryptionKeyNotFound = errors.New("encryption key not found")
+	ErrInvalidEncryptedData  = errors.New("invalid encrypted data, log record maybe corrupted")
+)
+
+// KeyProvider 提供 AES-GCM 加密使用的密钥，密钥长度为 16、24 或者 32 字节
+// 每条记录保存加密时使用的密钥 id，轮换密钥之后旧的密钥仍然需要用于解密
+type KeyProvider interface {
+	// CurrentKey 返回加密新记录使用的密钥及其 id
+	CurrentKey() (keyId uint32, key []byte, err error)
+
+	// Key 根据 id 返回解密使用的密钥，不存在时返回 ErrEncryptionKeyNotFound
+	Key(keyId uint32) ([]byte, error)
+}
+
+// KeyRing 内存中的密钥集合，CurrentKeyId 对应的密钥用于加密，其余的密钥只用于解密之前写入的记录
+type KeyRing struct {
+	CurrentKeyId uint32
+	Keys         map[uint32][]byte
+}
+
+func (kr *KeyRing) CurrentKey() (uint32, []byte, error) {
+	key, err := kr.Key(kr.CurrentKeyId)
+	return kr.CurrentKeyId, key, err
+}
+
+func (kr *KeyRing) Key(keyId uint32) ([]byte, error) {
+	key, ok := kr.Keys[keyId]
+	if !ok {
+		return nil, ErrEncryptionKeyNotFound
+	}
+	return key, nil
+}
+
+// 加密之后增加的最大长度，包括密钥 id、GCM 的 nonce 和认证标签
+const maxEncryptionOverhead = binary.MaxVarintLen32 + 12 + 16
+
+// 加密之后的数据
+//
+//	+-------------+-------------+---------------------+
+//	|   key id    |    nonce    |  密文及认证标签      |
+//	+-------------+-------------+---------------------+
+//	 变长（最大5）     12字节          变长
+func (c *Codec) encrypt(plaintext, additionalData []byte) ([]byte, error) {
+	keyId, _, err := c.KeyProvider.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := c.aead(keyId)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, binary.MaxVarintLen32+aead.NonceSize(), binary.MaxVarintLen32+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	n := binary.PutUvarint(buf, uint64(keyId))
+	nonce := buf[n : n+aead.NonceSize()]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(buf[:n+aead.NonceSize()], nonce, plaintext, additionalData), nil
+}
+
+func (c *Codec) decrypt(ciphertext, additionalData []byte) ([]byte, error) {
+	if c == nil || c.KeyProvider == nil {
+		return nil, ErrMissingEncryptionKey
+	}
+	keyId, n := binary.Uvarint(ciphertext)
+	if n <= 0 || keyId > uint64(^uint32(0)) {
+		return nil, ErrInvalidEncryptedData
+	}
+	aead, err := c.aead(uint32(keyId))
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < n+aead.NonceSize()+aead.Overhead() {
+		return nil, ErrInvalidEncryptedData
+	}
+	nonce := ciphertext[n : n+aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, ciphertext[n+aead.NonceSize():], additionalData)
+	if err != nil {
+		return nil, ErrInvalidEncryptedData
+	}
+	return plaintext, nil
+}
+
+// 取出密钥 id 对应的 cipher.AEAD，创建之后缓存起来
+func (c *Codec) aead(keyId uint32) (cipher.AEAD, error) {
+	if aead, ok := c.aeads.Load(keyId); ok {
+		return aead.(cipher.AEAD), nil
+	}
+	key, err := c.KeyProvider.Key(keyId)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	c.aeads.Store(keyId, aead)
+	return aead, nil
+}
@@ -0,0 +1,107 @@
+package data
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestCodec_Encryption(t *testing.T) {
+	keyRing := &KeyRing{
+		CurrentKeyId: 1,
+		Keys:         map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32)},
+	}
+	codec := &Codec{KeyProvider: keyRing, EncryptKeys: true}
+	record := &LogRecord{Key: []byte("customer-name"), Value: []byte("customer-value")}
+
+	// 1.加密之后不包含明文
+	enc1, size1, err := codec.EncodeLogRecord(record)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(enc1)), size1)
+	assert.False(t, bytes.Contains(enc1, record.Key))
+	assert.False(t, bytes.Contains(enc1, record.Value))
+
+	decode := func(codec *Codec, enc []byte) (*LogRecord, error) {
+		header, headerSize := decodeLogRecordHeader(enc)
+		return buildLogRecord(header, enc[:headerSize], enc[headerSize:], codec)
+	}
+	decoded, err := decode(codec, enc1)
+	assert.Nil(t, err)
+	assert.Equal(t, record, decoded)
+
+	// 2.没有密钥时无法读取
+	_, err = decode(nil, enc1)
+	assert.Equal(t, ErrMissingEncryptionKey, err)
+
+	// 3.轮换密钥之后仍然可以读取之前写入的记录
+	keyRing.Keys[2] = bytes.Repeat([]byte{2}, 16)
+	keyRing.CurrentKeyId = 2
+	enc2, _, err := codec.EncodeLogRecord(record)
+	assert.Nil(t, err)
+	for _, enc := range [][]byte{enc1, enc2} {
+		decoded, err := decode(codec, enc)
+		assert.Nil(t, err)
+		assert.Equal(t, record, decoded)
+	}
+	delete(keyRing.Keys, 1)
+	_, err = decode(&Codec{KeyProvider: keyRing}, enc1)
+	assert.Equal(t, ErrEncryptionKeyNotFound, err)
+
+	// 4.同时压缩和加密，删除记录的空 value 不加密
+	codec.Compressor = FlateCompressor
+	value := bytes.Repeat([]byte("customer-value"), 100)
+	enc3, size3, err := codec.EncodeLogRecord(&LogRecord{Key: record.Key, Value: value})
+	assert.Nil(t, err)
+	assert.Less(t, size3, int64(len(value)/2))
+	decoded, err = decode(codec, enc3)
+	assert.Nil(t, err)
+	assert.Equal(t, value, decoded.Value)
+
+	enc4, _, err := codec.EncodeLogRecord(&LogRecord{Key: record.Key, Type: LogRecordDeleted})
+	assert.Nil(t, err)
+	decoded, err = decode(codec, enc4)
+	assert.Nil(t, err)
+	assert.Equal(t, record.Key, decoded.Key)
+	assert.Equal(t, LogRecordDeleted, decoded.Type)
+	assert.Equal(t, 0, len(decoded.Value))
+}
+
+func TestDataFile_ReadEncryptedLogRecord(t *testing.T) {
+	dataFile, err := OpenDataFile(os.TempDir(), 333)
+	assert.Nil(t, err)
+	defer func() {
+		_ = dataFile.Close()
+		_ = os.Remove(GetDataFileName(os.TempDir(), 333))
+	}()
+	dataFile.Codec = &Codec{KeyProvider: &KeyRing{CurrentKeyId: 7, Keys: map[uint32][]byte{7: bytes.Repeat([]byte{7}, 24)}}}
+
+	// 同一个文件中混合写入加密和没有加密的记录
+	record := &LogRecord{Key: []byte("name"), Value: []byte("bitcask-kv-go")}
+	enc1, size1, err := dataFile.Codec.EncodeLogRecord(record)
+	assert.Nil(t, err)
+	assert.Nil(t, dataFile.Write(enc1))
+	enc2, _ := EncodeLogRecord(record)
+	assert.Nil(t, dataFile.Write(enc2))
+
+	for _, offset := range []int64{0, size1} {
+		readRecord, _, err := dataFile.ReadLogRecord(offset)
+		assert.Nil(t, err)
+		assert.Equal(t, record, readRecord)
+	}
+
+	// 密文被篡改
+	buf := make([]byte, size1)
+	_, err = dataFile.IoManager.Read(buf, 0)
+	assert.Nil(t, err)
+	header, headerSize := decodeLogRecordHeader(buf)
+	buf[len(buf)-1] ^= 0xff
+	_, err = buildLogRecord(&LogRecordHeader{
+		crc:        getLogRecordChecksum(&LogRecord{Key: buf[headerSize : headerSize+int64(header.keySize)], Value: buf[headerSize+int64(header.keySize):]}, buf[4:headerSize], crc32cTable),
+		recordType: header.recordType,
+		flags:      header.flags,
+		keySize:    header.keySize,
+		valueSize:  header.valueSize,
+	}, buf[:headerSize], buf[headerSize:], dataFile.Codec)
+	assert.Equal(t, ErrInvalidEncryptedData, err)
+}
@@ -0,0 +1,256 @@
+package data
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+var (
+	ErrFooterNotFound = errors.New("data file footer not found")
+	ErrInvalidFooter  = errors.New("invalid data file footer, data file maybe truncated or corrupted")
+)
+
+const (
+	footerMagic       uint32 = 0x5446564b // "KVFT"
+	footerTrailerSize        = 8
+)
+
+// Footer 数据文件写满之后追加在文件末尾的摘要信息
+//
+//	+-------------+-----------------+-------------+
+//	| footer 记录  | footer 记录长度   |    magic    |
+//	+-------------+-----------------+-------------+
+//	    变长             4字节            4字节
+type Footer struct {
+	RecordCount uint64 // 记录数量
+	LiveCount   uint64 // 写入 footer 时仍然被索引引用的记录数量
+	DeadCount   uint64 // 已经被覆盖或者删除的记录数量，删除标记等也计算在内
+	MinKey      []byte // 最小的 key
+	MaxKey      []byte // 最大的 key
+	Checksum    uint32 // footer 之前所有数据的 CRC32C
+
+	offset int64 // footer 记录在文件中的位置
+}
+
+// Overlaps 判断文件中是否可能有 [start, end) 范围内的 key，end 为空时没有上界
+func (f *Footer) Overlaps(start, end []byte) bool {
+	if f.RecordCount == 0 {
+		return false
+	}
+	if len(end) > 0 && bytes.Compare(f.MinKey, end) >= 0 {
+		return false
+	}
+	return bytes.Compare(f.MaxKey, start) >= 0
+}
+
+// FooterBuilder 随着写入或者读取数据文件统计 footer，写入的字节用于计算校验值
+type FooterBuilder struct {
+	footer Footer
+	hasKey bool
+}
+
+func (fb *FooterBuilder) Write(p []byte) (int, error) {
+	fb.footer.Checksum = crc32.Update(fb.footer.Checksum, crc32cTable, p)
+	return len(p), nil
+}
+
+// AddRecord 统计一条记录，key 为 nil 时不参与 key 范围的统计
+func (fb *FooterBuilder) AddRecord(key []byte, live bool) {
+	fb.footer.RecordCount++
+	if live {
+		fb.footer.LiveCount++
+	} else {
+		fb.footer.DeadCount++
+	}
+	if key == nil {
+		return
+	}
+	if !fb.hasKey || bytes.Compare(key, fb.footer.MinKey) < 0 {
+		fb.footer.MinKey = append([]byte(nil), key...)
+	}
+	if !fb.hasKey || bytes.Compare(key, fb.footer.MaxKey) > 0 {
+		fb.footer.MaxKey = append([]byte(nil), key...)
+	}
+	fb.hasKey = true
+}
+
+func (fb *FooterBuilder) Footer() *Footer {
+	footer := fb.footer
+	return &footer
+}
+
+// BuildFooter 读取整个数据文件统计 footer，fn 返回记录的 key 以及记录是否仍然有效
+func (df *DataFile) BuildFooter(fn func(logRecord *LogRecord, pos *LogRecordPos) ([]byte, bool)) (*Footer, error) {
+	fileSize, err := df.IoManager.Size()
+	if err != nil {
+		return nil, err
+	}
+	builder := &FooterBuilder{}
+	section := io.TeeReader(io.NewSectionReader(ioManagerReaderAt{df.IoManager}, 0, fileSize), builder)
+	reader := NewLogRecordReader(section)
+	reader.codec = df.Codec
+
+	var offset int64 = 0
+	for {
+		logRecord, size, err := reader.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		key, live := fn(logRecord, &LogRecordPos{Fid: df.FileId, Offset: offset, Size: uint32(size)})
+		builder.AddRecord(key, live)
+		offset += size
+	}
+	// 末尾不完整的数据同样计算在校验值中
+	if _, err := io.Copy(io.Discard, section); err != nil {
+		return nil, err
+	}
+	return builder.Footer(), nil
+}
+
+// WriteFooter 在文件末尾写入 footer，之后不能再写入数据
+func (df *DataFile) WriteFooter(footer *Footer) error {
+	encRecord, size, err := df.Codec.EncodeLogRecord(&LogRecord{
+		Value: encodeFooter(footer),
+		Type:  LogRecordFooter,
+	})
+	if err != nil {
+		return err
+	}
+	trailer := make([]byte, footerTrailerSize)
+	binary.LittleEndian.PutUint32(trailer[:4], uint32(size))
+	binary.LittleEndian.PutUint32(trailer[4:], footerMagic)
+	return df.Write(append(encRecord, trailer...))
+}
+
+// ReadFooter 读取文件末尾的 footer，没有 footer 时返回 ErrFooterNotFound
+func (df *DataFile) ReadFooter() (*Footer, error) {
+	fileSize, err := df.IoManager.Size()
+	if err != nil {
+		return nil, err
+	}
+	if fileSize < footerTrailerSize {
+		return nil, ErrFooterNotFound
+	}
+	trailer, err := df.readNBytes(footerTrailerSize, fileSize-footerTrailerSize)
+	if err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(trailer[4:]) != footerMagic {
+		return nil, ErrFooterNotFound
+	}
+
+	recordSize := int64(binary.LittleEndian.Uint32(trailer[:4]))
+	offset := fileSize - footerTrailerSize - recordSize
+	if offset < 0 {
+		return nil, ErrInvalidFooter
+	}
+	logRecord, size, err := df.readLogRecord(offset)
+	if err != nil {
+		if err == io.EOF || err == ErrInvalidCRC || err == ErrInvalidRecordSize {
+			return nil, ErrInvalidFooter
+		}
+		return nil, err
+	}
+	if logRecord.Type != LogRecordFooter || size != recordSize {
+		return nil, ErrInvalidFooter
+	}
+	footer := decodeFooter(logRecord.Value)
+	if footer == nil {
+		return nil, ErrInvalidFooter
+	}
+	footer.offset = offset
+	return footer, nil
+}
+
+// VerifyFooter 读取 footer，并校验文件中 footer 之前的所有数据
+func (df *DataFile) VerifyFooter() (*Footer, error) {
+	footer, err := df.ReadFooter()
+	if err != nil {
+		return nil, err
+	}
+	if err := df.VerifyChecksum(footer); err != nil {
+		return nil, err
+	}
+	return footer, nil
+}
+
+// VerifyChecksum 校验文件中 footer 之前的所有数据，和 footer 中的校验值不一致时返回 ErrInvalidFooter
+func (df *DataFile) VerifyChecksum(footer *Footer) error {
+	hash := crc32.New(crc32cTable)
+	if _, err := io.Copy(hash, io.NewSectionReader(ioManagerReaderAt{df.IoManager}, 0, footer.offset)); err != nil {
+		return err
+	}
+	if hash.Sum32() != footer.Checksum {
+		return ErrInvalidFooter
+	}
+	return nil
+}
+
+// MaxFooterSize key 的长度不超过 maxKeySize 时 footer 以及 trailer 的最大长度
+func (c *Codec) MaxFooterSize(maxKeySize int64) int64 {
+	return c.MaxEncodedSize(0, binary.MaxVarintLen64*3+binary.MaxVarintLen32*3+2*maxKeySize) + footerTrailerSize
+}
+
+func encodeFooter(footer *Footer) []byte {
+	buf := make([]byte, binary.MaxVarintLen64*3+binary.MaxVarintLen32*3+len(footer.MinKey)+len(footer.MaxKey))
+	var idx = 0
+	idx += binary.PutUvarint(buf[idx:], footer.RecordCount)
+	idx += binary.PutUvarint(buf[idx:], footer.LiveCount)
+	idx += binary.PutUvarint(buf[idx:], footer.DeadCount)
+	idx += binary.PutUvarint(buf[idx:], uint64(footer.Checksum))
+	for _, key := range [][]byte{footer.MinKey, footer.MaxKey} {
+		idx += binary.PutUvarint(buf[idx:], uint64(len(key)))
+		idx += copy(buf[idx:], key)
+	}
+	return buf[:idx]
+}
+
+func decodeFooter(buf []byte) *Footer {
+	var idx = 0
+	next := func() (uint64, bool) {
+		v, n := binary.Uvarint(buf[idx:])
+		if n <= 0 {
+			return 0, false
+		}
+		idx += n
+		return v, true
+	}
+	nextKey := func() ([]byte, bool) {
+		size, ok := next()
+		if !ok || size > uint64(len(buf)-idx) {
+			return nil, false
+		}
+		key := buf[idx : idx+int(size)]
+		idx += int(size)
+		return key, true
+	}
+
+	footer := &Footer{}
+	var checksum uint64
+	var ok bool
+	for _, v := range []*uint64{&footer.RecordCount, &footer.LiveCount, &footer.DeadCount, &checksum} {
+		if *v, ok = next(); !ok {
+			return nil
+		}
+	}
+	if checksum > uint64(^uint32(0)) {
+		return nil
+	}
+	footer.Checksum = uint32(checksum)
+	if footer.MinKey, ok = nextKey(); !ok {
+		return nil
+	}
+	if footer.MaxKey, ok = nextKey(); !ok {
+		return nil
+	}
+	if idx != len(buf) {
+		return nil
+	}
+	return footer
+}
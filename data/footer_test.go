@@ -0,0 +1,84 @@
+package data
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDataFile_Footer(t *testing.T) {
+	dirPath := filepath.Join(os.TempDir(), "footer-test")
+	_ = os.MkdirAll(dirPath, os.ModePerm)
+	defer func() {
+		_ = os.RemoveAll(dirPath)
+	}()
+
+	dataFile, err := OpenDataFile(dirPath, 0)
+	assert.Nil(t, err)
+	defer dataFile.Close()
+
+	// 1.没有 footer
+	_, err = dataFile.ReadFooter()
+	assert.Equal(t, ErrFooterNotFound, err)
+
+	records := []*LogRecord{
+		{Key: []byte("b"), Value: []byte("v1")},
+		{Key: []byte("a"), Value: []byte("v2")},
+		{Key: []byte("c"), Type: LogRecordDeleted},
+	}
+	for _, logRecord := range records {
+		encRecord, _ := EncodeLogRecord(logRecord)
+		assert.Nil(t, dataFile.Write(encRecord))
+	}
+	dataSize := dataFile.WriteOff
+
+	// 2.统计并写入 footer
+	footer, err := dataFile.BuildFooter(func(logRecord *LogRecord, pos *LogRecordPos) ([]byte, bool) {
+		return logRecord.Key, logRecord.Type == LogRecordNormal && string(logRecord.Key) != "b"
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), footer.RecordCount)
+	assert.Equal(t, uint64(1), footer.LiveCount)
+	assert.Equal(t, uint64(2), footer.DeadCount)
+	assert.Equal(t, []byte("a"), footer.MinKey)
+	assert.Equal(t, []byte("c"), footer.MaxKey)
+	assert.True(t, footer.Overlaps([]byte("b"), nil))
+	assert.True(t, footer.Overlaps(nil, []byte("b")))
+	assert.False(t, footer.Overlaps([]byte("d"), nil))
+	assert.False(t, footer.Overlaps(nil, []byte("a")))
+	assert.Nil(t, dataFile.WriteFooter(footer))
+
+	readFooter, err := dataFile.VerifyFooter()
+	assert.Nil(t, err)
+	assert.Equal(t, footer.Checksum, readFooter.Checksum)
+	assert.Equal(t, footer.RecordCount, readFooter.RecordCount)
+	assert.Equal(t, footer.MinKey, readFooter.MinKey)
+	assert.Equal(t, footer.MaxKey, readFooter.MaxKey)
+
+	// 3.顺序读取和随机读取都不会读到 footer
+	reader, err := dataFile.NewReader(0)
+	assert.Nil(t, err)
+	for range records {
+		_, _, err := reader.Next()
+		assert.Nil(t, err)
+	}
+	_, _, err = reader.Next()
+	assert.Equal(t, io.EOF, err)
+	_, _, err = dataFile.ReadLogRecord(dataSize)
+	assert.Equal(t, io.EOF, err)
+
+	// 4.数据被修改或者文件被截断
+	fileName := GetDataFileName(dirPath, 0)
+	buf, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	buf[0] ^= 0xff
+	assert.Nil(t, os.WriteFile(fileName, buf, 0644))
+	_, err = dataFile.VerifyFooter()
+	assert.Equal(t, ErrInvalidFooter, err)
+
+	assert.Nil(t, os.Truncate(fileName, int64(len(buf)-3)))
+	_, err = dataFile.ReadFooter()
+	assert.Equal(t, ErrFooterNotFound, err)
+}
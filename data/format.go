@@ -0,0 +1,67 @@
+package data
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+var (
+	ErrUnknownFormatVersion = errors.New("unknown log record format version")
+	ErrFormatUnsupported    = errors.New("the log record can not be encoded in the format version")
+)
+
+// FormatVersion 数据文件、hint 文件中记录的编码格式
+type FormatVersion = byte
+
+const (
+	// FormatV1 旧格式，没有 flags，使用 IEEE 校验，不支持压缩、加密、blob、写入时间、范围删除以及 footer
+	FormatV1 FormatVersion = iota + 1
+	// FormatV2 当前的格式，每条记录都有 flags，使用 CRC32C 校验
+	FormatV2
+
+	CurrentFormatVersion = FormatV2
+)
+
+// EncodeLogRecordFormat 按照 version 指定的格式编码
+// 旧格式不压缩 value，也不保存写入时间，配置了加密时返回 ErrFormatUnsupported
+func (c *Codec) EncodeLogRecordFormat(logRecord *LogRecord, version FormatVersion) ([]byte, int64, error) {
+	switch version {
+	case FormatV1:
+		if c != nil && c.KeyProvider != nil {
+			return nil, 0, ErrFormatUnsupported
+		}
+		return EncodeLogRecordV1(logRecord)
+	case FormatV2:
+		return c.EncodeLogRecord(logRecord)
+	default:
+		return nil, 0, ErrUnknownFormatVersion
+	}
+}
+
+// EncodeLogRecordV1 按照旧格式编码，写入时间不会保存
+//
+//	+-------------+-------------+-------------+--------------+-------------+--------------+
+//	| crc 校验值  |  type 类型   |    key size |   value size |      key    |      value   |
+//	+-------------+-------------+-------------+--------------+-------------+--------------+
+//	    4字节          1字节      变长（最大5）   变长（最大5）     变长           变长
+func EncodeLogRecordV1(logRecord *LogRecord) ([]byte, int64, error) {
+	if logRecord.Blob || logRecord.Type > LogRecordTxnFinished {
+		return nil, 0, ErrFormatUnsupported
+	}
+	header := make([]byte, binary.MaxVarintLen32*2+5)
+	header[4] = logRecord.Type
+	var index = 5
+	index += binary.PutVarint(header[index:], int64(len(logRecord.Key)))
+	index += binary.PutVarint(header[index:], int64(len(logRecord.Value)))
+
+	var size = index + len(logRecord.Key) + len(logRecord.Value)
+	encBytes := make([]byte, size)
+	copy(encBytes[:index], header[:index])
+	copy(encBytes[index:], logRecord.Key)
+	copy(encBytes[index+len(logRecord.Key):], logRecord.Value)
+
+	crc := crc32.ChecksumIEEE(encBytes[4:])
+	binary.LittleEndian.PutUint32(encBytes[:4], crc)
+	return encBytes, int64(size), nil
+}
@@ -0,0 +1,197 @@
+package data
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+var (
+	ErrInvalidIndexSnapshot = errors.New("invalid index snapshot, snapshot maybe corrupted")
+)
+
+const (
+	IndexSnapshotFileName = "index-snapshot"
+	indexSnapshotTmpName  = IndexSnapshotFileName + ".tmp"
+)
+
+// IndexSnapshotMeta 快照的元信息，写在快照文件的最后一条记录中
+type IndexSnapshotMeta struct {
+	Mark  *LogRecordPos // 快照覆盖到的数据位置，之后写入的数据需要重放
+	SeqNo uint64        // 快照时的事务序列号
+	Count uint64        // 快照中的索引条数
+}
+
+// IndexSnapshotWriter 将索引写入快照文件
+// 先写入临时文件，提交时持久化并重命名，保证快照文件要么完整要么不存在
+type IndexSnapshotWriter struct {
+	dirPath string
+	codec   *Codec
+	fd      *os.File
+	writer  *bufio.Writer
+	crc     uint32
+	count   uint64
+}
+
+// NewIndexSnapshotWriter 创建快照写入器，codec 和数据文件相同，加密时 key 不会以明文写入
+func NewIndexSnapshotWriter(dirPath string, codec *Codec) (*IndexSnapshotWriter, error) {
+	fd, err := os.OpenFile(filepath.Join(dirPath, indexSnapshotTmpName), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &IndexSnapshotWriter{
+		dirPath: dirPath,
+		codec:   codec,
+		fd:      fd,
+		writer:  bufio.NewWriterSize(fd, 1<<20),
+	}, nil
+}
+
+// Write 写入一条索引
+func (sw *IndexSnapshotWriter) Write(key []byte, pos *LogRecordPos) error {
+	record := &LogRecord{
+		Key:   key,
+		Value: EncodeLogRecordPos(pos),
+	}
+	encRecord, _, err := sw.codec.EncodeLogRecord(record)
+	if err != nil {
+		return err
+	}
+	if _, err := sw.writer.Write(encRecord); err != nil {
+		return err
+	}
+	sw.crc = updateIndexSnapshotCRC(sw.crc, record)
+	sw.count++
+	return nil
+}
+
+// Commit 写入元信息，持久化后替换旧的快照文件
+func (sw *IndexSnapshotWriter) Commit(mark *LogRecordPos, seqNo uint64) error {
+	buf := make([]byte, binary.MaxVarintLen32+binary.MaxVarintLen64*3+crc32.Size)
+	var idx = 0
+	idx += binary.PutUvarint(buf[idx:], uint64(mark.Fid))
+	idx += binary.PutVarint(buf[idx:], mark.Offset)
+	idx += binary.PutUvarint(buf[idx:], seqNo)
+	idx += binary.PutUvarint(buf[idx:], sw.count)
+	binary.LittleEndian.PutUint32(buf[idx:], sw.crc)
+	idx += crc32.Size
+
+	encRecord, _, err := sw.codec.EncodeLogRecord(&LogRecord{
+		Key:   []byte(IndexSnapshotFileName),
+		Value: buf[:idx],
+		Type:  LogRecordTxnFinished,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := sw.writer.Write(encRecord); err != nil {
+		return err
+	}
+	if err := sw.writer.Flush(); err != nil {
+		return err
+	}
+	if err := sw.fd.Sync(); err != nil {
+		return err
+	}
+	if err := sw.fd.Close(); err != nil {
+		return err
+	}
+	return os.Rename(filepath.Join(sw.dirPath, indexSnapshotTmpName), filepath.Join(sw.dirPath, IndexSnapshotFileName))
+}
+
+// Abort 放弃本次快照
+func (sw *IndexSnapshotWriter) Abort() {
+	_ = sw.fd.Close()
+	_ = os.Remove(filepath.Join(sw.dirPath, indexSnapshotTmpName))
+}
+
+// LoadIndexSnapshot 读取快照文件，对每一条索引调用 fn
+// 快照不存在时返回 nil，快照不完整或者校验失败时返回 ErrInvalidIndexSnapshot
+func LoadIndexSnapshot(dirPath string, codec *Codec, fn func(key []byte, pos *LogRecordPos)) (*IndexSnapshotMeta, error) {
+	fd, err := os.Open(filepath.Join(dirPath, IndexSnapshotFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer fd.Close()
+
+	var crc uint32
+	var count uint64
+	reader := NewLogRecordReader(fd)
+	reader.codec = codec
+	for {
+		logRecord, _, err := reader.Next()
+		if err != nil {
+			if err == io.EOF || err == ErrInvalidCRC || err == ErrInvalidRecordSize {
+				return nil, ErrInvalidIndexSnapshot
+			}
+			return nil, err
+		}
+
+		// 最后一条记录是快照的元信息
+		if logRecord.Type == LogRecordTxnFinished {
+			meta, metaCrc := decodeIndexSnapshotMeta(logRecord.Value)
+			if meta == nil || meta.Count != count || metaCrc != crc {
+				return nil, ErrInvalidIndexSnapshot
+			}
+			return meta, nil
+		}
+
+		// 每条索引记录参与整个快照的校验
+		crc = updateIndexSnapshotCRC(crc, logRecord)
+		count++
+		fn(logRecord.Key, DecodeLogRecordPos(logRecord.Value))
+	}
+}
+
+// RemoveIndexSnapshot 删除快照文件，数据文件发生重写之后快照中的位置信息不再有效
+func RemoveIndexSnapshot(dirPath string) error {
+	err := os.Remove(filepath.Join(dirPath, IndexSnapshotFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func updateIndexSnapshotCRC(crc uint32, record *LogRecord) uint32 {
+	crc = crc32.Update(crc, crc32.IEEETable, record.Key)
+	return crc32.Update(crc, crc32.IEEETable, record.Value)
+}
+
+func decodeIndexSnapshotMeta(buf []byte) (*IndexSnapshotMeta, uint32) {
+	var idx = 0
+	fid, n := binary.Uvarint(buf[idx:])
+	if n <= 0 {
+		return nil, 0
+	}
+	idx += n
+	offset, n := binary.Varint(buf[idx:])
+	if n <= 0 {
+		return nil, 0
+	}
+	idx += n
+	seqNo, n := binary.Uvarint(buf[idx:])
+	if n <= 0 {
+		return nil, 0
+	}
+	idx += n
+	count, n := binary.Uvarint(buf[idx:])
+	if n <= 0 {
+		return nil, 0
+	}
+	idx += n
+	if len(buf) < idx+crc32.Size {
+		return nil, 0
+	}
+	return &IndexSnapshotMeta{
+		Mark:  &LogRecordPos{Fid: uint32(fid), Offset: offset},
+		SeqNo: seqNo,
+		Count: count,
+	}, binary.LittleEndian.Uint32(buf[idx:])
+}
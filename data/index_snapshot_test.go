@@ -0,0 +1,54 @@
+package data
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIndexSnapshot(t *testing.T) {
+	dirPath := filepath.Join(os.TempDir(), "index-snapshot-test")
+	_ = os.MkdirAll(dirPath, os.ModePerm)
+	defer func() {
+		_ = os.RemoveAll(dirPath)
+	}()
+
+	// 1.快照不存在
+	meta, err := LoadIndexSnapshot(dirPath, nil, func(key []byte, pos *LogRecordPos) {})
+	assert.Nil(t, err)
+	assert.Nil(t, meta)
+
+	// 2.写入并读取快照
+	writer, err := NewIndexSnapshotWriter(dirPath, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, writer.Write([]byte("key-a"), &LogRecordPos{Fid: 1, Offset: 10, Size: 20}))
+	assert.Nil(t, writer.Write([]byte("key-b"), &LogRecordPos{Fid: 2, Offset: 30, Size: 40}))
+	assert.Nil(t, writer.Commit(&LogRecordPos{Fid: 2, Offset: 70}, 5))
+
+	keys := make(map[string]*LogRecordPos)
+	meta, err = LoadIndexSnapshot(dirPath, nil, func(key []byte, pos *LogRecordPos) {
+		keys[string(key)] = pos
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(2), meta.Mark.Fid)
+	assert.Equal(t, int64(70), meta.Mark.Offset)
+	assert.Equal(t, uint64(5), meta.SeqNo)
+	assert.Equal(t, uint64(2), meta.Count)
+	assert.Equal(t, &LogRecordPos{Fid: 1, Offset: 10, Size: 20}, keys["key-a"])
+	assert.Equal(t, &LogRecordPos{Fid: 2, Offset: 30, Size: 40}, keys["key-b"])
+
+	// 3.快照被截断
+	fileName := filepath.Join(dirPath, IndexSnapshotFileName)
+	stat, err := os.Stat(fileName)
+	assert.Nil(t, err)
+	assert.Nil(t, os.Truncate(fileName, stat.Size()-3))
+	_, err = LoadIndexSnapshot(dirPath, nil, func(key []byte, pos *LogRecordPos) {})
+	assert.Equal(t, ErrInvalidIndexSnapshot, err)
+
+	// 4.删除快照
+	assert.Nil(t, RemoveIndexSnapshot(dirPath))
+	meta, err = LoadIndexSnapshot(dirPath, nil, func(key []byte, pos *LogRecordPos) {})
+	assert.Nil(t, err)
+	assert.Nil(t, meta)
+}
@@ -3,6 +3,7 @@ package data
 import (
 	"encoding/binary"
 	"hash/crc32"
+	"math"
 )
 
 type LogRecordType = byte
@@ -11,11 +12,35 @@ const (
 	LogRecordNormal LogRecordType = iota
 	LogRecordDeleted
 	LogRecordTxnFinished
+	// 范围删除标记，key 为范围的起点，value 中保存范围的终点
+	LogRecordRangeDeleted
+	// 数据文件的 footer，value 中保存文件的摘要信息
+	LogRecordFooter
 )
 
-// crc type keySize valueSize
-// 4 +  1  +  5   +   5 = 15
-const maxLogRecordHeaderSize = binary.MaxVarintLen32*2 + 5
+// crc type flags keySize valueSize timestamp
+// 4 +  1  +  1  +  5   +   5   +   10 = 26
+const maxLogRecordHeaderSize = binary.MaxVarintLen32*2 + binary.MaxVarintLen64 + 6
+
+const (
+	// type 的最高位表示 type 之后还有一个字节的 flags，旧格式的记录没有 flags
+	logRecordFlagsPresent byte = 0x80
+	// flags 的低三位保存 value 的压缩算法标识，为 0 时没有压缩
+	compressionFlagMask byte = 0x07
+	// value 已经加密
+	valueEncryptedFlag byte = 0x08
+	// key 已经加密
+	keyEncryptedFlag byte = 0x10
+	// 使用 CRC32C 校验，没有时使用 IEEE，新写入的记录都使用 CRC32C
+	crc32cFlag byte = 0x20
+	// value 是 blob 文件中的位置
+	blobFlag byte = 0x40
+	// header 中保存了写入时间
+	timestampFlag byte = 0x80
+)
+
+// CRC32C 在支持 SSE4.2 等指令的平台上有硬件加速
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
 
 // LogRecord 写入到数据文件的记录
 // 之所以叫日志，是因为数据文件中的数据是追加写入的，类似日志的格式
@@ -23,20 +48,26 @@ type LogRecord struct {
 	Key   []byte
 	Value []byte
 	Type  LogRecordType
+	Blob  bool // 实际的 value 保存在 blob 文件中，Value 为编码之后的 blob 位置
+	// 写入时间，Unix 纳秒时间戳，为 0 时不保存
+	Timestamp int64
 }
 
 // LogRecord 的头部信息
 type LogRecordHeader struct {
 	crc        uint32        // crc 校验值
 	recordType LogRecordType // 标识 LogRecord 的类型
+	flags      byte          // 记录的编码方式
 	keySize    uint32        // key 的长度
 	valueSize  uint32        // value 的长度
+	timestamp  int64         // 写入时间
 }
 
 // LogRecordPos 数据内存索引，主要是描述数据在磁盘上的位置
 type LogRecordPos struct {
 	Fid    uint32 // 文件 id，表示将数据存储到了哪个文件当中
 	Offset int64  // 偏移，表示将数据存储到了数据文件中的哪个位置
+	Size   uint32 // 标识数据在磁盘上的大小
 }
 
 type TransactionRecord struct {
@@ -46,50 +77,67 @@ type TransactionRecord struct {
 
 // EncodeLogRecord 对 LogRecord 进行编码，返回字节数组及长度
 //
-//	+-------------+-------------+-------------+--------------+-------------+--------------+
-//	| crc 校验值  |  type 类型   |    key size |   value size |      key    |      value   |
-//	+-------------+-------------+-------------+--------------+-------------+--------------+
-//	    4字节          1字节        变长（最大5）   变长（最大5）     变长           变长
+//	+-------------+-------------+-------------+-------------+--------------+--------------+-------------+--------------+
+//	| crc 校验值  |  type 类型   | flags 可选   |    key size |   value size | timestamp 可选 |      key    |      value   |
+//	+-------------+-------------+-------------+-------------+--------------+--------------+-------------+--------------+
+//	    4字节          1字节         0或1字节      变长（最大5）   变长（最大5）   变长（最大10）      变长           变长
 func EncodeLogRecord(logRecord *LogRecord) ([]byte, int64) {
+	var flags byte
+	if logRecord.Blob {
+		flags |= blobFlag
+	}
+	return encodeLogRecord(logRecord.Type, flags, logRecord.Timestamp, logRecord.Key, logRecord.Value)
+}
+
+// 按照 flags 编码，value 为实际写入的数据
+func encodeLogRecord(typ LogRecordType, flags byte, timestamp int64, key, value []byte) ([]byte, int64) {
 	// 初始化一个 header 部分的字节数组
 	header := make([]byte, maxLogRecordHeaderSize)
 
-	// 第五个字节存储 Type
-	header[4] = logRecord.Type
-	var index = 5
-	// 5 字节之后，存储的是 key 和 value 的长度信息
+	// 第五个字节存储 Type，之后是 flags
+	header[4] = typ | logRecordFlagsPresent
+	header[5] = flags | crc32cFlag
+	var index = 6
+	// 之后存储的是 key 和 value 的长度信息
 	// 使用变长类型，节省空间
-	index += binary.PutVarint(header[index:], int64(len(logRecord.Key)))
-	index += binary.PutVarint(header[index:], int64(len(logRecord.Value)))
+	index += binary.PutVarint(header[index:], int64(len(key)))
+	index += binary.PutVarint(header[index:], int64(len(value)))
+	if timestamp != 0 {
+		header[5] |= timestampFlag
+		index += binary.PutVarint(header[index:], timestamp)
+	}
 
-	var size = index + len(logRecord.Key) + len(logRecord.Value)
+	var size = index + len(key) + len(value)
 	encBytes := make([]byte, size)
 
 	// 将 header 部分的内容拷贝过来
 	copy(encBytes[:index], header[:index])
 	// 将 key 和 value 数据拷贝到字节数组中
-	copy(encBytes[index:], logRecord.Key)
-	copy(encBytes[index+len(logRecord.Key):], logRecord.Value)
+	copy(encBytes[index:], key)
+	copy(encBytes[index+len(key):], value)
 
 	// 对整个 LogRecord 的数据进行 crc 校验
-	crc := crc32.ChecksumIEEE(encBytes[4:])
+	crc := crc32.Checksum(encBytes[4:], crc32cTable)
 	binary.LittleEndian.PutUint32(encBytes[:4], crc)
 
 	return encBytes, int64(size)
 }
 
-//logRecordPos编码
+// MaxLogRecordPosSize 位置信息编码之后的最大长度
+const MaxLogRecordPosSize = binary.MaxVarintLen32*2 + binary.MaxVarintLen64
 
+// EncodeLogRecordPos 对位置信息进行编码
 func EncodeLogRecordPos(pos *LogRecordPos) []byte {
-	buf := make([]byte, binary.MaxVarintLen32+binary.MaxVarintLen64)
+	buf := make([]byte, MaxLogRecordPosSize)
 	var idx = 0
 	idx += binary.PutVarint(buf[idx:], int64(pos.Fid))
-	idx += binary.PutVarint(buf[idx:], int64(pos.Offset))
+	idx += binary.PutVarint(buf[idx:], pos.Offset)
+	idx += binary.PutVarint(buf[idx:], int64(pos.Size))
 	return buf[:idx]
 }
 
 // 对字节数组中的 Header 信息进行解码
-func DecodeLogRecordHeader(buf []byte) (*LogRecordHeader, int64) {
+func decodeLogRecordHeader(buf []byte) (*LogRecordHeader, int64) {
 	if len(buf) <= 4 {
 		return nil, 0
 	}
@@ -100,38 +148,99 @@ func DecodeLogRecordHeader(buf []byte) (*LogRecordHeader, int64) {
 	}
 
 	var index = 5
-	// 取出实际的 key size
+	if header.recordType&logRecordFlagsPresent != 0 {
+		if len(buf) <= index {
+			return nil, 0
+		}
+		header.recordType &^= logRecordFlagsPresent
+		header.flags = buf[index]
+		index++
+	}
+
+	// 取出实际的 key size，长度不合法时说明 header 已经损坏
 	keySize, n := binary.Varint(buf[index:])
+	if n <= 0 || keySize < 0 || keySize > math.MaxUint32 {
+		return nil, 0
+	}
 	header.keySize = uint32(keySize)
 	index += n
 
 	// 取出实际的 value size
 	valueSize, n := binary.Varint(buf[index:])
+	if n <= 0 || valueSize < 0 || valueSize > math.MaxUint32 {
+		return nil, 0
+	}
 	header.valueSize = uint32(valueSize)
 	index += n
 
+	if header.flags&timestampFlag != 0 {
+		header.timestamp, n = binary.Varint(buf[index:])
+		if n <= 0 {
+			return nil, 0
+		}
+		index += n
+	}
+
 	return header, int64(index)
 }
 
+// DecodeLogRecordPos 解码位置信息，兼容没有记录 size 的旧格式
 func DecodeLogRecordPos(buf []byte) *LogRecordPos {
 	var idx = 0
 	fileId, n := binary.Varint(buf[idx:])
 	idx += n
-	offset, _ := binary.Varint(buf[idx:])
+	offset, n := binary.Varint(buf[idx:])
+	idx += n
+	var size int64
+	if idx < len(buf) {
+		size, _ = binary.Varint(buf[idx:])
+	}
 	return &LogRecordPos{
 		Fid:    uint32(fileId),
 		Offset: offset,
+		Size:   uint32(size),
+	}
+}
+
+// 根据 header 解出 key 和 value，并校验数据的有效性，加密或者压缩过的数据使用 codec 还原
+func buildLogRecord(header *LogRecordHeader, headerBuf []byte, kvBuf []byte, codec *Codec) (*LogRecord, error) {
+	keySize := int64(header.keySize)
+	logRecord := &LogRecord{Type: header.recordType, Blob: header.flags&blobFlag != 0, Timestamp: header.timestamp}
+	if len(kvBuf) > 0 {
+		logRecord.Key = kvBuf[:keySize]
+		logRecord.Value = kvBuf[keySize:]
 	}
+
+	table := crc32.IEEETable
+	if header.flags&crc32cFlag != 0 {
+		table = crc32cTable
+	}
+	crc := getLogRecordChecksum(logRecord, headerBuf[crc32.Size:], table)
+	if crc != header.crc {
+		return nil, ErrInvalidCRC
+	}
+
+	if header.flags&^(crc32cFlag|blobFlag|timestampFlag) != 0 {
+		if err := codec.decodeLogRecord(header.flags, logRecord); err != nil {
+			return nil, err
+		}
+	}
+	return logRecord, nil
 }
 
+// 旧格式的记录使用 IEEE 校验
 func getLogRecordCRC(lr *LogRecord, header []byte) uint32 {
+	return getLogRecordChecksum(lr, header, crc32.IEEETable)
+}
+
+func getLogRecordChecksum(lr *LogRecord, header []byte, table *crc32.Table) uint32 {
 	if lr == nil {
 		return 0
 	}
 
-	crc := crc32.ChecksumIEEE(header[:])
-	crc = crc32.Update(crc, crc32.IEEETable, lr.Key)
-	crc = crc32.Update(crc, crc32.IEEETable, lr.Value)
+	crc := crc32.Checksum(header[:], table)
+	crc = crc32.Update(crc, table, lr.Key)
+	crc = crc32.Update(crc, table, lr.Value)
 
 	return crc
 }
@@ -1,9 +1,11 @@
 package data
 
 import (
+	"encoding/binary"
 	"github.com/stretchr/testify/assert"
 	"hash/crc32"
 	"os"
+	"strconv"
 	"testing"
 )
 
@@ -146,3 +148,153 @@ func TestDataFile_ReadLogRecord(t *testing.T) {
 	assert.Equal(t, rec3, readRec3)
 	assert.Equal(t, size3, readSize3)
 }
+
+func TestDataFile_ReadLogRecordInvalidSize(t *testing.T) {
+	dirPath, _ := os.MkdirTemp("", "bitcask-go-record-size")
+	defer os.RemoveAll(dirPath)
+	dataFile, err := OpenDataFile(dirPath, 0)
+	assert.Nil(t, err)
+	defer dataFile.Close()
+
+	rec := &LogRecord{Key: []byte("name"), Value: []byte("bitcask kv go")}
+	enc, size := EncodeLogRecord(rec)
+	assert.Nil(t, dataFile.Write(enc))
+
+	// header 声明的 value 长度远超文件大小
+	header := []byte{1, 2, 3, 4, LogRecordNormal | logRecordFlagsPresent, crc32cFlag, 8}
+	header = binary.AppendVarint(header, 1<<31)
+	assert.Nil(t, dataFile.Write(append(header, "name"...)))
+	_, _, err = dataFile.ReadLogRecord(size)
+	assert.Equal(t, ErrInvalidRecordSize, err)
+
+	reader, err := dataFile.NewReader(0)
+	assert.Nil(t, err)
+	res, _, err := reader.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, rec, res)
+	_, _, err = reader.Next()
+	assert.Equal(t, ErrInvalidRecordSize, err)
+
+	// 长度为负数
+	header = []byte{1, 2, 3, 4, LogRecordNormal | logRecordFlagsPresent, crc32cFlag}
+	header = binary.AppendVarint(header, -1)
+	h, _ := decodeLogRecordHeader(append(header, 0))
+	assert.Nil(t, h)
+}
+
+func TestBuildLogRecord_Checksum(t *testing.T) {
+	record := &LogRecord{
+		Key:   []byte("name"),
+		Value: []byte("bitcask-kv-go"),
+		Type:  LogRecordNormal,
+	}
+	decode := func(enc []byte) (*LogRecord, error) {
+		header, headerSize := decodeLogRecordHeader(enc)
+		return buildLogRecord(header, enc[:headerSize], enc[headerSize:], nil)
+	}
+
+	// 1.旧格式的记录使用 IEEE 校验
+	legacy := append([]byte{81, 61, 93, 186, 0, 8, 26}, append(record.Key, record.Value...)...)
+	res1, err := decode(legacy)
+	assert.Nil(t, err)
+	assert.Equal(t, record, res1)
+
+	// 2.新写入的记录使用 CRC32C 校验
+	enc, _ := EncodeLogRecord(record)
+	header, _ := decodeLogRecordHeader(enc)
+	assert.Equal(t, crc32cFlag, header.flags&crc32cFlag)
+	res2, err := decode(enc)
+	assert.Nil(t, err)
+	assert.Equal(t, record, res2)
+
+	// 3.数据被损坏
+	for _, buf := range [][]byte{legacy, enc} {
+		buf[len(buf)-1] ^= 0xff
+		_, err := decode(buf)
+		assert.Equal(t, ErrInvalidCRC, err)
+	}
+}
+
+func TestEncodeLogRecord_Timestamp(t *testing.T) {
+	// 1.保存写入时间
+	record := &LogRecord{
+		Key:       []byte("name"),
+		Value:     []byte("bitcask-kv-go"),
+		Type:      LogRecordNormal,
+		Timestamp: 1700000000123456789,
+	}
+	enc, size := EncodeLogRecord(record)
+	header, headerSize := decodeLogRecordHeader(enc)
+	assert.Equal(t, timestampFlag, header.flags&timestampFlag)
+	assert.Equal(t, record.Timestamp, header.timestamp)
+	assert.Equal(t, size, headerSize+int64(len(record.Key)+len(record.Value)))
+	res, err := buildLogRecord(header, enc[:headerSize], enc[headerSize:], nil)
+	assert.Nil(t, err)
+	assert.Equal(t, record, res)
+
+	// 2.写入时间被截断时 header 不合法
+	header, _ = decodeLogRecordHeader(enc[:headerSize-1])
+	assert.Nil(t, header)
+
+	// 3.没有写入时间时不保存
+	record.Timestamp = 0
+	enc, _ = EncodeLogRecord(record)
+	header, _ = decodeLogRecordHeader(enc)
+	assert.Equal(t, byte(0), header.flags&timestampFlag)
+}
+
+func BenchmarkLogRecordChecksum(b *testing.B) {
+	tables := []struct {
+		name  string
+		table *crc32.Table
+	}{
+		{"IEEE", crc32.IEEETable},
+		{"CRC32C", crc32cTable},
+	}
+	for _, size := range []int{4 * 1024, 1024 * 1024} {
+		record := &LogRecord{Key: []byte("name"), Value: make([]byte, size)}
+		header := []byte{0, 8, 26}
+		for _, tt := range tables {
+			table := tt.table
+			b.Run(tt.name+"-"+strconv.Itoa(size), func(b *testing.B) {
+				b.SetBytes(int64(size))
+				for i := 0; i < b.N; i++ {
+					getLogRecordChecksum(record, header, table)
+				}
+			})
+		}
+	}
+}
+
+func TestEncodeLogRecordV1(t *testing.T) {
+	// 1.旧格式没有 flags，使用 IEEE 校验，写入时间不保存
+	record := &LogRecord{
+		Key:       []byte("name"),
+		Value:     []byte("bitcask-kv-go"),
+		Type:      LogRecordDeleted,
+		Timestamp: 1700000000123456789,
+	}
+	enc, size, err := EncodeLogRecordV1(record)
+	assert.Nil(t, err)
+	assert.Equal(t, LogRecordDeleted, enc[4])
+	header, headerSize := decodeLogRecordHeader(enc)
+	assert.Equal(t, byte(0), header.flags)
+	assert.Equal(t, size, headerSize+int64(len(record.Key)+len(record.Value)))
+	assert.Equal(t, crc32.ChecksumIEEE(enc[4:]), header.crc)
+	res, err := buildLogRecord(header, enc[:headerSize], enc[headerSize:], nil)
+	assert.Nil(t, err)
+	assert.Equal(t, record.Key, res.Key)
+	assert.Equal(t, record.Value, res.Value)
+	assert.Equal(t, int64(0), res.Timestamp)
+
+	// 2.旧格式不支持的记录
+	_, _, err = EncodeLogRecordV1(&LogRecord{Key: []byte("a"), Type: LogRecordRangeDeleted})
+	assert.Equal(t, ErrFormatUnsupported, err)
+	_, _, err = EncodeLogRecordV1(&LogRecord{Key: []byte("a"), Value: []byte("pos"), Blob: true})
+	assert.Equal(t, ErrFormatUnsupported, err)
+	codec := &Codec{KeyProvider: &KeyRing{CurrentKeyId: 1, Keys: map[uint32][]byte{1: make([]byte, 32)}}}
+	_, _, err = codec.EncodeLogRecordFormat(record, FormatV1)
+	assert.Equal(t, ErrFormatUnsupported, err)
+	_, _, err = codec.EncodeLogRecordFormat(record, 9)
+	assert.Equal(t, ErrUnknownFormatVersion, err)
+}
@@ -0,0 +1,183 @@
+package data
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+var (
+	ErrInvalidManifest            = errors.New("invalid manifest, manifest maybe corrupted")
+	ErrUnsupportedManifestVersion = errors.New("unsupported manifest version")
+)
+
+const (
+	ManifestFileName = "MANIFEST"
+	manifestTmpName  = ManifestFileName + ".tmp"
+
+	// manifest 编码格式的版本，增加字段时递增，读取时只接受当前版本
+	manifestVersion = 1
+)
+
+// Manifest 描述数据目录中有效的文件，启动时只加载其中列出的文件
+type Manifest struct {
+	ActiveFileId  uint32   // 活跃数据文件 id
+	DataFileIds   []uint32 // 旧的数据文件 id，从小到大排列
+	HintFileIds   []uint32 // 有对应 hint 文件的数据文件 id，从小到大排列
+	MergeBoundary uint32   // 最近一次 merge 之后写入的第一个数据文件 id，merge 生成的数据文件都在它之前
+	MergedFileIds []uint32 // 最近一次 merge 替换掉的数据文件 id，持久化索引还没有更新完成时不为空
+	BlobFileIds   []uint32 // blob 文件 id，从小到大排列，最后一个是活跃的 blob 文件
+	FooterFileIds []uint32 // 已经写入 footer 的数据文件 id，从小到大排列
+
+	MergeFirstFileId uint32 // 最近一次 merge 预留的第一个数据文件 id
+}
+
+// WriteManifest 写入临时文件并持久化，再重命名替换旧的 manifest，保证 manifest 要么是旧的要么是新的
+func WriteManifest(dirPath string, manifest *Manifest) error {
+	encRecord, _ := EncodeLogRecord(&LogRecord{
+		Key:   []byte(ManifestFileName),
+		Value: encodeManifest(manifest),
+	})
+
+	tmpName := filepath.Join(dirPath, manifestTmpName)
+	fd, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := fd.Write(encRecord); err != nil {
+		_ = fd.Close()
+		return err
+	}
+	if err := fd.Sync(); err != nil {
+		_ = fd.Close()
+		return err
+	}
+	if err := fd.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, filepath.Join(dirPath, ManifestFileName)); err != nil {
+		return err
+	}
+	return SyncDir(dirPath)
+}
+
+// ReadManifest 读取 manifest，不存在时返回 nil，校验失败时返回 ErrInvalidManifest
+// 由其他版本写入时返回 ErrUnsupportedManifestVersion
+func ReadManifest(dirPath string) (*Manifest, error) {
+	fd, err := os.Open(filepath.Join(dirPath, ManifestFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer fd.Close()
+
+	logRecord, _, err := NewLogRecordReader(fd).Next()
+	if err != nil {
+		if err == io.EOF || err == ErrInvalidCRC || err == ErrInvalidRecordSize {
+			return nil, ErrInvalidManifest
+		}
+		return nil, err
+	}
+	return decodeManifest(logRecord.Value)
+}
+
+// SyncDir 持久化目录，保证重命名之后的文件在崩溃之后依然可见
+func SyncDir(dirPath string) error {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func encodeManifest(manifest *Manifest) []byte {
+	fileIds := [][]uint32{manifest.DataFileIds, manifest.HintFileIds, manifest.MergedFileIds, manifest.BlobFileIds, manifest.FooterFileIds}
+	size := binary.MaxVarintLen32 * 9
+	for _, ids := range fileIds {
+		size += binary.MaxVarintLen32 * len(ids)
+	}
+
+	buf := make([]byte, size)
+	var idx = 0
+	idx += binary.PutUvarint(buf[idx:], manifestVersion)
+	idx += binary.PutUvarint(buf[idx:], uint64(manifest.ActiveFileId))
+	idx += binary.PutUvarint(buf[idx:], uint64(manifest.MergeBoundary))
+	for _, ids := range fileIds {
+		idx += binary.PutUvarint(buf[idx:], uint64(len(ids)))
+		for _, fileId := range ids {
+			idx += binary.PutUvarint(buf[idx:], uint64(fileId))
+		}
+	}
+	idx += binary.PutUvarint(buf[idx:], uint64(manifest.MergeFirstFileId))
+	return buf[:idx]
+}
+
+func decodeManifest(buf []byte) (*Manifest, error) {
+	var idx = 0
+	next := func() (uint32, bool) {
+		v, n := binary.Uvarint(buf[idx:])
+		if n <= 0 || v > uint64(^uint32(0)) {
+			return 0, false
+		}
+		idx += n
+		return uint32(v), true
+	}
+	nextIds := func() ([]uint32, bool) {
+		count, ok := next()
+		if !ok || int(count) > len(buf)-idx {
+			return nil, false
+		}
+		var ids []uint32
+		for i := uint32(0); i < count; i++ {
+			fileId, ok := next()
+			if !ok {
+				return nil, false
+			}
+			ids = append(ids, fileId)
+		}
+		return ids, true
+	}
+
+	version, ok := next()
+	if !ok {
+		return nil, ErrInvalidManifest
+	}
+	if version != manifestVersion {
+		return nil, ErrUnsupportedManifestVersion
+	}
+
+	manifest := &Manifest{}
+	if manifest.ActiveFileId, ok = next(); !ok {
+		return nil, ErrInvalidManifest
+	}
+	if manifest.MergeBoundary, ok = next(); !ok {
+		return nil, ErrInvalidManifest
+	}
+	if manifest.DataFileIds, ok = nextIds(); !ok {
+		return nil, ErrInvalidManifest
+	}
+	if manifest.HintFileIds, ok = nextIds(); !ok {
+		return nil, ErrInvalidManifest
+	}
+	if manifest.MergedFileIds, ok = nextIds(); !ok {
+		return nil, ErrInvalidManifest
+	}
+	if manifest.BlobFileIds, ok = nextIds(); !ok {
+		return nil, ErrInvalidManifest
+	}
+	if manifest.FooterFileIds, ok = nextIds(); !ok {
+		return nil, ErrInvalidManifest
+	}
+	if manifest.MergeFirstFileId, ok = next(); !ok {
+		return nil, ErrInvalidManifest
+	}
+	if idx != len(buf) {
+		return nil, ErrInvalidManifest
+	}
+	return manifest, nil
+}
@@ -0,0 +1,60 @@
+package data
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	dirPath := filepath.Join(os.TempDir(), "manifest-test")
+	_ = os.MkdirAll(dirPath, os.ModePerm)
+	defer func() {
+		_ = os.RemoveAll(dirPath)
+	}()
+
+	// 1.manifest 不存在
+	manifest, err := ReadManifest(dirPath)
+	assert.Nil(t, err)
+	assert.Nil(t, manifest)
+
+	// 2.写入并读取
+	m1 := &Manifest{
+		ActiveFileId:  9,
+		DataFileIds:   []uint32{1, 5, 6},
+		HintFileIds:   []uint32{5, 6},
+		MergeBoundary: 9,
+		MergedFileIds: []uint32{0, 2, 3},
+	}
+	assert.Nil(t, WriteManifest(dirPath, m1))
+	manifest, err = ReadManifest(dirPath)
+	assert.Nil(t, err)
+	assert.Equal(t, m1, manifest)
+
+	// 3.重写之后只能读到新的 manifest
+	m2 := &Manifest{ActiveFileId: 10, DataFileIds: []uint32{1, 5, 6, 9}, HintFileIds: []uint32{5, 6}, MergeBoundary: 9, BlobFileIds: []uint32{2, 3}, FooterFileIds: []uint32{1, 5}, MergeFirstFileId: 5}
+	assert.Nil(t, WriteManifest(dirPath, m2))
+	manifest, err = ReadManifest(dirPath)
+	assert.Nil(t, err)
+	assert.Equal(t, m2, manifest)
+
+	// 4.其他版本写入的 manifest
+	buf := encodeManifest(m1)
+	buf[0] = manifestVersion + 1
+	_, err = decodeManifest(buf)
+	assert.Equal(t, ErrUnsupportedManifestVersion, err)
+
+	// 5.manifest 被损坏
+	fileName := filepath.Join(dirPath, ManifestFileName)
+	buf, err = os.ReadFile(fileName)
+	assert.Nil(t, err)
+	buf[len(buf)-1] ^= 0xff
+	assert.Nil(t, os.WriteFile(fileName, buf, 0644))
+	_, err = ReadManifest(dirPath)
+	assert.Equal(t, ErrInvalidManifest, err)
+
+	assert.Nil(t, os.Truncate(fileName, int64(len(buf)-3)))
+	_, err = ReadManifest(dirPath)
+	assert.Equal(t, ErrInvalidManifest, err)
+}
@@ -0,0 +1,92 @@
+package data
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+const readerBufferSize = 1 << 20
+
+// LogRecordReader 顺序读取 LogRecord，使用缓冲减少系统调用
+// 适合加载快照、导入等需要从头到尾读取整个文件的场景
+type LogRecordReader struct {
+	reader *bufio.Reader
+	offset int64
+	codec  *Codec // 解压记录使用的编码方式
+}
+
+// NewLogRecordReader 初始化顺序读取器
+func NewLogRecordReader(r io.Reader) *LogRecordReader {
+	return &LogRecordReader{
+		reader: bufio.NewReaderSize(r, readerBufferSize),
+	}
+}
+
+// Next 读取下一条 LogRecord，返回记录及其大小，读取到末尾或者 footer 时返回 io.EOF
+func (lr *LogRecordReader) Next() (*LogRecord, int64, error) {
+	// 读取 Header 信息，末尾不足最大 header 长度时只返回剩余的部分
+	headerBuf, err := lr.reader.Peek(maxLogRecordHeaderSize)
+	if err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+
+	header, headerSize := decodeLogRecordHeader(headerBuf)
+	if header == nil {
+		return nil, 0, io.EOF
+	}
+	if header.crc == 0 && header.keySize == 0 && header.valueSize == 0 {
+		return nil, 0, io.EOF
+	}
+	headerBuf = append([]byte(nil), headerBuf[:headerSize]...)
+	if _, err := lr.reader.Discard(int(headerSize)); err != nil {
+		return nil, 0, err
+	}
+
+	keySize, valueSize := int64(header.keySize), int64(header.valueSize)
+	var kvBuf []byte
+	if keySize > 0 || valueSize > 0 {
+		if kvBuf, err = readFull(lr.reader, keySize+valueSize); err != nil {
+			// 记录不完整，说明写入时发生了中断或者文件被截断
+			if err == io.ErrUnexpectedEOF || err == io.EOF {
+				return nil, 0, ErrInvalidRecordSize
+			}
+			return nil, 0, err
+		}
+	}
+
+	logRecord, err := buildLogRecord(header, headerBuf, kvBuf, lr.codec)
+	if err != nil {
+		return nil, 0, err
+	}
+	// footer 之后没有数据记录
+	if logRecord.Type == LogRecordFooter {
+		return nil, 0, io.EOF
+	}
+	recordSize := headerSize + keySize + valueSize
+	lr.offset += recordSize
+	return logRecord, recordSize, nil
+}
+
+// 读取 n 个字节，较长时随着读取逐步分配内存，避免按照损坏的 header 中的长度一次分配过多内存
+func readFull(r io.Reader, n int64) ([]byte, error) {
+	if n <= readerBufferSize {
+		buf := make([]byte, n)
+		_, err := io.ReadFull(r, buf)
+		return buf, err
+	}
+	var buf bytes.Buffer
+	buf.Grow(readerBufferSize)
+	if _, err := io.CopyN(&buf, r, n); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Offset 已经读取的字节数
+func (lr *LogRecordReader) Offset() int64 {
+	return lr.offset
+}
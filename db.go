@@ -3,6 +3,8 @@ package KV
 import (
 	"KV/data"
 	"KV/index"
+	"KV/utils"
+	"encoding/binary"
 	"errors"
 	"io"
 	"os"
@@ -11,6 +13,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 const (
@@ -18,16 +21,39 @@ const (
 )
 
 type DB struct {
-	options         Options
-	mu              *sync.RWMutex
-	fileIds         []int                     // 文件 id，只能在加载索引的时候使用，不能在其他的地方更新和使用
-	activeFile      *data.DataFile            // 当前活跃数据文件，可以用于写入
-	olderFiles      map[uint32]*data.DataFile // 旧的数据文件，只能用于读
-	index           index.Indexer             // 内存索引
-	seqNo           uint64                    // 事务序列号，全局递增 atomic
-	isMerging       bool
-	seqNoFileExists bool
-	isInitial       bool
+	options          Options
+	mu               *sync.RWMutex
+	fileIds          []int                     // 文件 id，只能在加载索引的时候使用，不能在其他的地方更新和使用
+	activeFile       *data.DataFile            // 当前活跃数据文件，可以用于写入
+	olderFiles       map[uint32]*data.DataFile // 旧的数据文件，只能用于读
+	index            index.Indexer             // 内存索引
+	persistentIndex  bool                      // 索引是否持久化，持久化的索引启动时不需要重建
+	seqNo            uint64                    // 事务序列号，全局递增 atomic
+	isMerging        bool
+	isBlobGC         bool
+	seqNoFileExists  bool
+	isInitial        bool
+	snapshotMu       *sync.Mutex   // 保证同一时间只有一个索引快照在写入
+	closeCh          chan struct{} // 关闭时通知后台任务退出
+	closeOnce        *sync.Once
+	closed           bool
+	failed           bool // merge 生效之后更新内存状态失败，内存和磁盘上的数据不一致，只能重新打开
+	bgWait           *sync.WaitGroup
+	secondaryIndexes map[string]IndexFunc      // 二级索引定义
+	indexDefs        map[string]struct{}       // 已经建立完成并且写入了定义记录的二级索引
+	fileStats        map[uint32]*fileStat      // 每个数据文件中有效和无效数据的大小，为 nil 时还没有统计
+	mergeLimiter     *utils.RateLimiter        // merge 读写数据的限速器
+	fileEpoch        uint64                    // 每次 merge 生效之后递增
+	readers          map[uint64]int            // 每个 epoch 中还没有关闭的迭代器数量
+	retiredFiles     map[uint32]*retiredFile   // 已经被 merge 替换，但是可能仍然被迭代器读取的数据文件
+	manifest         *data.Manifest            // 最近一次写入的 manifest，还没有数据文件时为 nil
+	codec            *data.Codec               // 数据文件中记录的编码方式
+	activeBlobFile   *data.DataFile            // 当前写入的 blob 文件
+	blobFiles        map[uint32]*data.DataFile // 旧的 blob 文件，只能用于读
+	retiredBlobFiles map[uint32]*retiredFile   // 已经被回收，但是可能仍然被迭代器读取的 blob 文件
+	footers          map[uint32]*data.Footer   // 已经写入 footer 的旧数据文件，校验失败的 footer 为 nil
+	sealCh           chan struct{}             // 通知后台任务为旧数据文件写入 footer
+	offline          bool                      // 转换格式时离线打开，不会修改数据目录中的文件
 }
 
 // Open 打开 bitcask 存储引擎实例
@@ -38,58 +64,141 @@ func Open(options Options) (*DB, error) {
 	}
 
 	// 判断数据目录是否存在，如果不存在的话，则创建这个目录
+	var isInitial bool
 	if _, err := os.Stat(options.DirPath); os.IsNotExist(err) {
+		isInitial = true
 		if err := os.MkdirAll(options.DirPath, os.ModePerm); err != nil {
 			return nil, err
 		}
 	}
+	entries, err := os.ReadDir(options.DirPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		isInitial = true
+	}
+
+	// 初始化索引
+	indexer, err := index.NewIndexer(options.IndexType, indexConfig(options))
+	if err != nil {
+		return nil, err
+	}
 
 	// 初始化 DB 实例结构体
 	db := &DB{
-		options:    options,
-		mu:         new(sync.RWMutex),
-		olderFiles: make(map[uint32]*data.DataFile),
-		index:      index.NewIndexer(options.IndexType, options.DirPath, options.SyncWrites),
+		options:          options,
+		mu:               new(sync.RWMutex),
+		olderFiles:       make(map[uint32]*data.DataFile),
+		index:            indexer,
+		persistentIndex:  index.IsPersistent(options.IndexType),
+		isInitial:        isInitial,
+		snapshotMu:       new(sync.Mutex),
+		closeCh:          make(chan struct{}),
+		closeOnce:        new(sync.Once),
+		bgWait:           new(sync.WaitGroup),
+		mergeLimiter:     utils.NewRateLimiter(options.MergeBytesPerSecond),
+		readers:          make(map[uint64]int),
+		retiredFiles:     make(map[uint32]*retiredFile),
+		blobFiles:        make(map[uint32]*data.DataFile),
+		retiredBlobFiles: make(map[uint32]*retiredFile),
+		footers:          make(map[uint32]*data.Footer),
+		sealCh:           make(chan struct{}, 1),
+		codec:            newCodec(options),
 	}
 
-	//加载 merge 目录
-	if err := db.loadMergeFiles(); err != nil {
+	// 加载 manifest 中列出的数据文件
+	if err := db.loadManifest(); err != nil {
 		return nil, err
 	}
+	// 内存索引需要重新构建，持久化索引只需要补齐没有覆盖到的数据
+	if !db.persistentIndex {
+		// 优先从索引快照中加载
+		loaded, err := db.loadIndexFromSnapshot()
+		if err != nil {
+			return nil, err
+		}
 
-	// 加载数据文件
-	if err := db.loadDataFiles(); err != nil {
-		return nil, err
+		if !loaded {
+			// 从数据文件中加载索引
+			if err := db.loadIndexFromDataFiles(); err != nil {
+				return nil, err
+			}
+		}
 	}
-	//b+ 磁盘索引
-	if options.IndexType != BPTree {
-		//加载 hint 索引
-		if err := db.loadIndexFromHintFile(); err != nil {
+
+	if db.persistentIndex {
+		if err := db.loadSeqNo(); err != nil {
 			return nil, err
 		}
 
-		// 从数据文件中加载索引
-		if err := db.loadIndexFromDataFiles(); err != nil {
+		// 磁盘索引中已经保存了高水位之前的数据，只需要重放之后写入的数据
+		if err := db.loadIndexFromCheckpoint(); err != nil {
 			return nil, err
 		}
 	}
 
-	if options.IndexType == BPTree {
-		if err := db.loadSeqNo(); err != nil {
+	db.loadIndexDefs()
+
+	// 启动后台任务
+	if !db.persistentIndex && options.IndexSnapshotInterval > 0 {
+		db.startBackgroundTask(func() {
+			db.runIndexSnapshotTask(options.IndexSnapshotInterval)
+		})
+	}
+	if options.MergeRatio > 0 {
+		if err := db.loadFileStats(); err != nil {
 			return nil, err
 		}
+		db.startBackgroundTask(func() {
+			db.runAutoMergeTask(options.MergeCheckInterval)
+		})
 	}
+	if options.BlobGCInterval > 0 {
+		db.startBackgroundTask(func() {
+			db.runAutoBlobGCTask(options.BlobGCInterval)
+		})
+	}
+	db.startBackgroundTask(db.runSealTask)
+	db.notifySeal()
 	return db, nil
 }
 
 // Close 关闭数据库
 func (db *DB) Close() error {
-	if db.activeFile == nil {
-		return nil
-	}
+	// 先停止后台任务，后台任务中可能需要获取锁
+	db.closeOnce.Do(func() {
+		close(db.closeCh)
+	})
+	db.bgWait.Wait()
+
+	db.snapshotMu.Lock()
+	defer db.snapshotMu.Unlock()
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
+	// 重复关闭时直接返回
+	if db.closed {
+		return nil
+	}
+	db.closed = true
+	if db.activeFile == nil {
+		return db.index.Close()
+	}
+
+	// 保存内存索引快照，下次启动时不需要重新构建索引，内存索引不可信时不保存
+	if !db.persistentIndex && !db.failed {
+		iterator, mark, seqNo := db.indexSnapshot()
+		if err := db.writeIndexSnapshot(iterator, mark, seqNo); err != nil {
+			return err
+		}
+	}
+	if !db.failed {
+		if err := db.writeFooterManifest(); err != nil {
+			return err
+		}
+	}
+
 	//保存当前事务 seqNo
 	seqNoFile, err := data.OpenSeqNoFile(db.options.DirPath)
 	if err != nil {
@@ -108,6 +217,11 @@ func (db *DB) Close() error {
 		return err
 	}
 
+	// 关闭索引
+	if err := db.index.Close(); err != nil {
+		return err
+	}
+
 	//	关闭当前活跃文件
 	if err := db.activeFile.Close(); err != nil {
 		return err
@@ -118,7 +232,30 @@ func (db *DB) Close() error {
 			return err
 		}
 	}
-	return nil
+	// 关闭 blob 文件
+	if err := db.closeBlobFiles(); err != nil {
+		return err
+	}
+
+	// 数据库关闭之后迭代器不能再使用，被 merge 替换的数据文件都可以删除
+	db.readers = make(map[uint64]int)
+	return db.releaseRetiredFiles()
+}
+
+// 根据配置项生成数据文件中记录的编码方式
+func newCodec(options Options) *data.Codec {
+	return &data.Codec{
+		Compressor:           options.Compression,
+		CompressionThreshold: options.CompressionThreshold,
+		KeyProvider:          options.Encryption,
+		EncryptKeys:          options.EncryptKeys,
+	}
+}
+
+// 启动后台任务，关闭数据库时等待其退出
+func (db *DB) startBackgroundTask(task func()) {
+	db.bgWait.Add(1)
+	go task()
 }
 
 // Sync 持久化数据文件
@@ -128,14 +265,34 @@ func (db *DB) Sync() error {
 	}
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	if err := db.syncBlobFile(); err != nil {
+		return err
+	}
 	return db.activeFile.Sync()
 }
 
 // Put 写入 Key/Value 数据，key 不能为空
 func (db *DB) Put(key []byte, value []byte) error {
 	// 判断 key 是否有效
-	if len(key) == 0 {
-		return ErrKeyIsEmpty
+	if err := checkUserKey(key); err != nil {
+		return err
+	}
+	if err := db.checkKeyValueSize(key, value); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// 需要同时更新二级索引时，和数据一起通过事务写入
+	indexRecords, err := db.secondaryIndexRecords(key, value, data.LogRecordNormal)
+	if err != nil {
+		return err
+	}
+	indexRecords = append(indexRecords, db.staleIndexDefRecords()...)
+	if len(indexRecords) > 0 {
+		records := append([]*data.LogRecord{{Key: key, Value: value, Type: data.LogRecordNormal}}, indexRecords...)
+		return db.writeTransaction(records, db.options.SyncWrites)
 	}
 
 	// 构造 LogRecord 结构体
@@ -146,48 +303,59 @@ func (db *DB) Put(key []byte, value []byte) error {
 	}
 
 	// 追加写入到当前活跃数据文件当中
-	pos, err := db.appendLogRecordWithLock(logRecord)
+	pos, err := db.appendLogRecord(logRecord)
 	if err != nil {
 		return err
 	}
 
 	// 更新内存索引
-	if ok := db.index.Put(key, pos); !ok {
-		return ErrIndexUpdateFailed
-	}
-
-	return nil
+	return db.indexLogRecord(key, data.LogRecordNormal, pos)
 }
 
 // Delete 根据 key 删除对应的数据
 func (db *DB) Delete(key []byte) error {
 	// 判断 key 的有效性
-	if len(key) == 0 {
-		return ErrKeyIsEmpty
+	if err := checkUserKey(key); err != nil {
+		return err
 	}
 
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
 	// 先检查 key 是否存在，如果不存在的话直接返回
 	if pos := db.index.Get(key); pos == nil {
 		return nil
 	}
 
+	// 需要同时删除二级索引记录时，和数据一起通过事务写入
+	indexRecords, err := db.secondaryIndexRecords(key, nil, data.LogRecordDeleted)
+	if err != nil {
+		return err
+	}
+	indexRecords = append(indexRecords, db.staleIndexDefRecords()...)
+	if len(indexRecords) > 0 {
+		records := append([]*data.LogRecord{{Key: key, Type: data.LogRecordDeleted}}, indexRecords...)
+		return db.writeTransaction(records, db.options.SyncWrites)
+	}
+
 	// 构造 LogRecord，标识其是被删除的
 	logRecord := &data.LogRecord{
 		Key:  logRecordKeyWithSeqNo(key, nonTransactionSeqNo),
 		Type: data.LogRecordDeleted,
 	}
 	// 写入到数据文件当中
-	_, err := db.appendLogRecordWithLock(logRecord)
+	pos, err := db.appendLogRecord(logRecord)
 	if err != nil {
-		return nil
+		return err
 	}
 
 	//	从内存索引中将对应的 key 删除
-	ok := db.index.Delete(key)
-	if !ok {
-		return ErrIndexUpdateFailed
-	}
-	return nil
+	return db.indexLogRecord(key, data.LogRecordDeleted, pos)
+}
+
+// RecordMeta 记录的元数据
+type RecordMeta struct {
+	Timestamp time.Time // 写入时间，之前版本写入的记录没有写入时间，为零值
 }
 
 // Get 根据 key 读取数据
@@ -211,25 +379,59 @@ func (db *DB) Get(key []byte) ([]byte, error) {
 	return db.getValueByPosition(logRecordPos)
 }
 
+// GetWithMeta 根据 key 读取数据及其写入时间
+func (db *DB) GetWithMeta(key []byte) ([]byte, *RecordMeta, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if len(key) == 0 {
+		return nil, nil, ErrKeyIsEmpty
+	}
+	logRecordPos := db.index.Get(key)
+	if logRecordPos == nil {
+		return nil, nil, ErrKeyNotFound
+	}
+	logRecord, err := db.getRecordByPosition(logRecordPos)
+	if err != nil {
+		return nil, nil, err
+	}
+	return logRecord.Value, &RecordMeta{Timestamp: timestampToTime(logRecord.Timestamp)}, nil
+}
+
 // ListKeys 获取数据库中所有的 key
 func (db *DB) ListKeys() [][]byte {
 	iterator := db.index.Iterator(false)
-	keys := make([][]byte, db.index.Size())
-	var idx int
+	defer iterator.Close()
+	keys := make([][]byte, 0, db.index.Size())
 	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
-		keys[idx] = iterator.Key()
-		idx++
+		if isInternalKey(iterator.Key()) {
+			continue
+		}
+		keys = append(keys, iterator.Key())
 	}
 	return keys
 }
 
+// IndexMemoryUsage 索引占用的内存大小，索引没有实现 index.MemoryReporter 时返回 false
+func (db *DB) IndexMemoryUsage() (int64, bool) {
+	reporter, ok := db.index.(index.MemoryReporter)
+	if !ok {
+		return 0, false
+	}
+	return reporter.MemoryUsage(), true
+}
+
 // Fold 获取所有的数据，并执行用户指定的操作，函数返回 false 时终止遍历
 func (db *DB) Fold(fn func(key []byte, value []byte) bool) error {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
 	iterator := db.index.Iterator(false)
+	defer iterator.Close()
 	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		if isInternalKey(iterator.Key()) {
+			continue
+		}
 		value, err := db.getValueByPosition(iterator.Value())
 		if err != nil {
 			return err
@@ -241,15 +443,43 @@ func (db *DB) Fold(fn func(key []byte, value []byte) bool) error {
 	return nil
 }
 
+// 检查 key 和 value 的长度是否超过限制
+func (db *DB) checkKeyValueSize(key, value []byte) error {
+	return db.checkRecordSize(uint64(len(key)), uint64(len(value)))
+}
+
+// 根据长度校验 key 和 value，用于读取数据之前
+func (db *DB) checkRecordSize(keySize, valueSize uint64) error {
+	if db.options.MaxKeySize > 0 && keySize > uint64(db.options.MaxKeySize) || keySize > uint64(db.options.DataFileSize) {
+		return ErrKeyTooLarge
+	}
+	maxValueSize := uint64(db.options.MaxValueSize)
+	if maxValueSize == 0 {
+		maxValueSize = uint64(db.options.DataFileSize)
+	}
+	if valueSize > maxValueSize {
+		return ErrValueTooLarge
+	}
+	// 编码之后的整条记录也不能超过数据文件的大小，事务中的 key 前面还有序列号
+	if db.codec.MaxEncodedSize(int64(keySize)+binary.MaxVarintLen64, int64(valueSize)) > db.options.DataFileSize {
+		return ErrValueTooLarge
+	}
+	return nil
+}
+
 // 根据索引信息获取对应的 value
 func (db *DB) getValueByPosition(logRecordPos *data.LogRecordPos) ([]byte, error) {
-	// 根据文件 id 找到对应的数据文件
-	var dataFile *data.DataFile
-	if db.activeFile.FileId == logRecordPos.Fid {
-		dataFile = db.activeFile
-	} else {
-		dataFile = db.olderFiles[logRecordPos.Fid]
+	logRecord, err := db.getRecordByPosition(logRecordPos)
+	if err != nil {
+		return nil, err
 	}
+	return logRecord.Value, nil
+}
+
+// 根据索引信息读取对应的记录，保存在 blob 文件中的 value 会被读取出来
+func (db *DB) getRecordByPosition(logRecordPos *data.LogRecordPos) (*data.LogRecord, error) {
+	// 根据文件 id 找到对应的数据文件
+	dataFile := db.dataFileById(logRecordPos.Fid)
 	// 数据文件为空
 	if dataFile == nil {
 		return nil, ErrDataFileNotFound
@@ -265,39 +495,90 @@ func (db *DB) getValueByPosition(logRecordPos *data.LogRecordPos) ([]byte, error
 		return nil, ErrKeyNotFound
 	}
 
-	return logRecord.Value, nil
+	// 较大的 value 保存在 blob 文件中
+	if logRecord.Blob {
+		value, err := db.readBlobValue(data.DecodeLogRecordPos(logRecord.Value))
+		if err != nil {
+			return nil, err
+		}
+		logRecord.Value, logRecord.Blob = value, false
+	}
+	return logRecord, nil
 }
 
-func (db *DB) appendLogRecordWithLock(logRecord *data.LogRecord) (*data.LogRecordPos, error) {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-	return db.appendLogRecord(logRecord)
+// 根据文件 id 找到对应的数据文件，不存在时返回 nil
+func (db *DB) dataFileById(fileId uint32) *data.DataFile {
+	if db.activeFile != nil && db.activeFile.FileId == fileId {
+		return db.activeFile
+	}
+	if file, ok := db.olderFiles[fileId]; ok {
+		return file
+	}
+	if retired, ok := db.retiredFiles[fileId]; ok {
+		// merge 之前创建的迭代器仍然读取旧的数据文件
+		return retired.file
+	}
+	return nil
 }
 
 // 追加写数据到活跃文件中
 func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, error) {
-	// 判断当前活跃数据文件是否存在，因为数据库在没有写入的时候是没有文件生成的
-	// 如果为空则初始化数据文件
-	if db.activeFile == nil {
-		if err := db.setActiveDataFile(); err != nil {
+	// value 超过阈值时写入 blob 文件，数据文件中只保存 blob 文件中的位置
+	isBlob := db.options.BlobThreshold > 0 && logRecord.Type == data.LogRecordNormal && !logRecord.Blob &&
+		len(logRecord.Value) > db.options.BlobThreshold
+	return db.appendRecord(logRecord, isBlob)
+}
+
+// 追加写数据到活跃文件中，isBlob 为 true 时 value 写入 blob 文件
+// 写入 blob 文件之前位置还没有确定，使用位置编码之后的最大长度判断数据文件是否需要切换
+// 在访问此方法前必须持有互斥锁
+func (db *DB) appendRecord(logRecord *data.LogRecord, isBlob bool) (*data.LogRecordPos, error) {
+	if db.failed {
+		return nil, ErrDatabaseFailed
+	}
+	// 记录写入时间，事务中的记录使用同一个时间
+	if logRecord.Timestamp == 0 && logRecord.Type != data.LogRecordTxnFinished {
+		logRecord.Timestamp = db.now()
+	}
+
+	var encRecord, encBlobRecord []byte
+	var size, blobSize int64
+	var err error
+	if isBlob {
+		if encBlobRecord, blobSize, err = db.codec.EncodeLogRecord(logRecord); err != nil {
+			return nil, err
+		}
+		size = db.codec.MaxEncodedSize(int64(len(logRecord.Key)), data.MaxLogRecordPosSize)
+	} else {
+		if encRecord, size, err = db.codec.EncodeLogRecord(logRecord); err != nil {
 			return nil, err
 		}
 	}
 
-	// 写入数据编码
-	encRecord, size := data.EncodeLogRecord(logRecord)
-	// 如果写入的数据已经到达了活跃文件的阈值，则关闭活跃文件，并打开新的文件
-	if db.activeFile.WriteOff+size > db.options.DataFileSize {
-		// 先持久化数据文件，保证已有的数据持久到磁盘当中
-		if err := db.activeFile.Sync(); err != nil {
+	// 数据库在没有写入的时候是没有文件生成的，写入的数据到达文件的阈值时切换到新的文件
+	// 数据文件和 blob 文件同时切换时只写入一次 manifest
+	rotateData := db.activeFile == nil || db.activeFile.WriteOff+size > db.options.DataFileSize
+	rotateBlob := isBlob && (db.activeBlobFile == nil ||
+		(db.activeBlobFile.WriteOff > 0 && db.activeBlobFile.WriteOff+blobSize > db.options.DataFileSize))
+	if rotateData || rotateBlob {
+		if err := db.rotateFiles(rotateData, rotateBlob); err != nil {
 			return nil, err
 		}
+	}
 
-		// 当前活跃文件转换为旧的数据文件
-		db.olderFiles[db.activeFile.FileId] = db.activeFile
-
-		// 打开新的数据文件
-		if err := db.setActiveDataFile(); err != nil {
+	if isBlob {
+		blobPos, err := db.writeBlobRecord(encBlobRecord, blobSize)
+		if err != nil {
+			return nil, err
+		}
+		logRecord = &data.LogRecord{
+			Key:       logRecord.Key,
+			Value:     data.EncodeLogRecordPos(blobPos),
+			Type:      logRecord.Type,
+			Blob:      true,
+			Timestamp: logRecord.Timestamp,
+		}
+		if encRecord, size, err = db.codec.EncodeLogRecord(logRecord); err != nil {
 			return nil, err
 		}
 	}
@@ -315,19 +596,160 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
 	}
 
 	// 构造内存索引信息
-	pos := &data.LogRecordPos{Fid: db.activeFile.FileId, Offset: writeOff}
+	pos := &data.LogRecordPos{Fid: db.activeFile.FileId, Offset: writeOff, Size: uint32(size)}
 	return pos, nil
 }
 
-// 设置当前活跃文件
+// 当前时间，Unix 纳秒时间戳
+func (db *DB) now() int64 {
+	if db.options.Clock == nil {
+		return time.Now().UnixNano()
+	}
+	return db.options.Clock().UnixNano()
+}
+
+// 将记录中的时间戳转换为 time.Time，没有写入时间时返回零值
+func timestampToTime(timestamp int64) time.Time {
+	if timestamp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, timestamp)
+}
+
+// 更新索引，同时统计每个数据文件中被覆盖或者删除的旧数据的大小
+// 删除时 pos 为删除标记的位置，删除标记本身也是可以回收的
+// 在访问此方法前必须持有互斥锁
+func (db *DB) updateIndex(batch index.Batch, key []byte, typ data.LogRecordType, pos *data.LogRecordPos) bool {
+	if db.fileStats != nil {
+		db.updateFileStats(batch.Get(key), typ, pos)
+	}
+	if typ == data.LogRecordDeleted {
+		return batch.Delete(key)
+	}
+	return batch.Put(key, pos)
+}
+
+// 更新一条记录的索引
+// 在访问此方法前必须持有互斥锁
+func (db *DB) indexLogRecord(key []byte, typ data.LogRecordType, pos *data.LogRecordPos) error {
+	return db.batchIndex(pos, func(batch index.Batch) error {
+		if ok := db.updateIndex(batch, key, typ, pos); !ok {
+			return ErrIndexUpdateFailed
+		}
+		return nil
+	})
+}
+
+// 在一个事务中执行 fn 中的索引更新，last 不为空时同时记录持久化索引已经覆盖到 last 这条记录
+// 持久化索引只需要提交一次，崩溃之后索引和高水位也不会不一致
 // 在访问此方法前必须持有互斥锁
-func (db *DB) setActiveDataFile() error {
-	var initialFileId uint32 = 0
+func (db *DB) batchIndex(last *data.LogRecordPos, fn func(batch index.Batch) error) error {
+	var checkpointed bool
+	apply := func(batch index.Batch) error {
+		if err := fn(batch); err != nil {
+			return err
+		}
+		if cp, ok := batch.(index.Checkpointer); ok && last != nil {
+			checkpointed = cp.SetCheckpoint(checkpointAfter(last))
+		}
+		return nil
+	}
+
+	var err error
+	if batcher, ok := db.index.(index.Batcher); ok {
+		err = batcher.Batch(apply)
+	} else {
+		err = apply(db.index)
+	}
+	if err != nil {
+		return err
+	}
+	// 事务中不能更新高水位的索引单独更新
+	if cp, ok := db.index.(index.Checkpointer); ok && last != nil && !checkpointed {
+		cp.SetCheckpoint(checkpointAfter(last))
+	}
+	return nil
+}
+
+// 关闭所有的数据文件
+func (db *DB) closeDataFiles() {
 	if db.activeFile != nil {
-		initialFileId = db.activeFile.FileId + 1
+		_ = db.activeFile.Close()
+	}
+	for _, file := range db.olderFiles {
+		_ = file.Close()
 	}
-	// 打开新的数据文件
-	dataFile, err := data.OpenDataFile(db.options.DirPath, initialFileId)
+	_ = db.closeBlobFiles()
+}
+
+// 已经更新到索引中的最后一条记录对应的高水位
+func checkpointAfter(pos *data.LogRecordPos) *data.LogRecordPos {
+	return &data.LogRecordPos{Fid: pos.Fid, Offset: pos.Offset + int64(pos.Size)}
+}
+
+// 切换到新的活跃数据文件或者活跃 blob 文件，之前的活跃文件转换为旧的文件
+// 两者同时切换时只写入一次 manifest，先写入 manifest，保证写入新文件中的数据在重启之后可见
+// 在访问此方法前必须持有互斥锁
+func (db *DB) rotateFiles(rotateData, rotateBlob bool) error {
+	// 先持久化旧的文件，保证已有的数据持久到磁盘当中
+	if err := db.syncBlobFile(); err != nil {
+		return err
+	}
+	var activeFileId, blobFileId uint32
+	if db.activeFile != nil {
+		activeFileId = db.activeFile.FileId
+		if rotateData {
+			if err := db.activeFile.Sync(); err != nil {
+				return err
+			}
+			// 当前活跃文件转换为旧的数据文件
+			db.olderFiles[db.activeFile.FileId] = db.activeFile
+			activeFileId++
+		}
+	}
+	if db.activeBlobFile != nil {
+		blobFileId = db.activeBlobFile.FileId + 1
+	}
+
+	manifest := db.newManifest(activeFileId, nil, nil)
+	if rotateBlob {
+		manifest.BlobFileIds = append(manifest.BlobFileIds, blobFileId)
+	}
+	if err := db.writeManifest(manifest); err != nil {
+		return err
+	}
+
+	if rotateData {
+		dataFile, err := db.openDataFile(db.options.DirPath, activeFileId)
+		if err != nil {
+			return err
+		}
+		if db.activeFile != nil {
+			db.notifySeal()
+		}
+		db.activeFile = dataFile
+	}
+	if rotateBlob {
+		blobFile, err := db.openBlobFile(blobFileId)
+		if err != nil {
+			return err
+		}
+		if db.activeBlobFile != nil {
+			db.blobFiles[db.activeBlobFile.FileId] = db.activeBlobFile
+		}
+		db.activeBlobFile = blobFile
+	}
+	return nil
+}
+
+// 打开指定 id 的数据文件作为活跃文件，之前的活跃文件需要已经放入旧的数据文件中
+// 先写入 manifest，保证写入新的活跃文件中的数据在重启之后可见
+// 在访问此方法前必须持有互斥锁
+func (db *DB) openActiveDataFile(fileId uint32) error {
+	if err := db.writeManifest(db.newManifest(fileId, nil, nil)); err != nil {
+		return err
+	}
+	dataFile, err := db.openDataFile(db.options.DirPath, fileId)
 	if err != nil {
 		return err
 	}
@@ -335,7 +757,17 @@ func (db *DB) setActiveDataFile() error {
 	return nil
 }
 
-// 从磁盘中加载数据文件
+// 打开数据文件，读取时使用当前的编码方式解压记录
+func (db *DB) openDataFile(dirPath string, fileId uint32) (*data.DataFile, error) {
+	dataFile, err := data.OpenDataFile(dirPath, fileId)
+	if err != nil {
+		return nil, err
+	}
+	dataFile.Codec = db.codec
+	return dataFile, nil
+}
+
+// 从磁盘中加载数据文件，只用于还没有 manifest 的数据目录
 func (db *DB) loadDataFiles() error {
 	dirEntries, err := os.ReadDir(db.options.DirPath)
 	if err != nil {
@@ -362,7 +794,7 @@ func (db *DB) loadDataFiles() error {
 
 	// 遍历每个文件id，打开对应的数据文件
 	for i, fid := range fileIds {
-		dataFile, err := data.OpenDataFile(db.options.DirPath, uint32(fid))
+		dataFile, err := db.openDataFile(db.options.DirPath, uint32(fid))
 		if err != nil {
 			return err
 		}
@@ -383,36 +815,116 @@ func (db *DB) loadIndexFromDataFiles() error {
 		return nil
 	}
 
-	//和 hint 冲突的 index 不加载
-	hasMerge, nonMergeFileId := false, uint32(0)
-	mergeFinishFileName := filepath.Join(db.options.DirPath, data.MergeFinishFileName)
-	if _, err := os.Stat(mergeFinishFileName); err == nil {
-		fid, err := db.getNonMergeFileId(db.options.DirPath)
+	_, err := db.replayDataFiles(&data.LogRecordPos{Fid: 0, Offset: 0})
+	return err
+}
+
+// 从持久化索引的高水位开始重放数据文件，补齐崩溃时没有来得及更新到索引中的数据
+func (db *DB) loadIndexFromCheckpoint() error {
+	if len(db.fileIds) == 0 {
+		return nil
+	}
+
+	// 索引没有记录高水位，直接信任索引中的数据，只需要更新活跃文件的写入位置
+	cp, ok := db.index.(index.Checkpointer)
+	if !ok {
+		size, err := db.activeFile.IoManager.Size()
 		if err != nil {
 			return err
 		}
-		hasMerge = true
-		nonMergeFileId = fid
+		db.activeFile.WriteOff = size
+		return nil
 	}
 
-	updateIndex := func(key []byte, typ data.LogRecordType, logRecordPos *data.LogRecordPos) {
-		var ok bool
-		if typ == data.LogRecordDeleted {
-			ok = db.index.Delete(key)
-		} else {
-			ok = db.index.Put(key, logRecordPos)
+	// 高水位和索引一起提交，但是数据文件不一定已经持久化，崩溃之后高水位可能超出了数据文件的末尾
+	// 这时索引中可能有指向已经丢失的数据的位置，需要清空索引之后重新构建
+	start := cp.Checkpoint()
+	if start != nil {
+		valid, err := db.checkpointValid(start)
+		if err != nil {
+			return err
 		}
-		if !ok {
-			panic("failed to update index while startup")
+		if !valid {
+			if err := db.resetIndex(); err != nil {
+				return err
+			}
+			start = nil
 		}
 	}
+	// 没有高水位，说明索引是新建的，需要重放全部数据
+	if start == nil {
+		start = &data.LogRecordPos{Fid: 0, Offset: 0}
+	}
+
+	end, err := db.replayDataFiles(start)
+	if err != nil {
+		return err
+	}
+	cp.SetCheckpoint(end)
+	return nil
+}
 
-	var currentSeqNo uint64 = nonTransactionSeqNo
+// 判断高水位是否在数据文件的范围之内
+// 高水位所在的数据文件已经被 merge 替换时，之后的数据文件仍然会被重放
+func (db *DB) checkpointValid(cp *data.LogRecordPos) (bool, error) {
+	if cp.Fid > db.activeFile.FileId {
+		return false, nil
+	}
+	dataFile := db.dataFileById(cp.Fid)
+	if dataFile == nil {
+		return true, nil
+	}
+	size, err := dataFile.IoManager.Size()
+	if err != nil {
+		return false, err
+	}
+	return cp.Offset <= size, nil
+}
+
+// 清空持久化索引中的所有 key，之后从头重放数据文件
+func (db *DB) resetIndex() error {
+	var keys [][]byte
+	iterator := db.index.Iterator(false)
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		keys = append(keys, append([]byte(nil), iterator.Key()...))
+	}
+	iterator.Close()
+
+	return db.batchIndex(nil, func(batch index.Batch) error {
+		for _, key := range keys {
+			batch.Delete(key)
+		}
+		return nil
+	})
+}
+
+// 从 start 位置开始依次读取数据文件中的记录，并更新到索引中
+// 返回重放结束的位置
+func (db *DB) replayDataFiles(start *data.LogRecordPos) (*data.LogRecordPos, error) {
+	// 重放范围删除标记时可能发生错误，在每条记录之后检查
+	var replayErr error
+	updateIndex := func(key []byte, typ data.LogRecordType, logRecordPos *data.LogRecordPos) {
+		switch typ {
+		case data.LogRecordDeleted:
+			db.index.Delete(key)
+		case data.LogRecordRangeDeleted:
+			if err := db.replayRangeTombstone(logRecordPos); err != nil && replayErr == nil {
+				replayErr = err
+			}
+		default:
+			if ok := db.index.Put(key, logRecordPos); !ok {
+				panic("failed to update index while startup")
+			}
+		}
+	}
+
+	end := &data.LogRecordPos{Fid: start.Fid, Offset: start.Offset}
+	var currentSeqNo = db.seqNo
 	transactionRecords := make(map[uint64][]*data.TransactionRecord)
 	// 遍历所有的文件id，处理文件中的记录
 	for i, fid := range db.fileIds {
 		var fileId = uint32(fid)
-		if hasMerge && fileId < nonMergeFileId {
+		if fileId < start.Fid {
 			continue
 		}
 
@@ -424,17 +936,41 @@ func (db *DB) loadIndexFromDataFiles() error {
 		}
 
 		var offset int64 = 0
+		if fileId == start.Fid {
+			offset = start.Offset
+		}
+
+		// merge 生成的数据文件有对应的 hint 文件，直接从 hint 文件中加载
+		if offset == 0 {
+			loaded, err := db.loadIndexFromHintFile(db.options.DirPath, fileId, updateIndex)
+			if err != nil {
+				return nil, err
+			}
+			if replayErr != nil {
+				return nil, replayErr
+			}
+			if loaded {
+				if offset, err = dataFile.IoManager.Size(); err != nil {
+					return nil, err
+				}
+			}
+		}
 		for {
 			logRecord, size, err := dataFile.ReadLogRecord(offset)
 			if err != nil {
 				if err == io.EOF {
 					break
 				}
-				return err
+				// 只有活跃文件末尾的记录可能因为写入中断而不完整，旧的数据文件不完整说明已经损坏
+				// 配置了 RepairTruncatedTail 时才丢弃活跃文件末尾不完整的记录
+				if err == data.ErrInvalidRecordSize && i == len(db.fileIds)-1 && db.options.RepairTruncatedTail {
+					break
+				}
+				return nil, err
 			}
 
 			// 构造内存索引信息
-			pos := &data.LogRecordPos{Fid: fileId, Offset: offset}
+			pos := &data.LogRecordPos{Fid: fileId, Offset: offset, Size: uint32(size)}
 
 			// 解析 key，取出事务序列号
 			realKey, seqNo := parseLogRecordKey(logRecord.Key)
@@ -457,6 +993,9 @@ func (db *DB) loadIndexFromDataFiles() error {
 					})
 				}
 			}
+			if replayErr != nil {
+				return nil, replayErr
+			}
 			// 更新事务序列号
 			if seqNo > currentSeqNo {
 				currentSeqNo = seqNo
@@ -466,14 +1005,44 @@ func (db *DB) loadIndexFromDataFiles() error {
 			offset += size
 		}
 
+		end.Fid, end.Offset = fileId, offset
 		// 如果是当前活跃文件，更新这个文件的 WriteOff
+		// 修复时截断末尾没有写完整的数据，之后写入的数据紧接在最后一条完整的记录之后
 		if i == len(db.fileIds)-1 {
+			size, err := dataFile.IoManager.Size()
+			if err != nil {
+				return nil, err
+			}
+			if size > offset && !db.offline {
+				if err := dataFile.IoManager.Truncate(offset); err != nil {
+					return nil, err
+				}
+			}
 			db.activeFile.WriteOff = offset
 		}
 	}
+
+	// 高水位之后已经没有数据文件，直接以文件大小作为写入位置
+	if db.activeFile != nil && start.Fid > db.activeFile.FileId {
+		size, err := db.activeFile.IoManager.Size()
+		if err != nil {
+			return nil, err
+		}
+		db.activeFile.WriteOff = size
+	}
+
 	//更新当前最新的序列号
 	db.seqNo = currentSeqNo
-	return nil
+	return end, nil
+}
+
+func indexConfig(options Options) index.Config {
+	return index.Config{
+		DirPath:      options.DirPath,
+		SyncWrites:   options.SyncWrites,
+		DataFileSize: options.DataFileSize,
+		Params:       options.IndexParams,
+	}
 }
 
 func checkOptions(options Options) error {
@@ -483,29 +1052,91 @@ func checkOptions(options Options) error {
 	if options.DataFileSize <= 0 {
 		return errors.New("database data file size must be greater than 0")
 	}
+	if options.MergeRatio < 0 || options.MergeRatio > 1 {
+		return errors.New("invalid merge ratio, must between 0 and 1")
+	}
+	if options.MergeFileGarbageRatio < 0 || options.MergeFileGarbageRatio > 1 {
+		return errors.New("invalid merge file garbage ratio, must between 0 and 1")
+	}
+	if options.MergeWorkers < 0 {
+		return errors.New("merge workers must not be negative")
+	}
+	if options.Compression != nil {
+		if id := options.Compression.ID(); id == 0 || id > data.MaxCompressionId {
+			return errors.New("invalid compressor id, must between 1 and 7")
+		}
+	}
+	if options.CompressionThreshold < 0 {
+		return errors.New("compression threshold must not be negative")
+	}
+	if options.Encryption != nil {
+		_, key, err := options.Encryption.CurrentKey()
+		if err != nil {
+			return err
+		}
+		if n := len(key); n != 16 && n != 24 && n != 32 {
+			return errors.New("invalid encryption key, must be 16, 24 or 32 bytes")
+		}
+	}
+	if options.MaxKeySize < 0 {
+		return errors.New("max key size must not be negative")
+	}
+	if options.MaxValueSize < 0 || int64(options.MaxValueSize) > options.DataFileSize {
+		return errors.New("invalid max value size, must between 0 and data file size")
+	}
+	if options.BlobThreshold < 0 {
+		return errors.New("blob threshold must not be negative")
+	}
+	if options.BlobGCRatio < 0 || options.BlobGCRatio > 1 {
+		return errors.New("invalid blob gc ratio, must between 0 and 1")
+	}
+	if options.BlobGCInterval < 0 {
+		return errors.New("blob gc interval must not be negative")
+	}
+	if options.EncryptKeys {
+		if options.Encryption == nil {
+			return errors.New("encrypt keys requires an encryption key provider")
+		}
+		if index.IsPersistent(options.IndexType) {
+			return errors.New("encrypt keys is not supported by persistent index")
+		}
+	}
+	if options.MergeRatio > 0 && options.MergeCheckInterval <= 0 {
+		return errors.New("merge check interval must be greater than 0")
+	}
 	return nil
 }
 
 func (db *DB) loadSeqNo() error {
-	fileName := filepath.Join(db.options.DirPath, data.SeqNoFileName)
+	seqNo, ok, err := readSeqNoFile(db.options.DirPath)
+	if err != nil || !ok {
+		return err
+	}
+	db.seqNo = seqNo
+	db.seqNoFileExists = true
+
+	return os.Remove(filepath.Join(db.options.DirPath, data.SeqNoFileName))
+}
+
+// 读取 seq-no 文件中保存的事务序列号，文件不存在时返回 false
+func readSeqNoFile(dirPath string) (uint64, bool, error) {
+	fileName := filepath.Join(dirPath, data.SeqNoFileName)
 	if _, err := os.Stat(fileName); os.IsNotExist(err) {
-		return nil
+		return 0, false, nil
 	}
-	seqNoFile, err := data.OpenSeqNoFile(db.options.DirPath)
+	seqNoFile, err := data.OpenSeqNoFile(dirPath)
 	if err != nil {
-		return err
+		return 0, false, err
 	}
+	defer seqNoFile.Close()
 	record, _, err := seqNoFile.ReadLogRecord(0)
 	if err != nil {
-		return err
+		return 0, false, err
 	}
 
 	seqNo, err := strconv.ParseUint(string(record.Value), 10, 64)
 	if err != nil {
-		return err
+		return 0, false, err
 	}
-	db.seqNo = seqNo
-	db.seqNoFileExists = true
-
-	return os.Remove(fileName)
+	return seqNo, true, nil
 }
@@ -0,0 +1,462 @@
+package KV
+
+import (
+	"KV/data"
+	"KV/index"
+	"KV/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDB_BPTreeReplayFromCheckpoint(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-checkpoint")
+	opts.DirPath = dir
+	opts.IndexType = BPTree
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	for i := 100; i < 150; i++ {
+		assert.Nil(t, wb.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	assert.Nil(t, wb.Commit())
+
+	// 高水位和索引一起更新，覆盖到最后写入的记录
+	cp := db.index.(index.Checkpointer).Checkpoint()
+	assert.Equal(t, db.activeFile.FileId, cp.Fid)
+	assert.Equal(t, db.activeFile.WriteOff, cp.Offset)
+
+	// 模拟记录已经写入数据文件，但是还没有更新索引时崩溃
+	db.mu.Lock()
+	for i := 150; i < 200; i++ {
+		_, err := db.appendLogRecord(&data.LogRecord{
+			Key:   logRecordKeyWithSeqNo(utils.GetTestKey(i), nonTransactionSeqNo),
+			Value: utils.GetTestKey(i),
+		})
+		assert.Nil(t, err)
+	}
+	// 高水位之前的数据不会被重放，直接从索引中删除的 key 不会重新出现
+	db.index.Delete(utils.GetTestKey(0))
+	db.mu.Unlock()
+	crashDB(db)
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	defer db.Close()
+	_, err = db.Get(utils.GetTestKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+	for i := 1; i < 200; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+	cp = db.index.(index.Checkpointer).Checkpoint()
+	assert.Equal(t, db.activeFile.WriteOff, cp.Offset)
+}
+
+func TestDB_BPTreeCheckpointPastTruncatedTail(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-checkpoint-truncated")
+	opts.DirPath = dir
+	opts.IndexType = BPTree
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	// 模拟高水位已经提交，但是数据文件末尾还没有持久化时崩溃
+	pos := db.index.Get(utils.GetTestKey(50))
+	activeFileId := db.activeFile.FileId
+	crashDB(db)
+	assert.Nil(t, os.Truncate(data.GetDataFileName(dir, activeFileId), pos.Offset))
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, pos.Offset, db.activeFile.WriteOff)
+	cp := db.index.(index.Checkpointer).Checkpoint()
+	assert.Equal(t, pos.Offset, cp.Offset)
+	assert.Equal(t, 50, db.index.Size())
+	for i := 0; i < 100; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		if i >= 50 {
+			assert.Equal(t, ErrKeyNotFound, err)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+
+	// 之后写入的数据紧接在最后一条完整的记录之后
+	assert.Nil(t, db.Put([]byte("after"), []byte("value")))
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	defer db.Close()
+	val, err := db.Get([]byte("after"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), val)
+}
+
+func TestDB_LoadIndexFromSnapshot(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-snapshot")
+	opts.DirPath = dir
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	// 第一轮写入的记录都会被覆盖
+	for r := 0; r < 2; r++ {
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(r*100+i)))
+		}
+	}
+	assert.Nil(t, db.Close())
+	// 重复关闭不会出错
+	assert.Nil(t, db.Close())
+	_, err = os.Stat(filepath.Join(dir, data.IndexSnapshotFileName))
+	assert.Nil(t, err)
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for i := 100; i < 150; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	crashDB(db)
+
+	// 破坏快照覆盖范围内的一条无效记录，只重放快照之后写入的数据时不会读取到它
+	dataFile, err := data.OpenDataFile(dir, 0)
+	assert.Nil(t, err)
+	_, size, err := dataFile.ReadLogRecord(0)
+	assert.Nil(t, err)
+	assert.Nil(t, dataFile.Close())
+	fileName := data.GetDataFileName(dir, 0)
+	buf, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	buf[size-1] ^= 0xff
+	assert.Nil(t, os.WriteFile(fileName, buf, 0644))
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	defer db.Close()
+	for i := 0; i < 150; i++ {
+		expected := utils.GetTestKey(i)
+		if i < 100 {
+			expected = utils.GetTestKey(100 + i)
+		}
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, expected, val)
+	}
+}
+
+func TestDB_RotateDataAndBlobFiles(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-rotate")
+	opts.DirPath = dir
+	opts.DataFileSize = 4 * 1024
+	opts.BlobThreshold = 256
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	values := make(map[string][]byte)
+	for i := 0; i < 300; i++ {
+		// 交替写入小的 value 和写入 blob 文件的大 value，两种文件都会切换
+		value := utils.RandomValue(16)
+		if i%2 == 0 {
+			value = utils.RandomValue(512)
+		}
+		assert.Nil(t, db.Put(utils.GetTestKey(i), value))
+		values[string(utils.GetTestKey(i))] = value
+
+		// manifest 中列出了所有正在使用的文件
+		assert.Equal(t, db.activeFile.FileId, db.manifest.ActiveFileId)
+		assert.Equal(t, len(db.olderFiles), len(db.manifest.DataFileIds))
+		assert.Equal(t, db.activeBlobFile.FileId, db.manifest.BlobFileIds[len(db.manifest.BlobFileIds)-1])
+		assert.Equal(t, len(db.blobFiles)+1, len(db.manifest.BlobFileIds))
+	}
+	assert.True(t, len(db.olderFiles) > 0)
+	assert.True(t, len(db.blobFiles) > 0)
+	crashDB(db)
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	defer db.Close()
+	for key, value := range values {
+		val, err := db.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+}
+
+func TestDB_ChangesAndGetWithMeta(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-changes")
+	opts.DirPath = dir
+	opts.DataFileSize = 16 * 1024
+	// 每次写入时间前进一秒
+	base := time.Unix(1700000000, 0)
+	var ticks int64
+	opts.Clock = func() time.Time {
+		ticks++
+		return base.Add(time.Duration(ticks) * time.Second)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	assert.Nil(t, db.Put([]byte("a"), []byte("1")))
+	assert.Nil(t, db.Put([]byte("b"), []byte("2")))
+	_, meta, err := db.GetWithMeta([]byte("b"))
+	assert.Nil(t, err)
+	bTime := meta.Timestamp
+	assert.Equal(t, base.Add(2*time.Second).UnixNano(), bTime.UnixNano())
+
+	// 之后写入的数据都会被覆盖，merge 时 b 所在的数据文件会被重写
+	for r := 0; r < 2; r++ {
+		for i := 0; i < 300; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+		}
+	}
+	since := base.Add(time.Duration(ticks) * time.Second)
+	assert.Nil(t, db.Delete([]byte("a")))
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put([]byte("c"), []byte("3")))
+	assert.Nil(t, wb.Put([]byte("d"), []byte("4")))
+	assert.Nil(t, wb.Commit())
+
+	// 1.只遍历 since 之后写入的记录
+	var changes []Change
+	assert.Nil(t, db.Changes(since, func(change Change) bool {
+		changes = append(changes, change)
+		return true
+	}))
+	assert.Equal(t, 3, len(changes))
+	assert.Equal(t, []byte("a"), changes[0].Key)
+	assert.True(t, changes[0].Deleted)
+	assert.True(t, changes[0].Timestamp.After(since))
+	assert.Equal(t, changes[1].Timestamp, changes[2].Timestamp)
+
+	// 2.函数返回 false 时终止遍历
+	var count int
+	assert.Nil(t, db.Changes(since, func(change Change) bool {
+		count++
+		return false
+	}))
+	assert.Equal(t, 1, count)
+
+	// 3.merge 之后写入时间保持不变
+	assert.Nil(t, db.Merge())
+	assert.NotEqual(t, uint32(0), db.index.Get([]byte("b")).Fid)
+	_, meta, err = db.GetWithMeta([]byte("b"))
+	assert.Nil(t, err)
+	assert.Equal(t, bTime.UnixNano(), meta.Timestamp.UnixNano())
+
+	var bChange *Change
+	assert.Nil(t, db.Changes(base, func(change Change) bool {
+		if string(change.Key) == "b" {
+			bChange = &change
+		}
+		return true
+	}))
+	assert.NotNil(t, bChange)
+	assert.Equal(t, bTime.UnixNano(), bChange.Timestamp.UnixNano())
+}
+
+func TestDB_ChangesInRange(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-changes-range")
+	opts.DirPath = dir
+	opts.DataFileSize = 16 * 1024
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	// 按照 key 的顺序写入，每个数据文件中 key 的范围互不相交
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	sealed := func() bool {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+		for fileId := range db.olderFiles {
+			if db.footers[fileId] == nil {
+				return false
+			}
+		}
+		return len(db.olderFiles) > 1
+	}
+	for i := 0; i < 100 && !sealed(); i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.True(t, sealed())
+
+	// 1.破坏第一个数据文件中的记录，完整遍历时失败
+	fileName := data.GetDataFileName(dir, 0)
+	f, err := os.OpenFile(fileName, os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, 200)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+	assert.NotNil(t, db.Changes(time.Time{}, func(change Change) bool { return true }))
+
+	// 2.范围和第一个数据文件不相交时跳过这个文件
+	var keys [][]byte
+	assert.Nil(t, db.ChangesInRange(utils.GetTestKey(900), utils.GetTestKey(950), time.Time{}, func(change Change) bool {
+		keys = append(keys, change.Key)
+		return true
+	}))
+	assert.Equal(t, 50, len(keys))
+	assert.Equal(t, utils.GetTestKey(900), keys[0])
+	assert.Equal(t, utils.GetTestKey(949), keys[len(keys)-1])
+
+	// 3.活跃文件和没有 footer 的文件总是会被读取
+	keys = nil
+	assert.Nil(t, db.ChangesInRange(utils.GetTestKey(999), nil, time.Time{}, func(change Change) bool {
+		keys = append(keys, change.Key)
+		return true
+	}))
+	assert.Equal(t, [][]byte{utils.GetTestKey(999)}, keys)
+
+	assert.Equal(t, ErrInvalidKeyRange, db.ChangesInRange([]byte("b"), []byte("a"), time.Time{}, nil))
+}
+
+func TestDB_ReplayTruncatedRecord(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-truncated")
+	opts.DirPath = dir
+	opts.DataFileSize = 4 * 1024
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	assert.True(t, len(db.olderFiles) > 0)
+	activeFileId := db.activeFile.FileId
+	crashDB(db)
+
+	// 1.活跃文件末尾的记录没有写完整，没有配置修复时启动失败，配置之后截断
+	fileName := data.GetDataFileName(dir, activeFileId)
+	stat, err := os.Stat(fileName)
+	assert.Nil(t, err)
+	encRecord, _ := data.EncodeLogRecord(&data.LogRecord{
+		Key:   logRecordKeyWithSeqNo([]byte("torn"), nonTransactionSeqNo),
+		Value: utils.RandomValue(128),
+	})
+	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = f.Write(encRecord[:len(encRecord)/2])
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+	torn, err := os.Stat(fileName)
+	assert.Nil(t, err)
+
+	_, err = Open(opts)
+	assert.Equal(t, data.ErrInvalidRecordSize, err)
+	stat2, err := os.Stat(fileName)
+	assert.Nil(t, err)
+	assert.Equal(t, torn.Size(), stat2.Size())
+
+	opts.RepairTruncatedTail = true
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, stat.Size(), db.activeFile.WriteOff)
+	_, err = db.Get([]byte("torn"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Nil(t, db.Put([]byte("after"), []byte("value")))
+	crashDB(db)
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	val, err := db.Get([]byte("after"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), val)
+	crashDB(db)
+
+	// 2.旧的数据文件被截断时启动失败，不能当作文件末尾丢弃之后的数据
+	manifest, err := data.ReadManifest(dir)
+	assert.Nil(t, err)
+	manifest.FooterFileIds = nil
+	assert.Nil(t, data.WriteManifest(dir, manifest))
+	dataFile, err := data.OpenDataFile(dir, 0)
+	assert.Nil(t, err)
+	_, size, err := dataFile.ReadLogRecord(0)
+	assert.Nil(t, err)
+	assert.Nil(t, dataFile.Close())
+	assert.Nil(t, os.Truncate(data.GetDataFileName(dir, 0), size+size/2))
+
+	_, err = Open(opts)
+	assert.Equal(t, data.ErrInvalidRecordSize, err)
+}
+
+func TestDB_PutRecordLargerThanDataFile(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-large")
+	opts.DirPath = dir
+	opts.DataFileSize = 4 * 1024
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	// value 没有超过数据文件的大小，但是加上 header 和 key 之后超过了
+	assert.Equal(t, ErrValueTooLarge, db.Put(utils.GetTestKey(0), utils.RandomValue(int(opts.DataFileSize)-8)))
+	assert.Nil(t, db.Put(utils.GetTestKey(1), utils.RandomValue(int(opts.DataFileSize)/2)))
+}
+
+func TestDB_IndexMemoryUsage(t *testing.T) {
+	for _, typ := range []IndexerType{BTree, Compact} {
+		opts := DefaultOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go-memory-usage")
+		opts.DirPath = dir
+		opts.IndexType = typ
+
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		for i := 0; i < 1000; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(16)))
+		}
+		// 只有实现了 MemoryReporter 的索引才能统计内存占用
+		usage, ok := db.IndexMemoryUsage()
+		assert.Equal(t, typ == Compact, ok)
+		if ok {
+			assert.Greater(t, usage, int64(0))
+		}
+		assert.Nil(t, db.Close())
+		_ = os.RemoveAll(dir)
+	}
+}
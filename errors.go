@@ -11,4 +11,17 @@ var (
 	ErrExceedMaxBatchNum      = errors.New("exceed the max batch num")
 	ErrMergeIsProgress        = errors.New("merge is in progress, try again later")
 	ErrWriteBatchCannotUse    = errors.New("cannot use write batch, no seq no file")
+	ErrKeyIsReserved          = errors.New("the key uses a reserved prefix")
+	ErrIndexNameIsEmpty       = errors.New("the secondary index name is empty")
+	ErrNoEnoughSpaceForMerge  = errors.New("no enough disk space for merge")
+	ErrMergeFileIdsExhausted  = errors.New("merge output exceeds the reserved data file ids")
+	ErrDatabaseFailed         = errors.New("the database is inconsistent after a failed merge, reopen it")
+	ErrBlobGCIsProgress       = errors.New("blob gc is in progress, try again later")
+	ErrKeyTooLarge            = errors.New("the key exceeds the max key size")
+	ErrValueTooLarge          = errors.New("the value exceeds the max value size")
+	ErrInvalidKeyRange        = errors.New("invalid key range, start must be less than end")
+	ErrUnsupportedFormat      = errors.New("unsupported export format")
+	ErrInvalidExportData      = errors.New("invalid export data, data maybe truncated or corrupted")
+	ErrUpgradeVerifyFailed    = errors.New("the upgraded data does not match the original data")
+	ErrUpgradeMergePending    = errors.New("an unfinished merge is present, open and close the database before upgrading")
 )
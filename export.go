@@ -0,0 +1,237 @@
+package KV
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+)
+
+// 导出和导入数据库中的 key 和 value，不依赖数据文件的格式，可以用于不同版本、不同索引类型的数据库之间迁移数据
+// 二级索引的数据不会被导出，导入时根据目标数据库中注册的二级索引重新生成
+
+type ExportFormat = int8
+
+const (
+	// ExportBinary 带长度前缀的二进制格式
+	//
+	//	+---------+---------+----------+-----+------------+-------+-----+---+------------+
+	//	|  magic  | version | key 长度  | key | value 长度  | value | ... | 0 |  记录数量   |
+	//	+---------+---------+----------+-----+------------+-------+-----+---+------------+
+	//	   4字节      1字节      变长                变长                   变长     变长
+	ExportBinary ExportFormat = iota + 1
+
+	// ExportJSONLines 每行一个 JSON 对象，key 和 value 使用 base64 编码
+	// 最后一行只有记录数量 {"count":N}，用于发现按行截断的数据
+	ExportJSONLines
+)
+
+const (
+	exportMagic   = "KVEX"
+	exportVersion = 1
+
+	importBatchNum  = 1000
+	importBatchSize = 4 * 1024 * 1024 // 4MB
+)
+
+// JSON Lines 格式中的一行，Count 只在最后一行出现
+type exportEntry struct {
+	Key   []byte  `json:"key,omitempty"`
+	Value []byte  `json:"value,omitempty"`
+	Count *uint64 `json:"count,omitempty"`
+}
+
+// Export 将数据库中所有的 key 和 value 按照 key 的顺序写入 w
+// 导出的是调用时的数据，导出期间写入的数据不会被导出
+func (db *DB) Export(w io.Writer, format ExportFormat) error {
+	var write func(key, value []byte) error
+	var finish func(count uint64) error
+
+	writer := bufio.NewWriter(w)
+	switch format {
+	case ExportBinary:
+		if _, err := writer.WriteString(exportMagic); err != nil {
+			return err
+		}
+		if err := writer.WriteByte(exportVersion); err != nil {
+			return err
+		}
+		buf := make([]byte, binary.MaxVarintLen64)
+		writeUvarint := func(v uint64) error {
+			n := binary.PutUvarint(buf, v)
+			_, err := writer.Write(buf[:n])
+			return err
+		}
+		write = func(key, value []byte) error {
+			for _, b := range [][]byte{key, value} {
+				if err := writeUvarint(uint64(len(b))); err != nil {
+					return err
+				}
+				if _, err := writer.Write(b); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		// key 不能为空，长度为 0 表示结束，之后是记录数量，用于发现被截断的数据
+		finish = func(count uint64) error {
+			if err := writeUvarint(0); err != nil {
+				return err
+			}
+			return writeUvarint(count)
+		}
+	case ExportJSONLines:
+		encoder := json.NewEncoder(writer)
+		write = func(key, value []byte) error {
+			return encoder.Encode(&exportEntry{Key: key, Value: value})
+		}
+		finish = func(count uint64) error {
+			return encoder.Encode(&exportEntry{Count: &count})
+		}
+	default:
+		return ErrUnsupportedFormat
+	}
+
+	// 迭代器创建时的索引就是导出的数据，导出期间数据文件不会被删除
+	iterator := db.NewIterator(DefaultIteratorOptions)
+	defer iterator.Close()
+
+	var count uint64
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		value, err := iterator.Value()
+		if err != nil {
+			return err
+		}
+		if err := write(iterator.Key(), value); err != nil {
+			return err
+		}
+		count++
+	}
+	if err := finish(count); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// Import 从 r 中读取 Export 导出的数据并写入数据库，已经存在的 key 会被覆盖
+// 数据分批以事务的方式写入，中途出错时之前的批次已经写入
+// 使用 B+ 树索引并且不能确定事务序列号时不能使用事务，返回 ErrWriteBatchCannotUse
+func (db *DB) Import(r io.Reader, format ExportFormat) error {
+	if db.persistentIndex && !db.seqNoFileExists && !db.isInitial {
+		return ErrWriteBatchCannotUse
+	}
+
+	var next func() ([]byte, []byte, error)
+	reader := bufio.NewReader(r)
+	switch format {
+	case ExportBinary:
+		header := make([]byte, len(exportMagic)+1)
+		if _, err := io.ReadFull(reader, header); err != nil || string(header[:len(exportMagic)]) != exportMagic {
+			return ErrInvalidExportData
+		}
+		if header[len(exportMagic)] != exportVersion {
+			return ErrUnsupportedFormat
+		}
+		next = db.binaryImportReader(reader)
+	case ExportJSONLines:
+		next = jsonImportReader(reader)
+	default:
+		return ErrUnsupportedFormat
+	}
+
+	batchOptions := WriteBatchOptions{MaxBatchNum: importBatchNum, SyncWrites: false}
+	wb := db.NewWriteBatch(batchOptions)
+	var batchNum, batchSize int
+	for {
+		key, value, err := next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		if err := wb.Put(key, value); err != nil {
+			return err
+		}
+		batchNum++
+		batchSize += len(key) + len(value)
+		if batchNum >= importBatchNum || batchSize >= importBatchSize {
+			if err := wb.Commit(); err != nil {
+				return err
+			}
+			batchNum, batchSize = 0, 0
+		}
+	}
+	if err := wb.Commit(); err != nil {
+		return err
+	}
+	return db.Sync()
+}
+
+// 依次读取二进制格式中的 key 和 value，读取到结束标识并且记录数量一致时返回 io.EOF
+func (db *DB) binaryImportReader(reader *bufio.Reader) func() ([]byte, []byte, error) {
+	var count uint64
+	readBytes := func(size uint64) ([]byte, error) {
+		// 按照实际读取到的数据分配内存，避免损坏的长度导致一次分配过多内存
+		var buf bytes.Buffer
+		if _, err := io.CopyN(&buf, reader, int64(size)); err != nil {
+			return nil, ErrInvalidExportData
+		}
+		return buf.Bytes(), nil
+	}
+	return func() ([]byte, []byte, error) {
+		keySize, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, nil, ErrInvalidExportData
+		}
+		if keySize == 0 {
+			total, err := binary.ReadUvarint(reader)
+			if err != nil || total != count {
+				return nil, nil, ErrInvalidExportData
+			}
+			return nil, nil, io.EOF
+		}
+		if err := db.checkRecordSize(keySize, 0); err != nil {
+			return nil, nil, err
+		}
+		key, err := readBytes(keySize)
+		if err != nil {
+			return nil, nil, err
+		}
+		valueSize, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, nil, ErrInvalidExportData
+		}
+		if err := db.checkRecordSize(keySize, valueSize); err != nil {
+			return nil, nil, err
+		}
+		value, err := readBytes(valueSize)
+		if err != nil {
+			return nil, nil, err
+		}
+		count++
+		return key, value, nil
+	}
+}
+
+// 依次读取 JSON Lines 格式中的 key 和 value，读取到最后一行并且记录数量一致时返回 io.EOF
+func jsonImportReader(reader *bufio.Reader) func() ([]byte, []byte, error) {
+	var count uint64
+	decoder := json.NewDecoder(reader)
+	return func() ([]byte, []byte, error) {
+		var entry exportEntry
+		if err := decoder.Decode(&entry); err != nil {
+			return nil, nil, ErrInvalidExportData
+		}
+		if entry.Count == nil {
+			count++
+			return entry.Key, entry.Value, nil
+		}
+		// 最后一行之后不能再有数据
+		if len(entry.Key) > 0 || *entry.Count != count || decoder.Decode(&entry) != io.EOF {
+			return nil, nil, ErrInvalidExportData
+		}
+		return nil, nil, io.EOF
+	}
+}
@@ -0,0 +1,133 @@
+package KV
+
+import (
+	"KV/utils"
+	"bufio"
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func openExportDB(t *testing.T, indexType IndexerType) (*DB, func()) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-export")
+	opts.DirPath = dir
+	opts.IndexType = indexType
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	return db, func() {
+		_ = db.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+// 导出之后导入到另一个数据库，两边的数据完全一致
+func testExportRoundTrip(t *testing.T, format ExportFormat) {
+	src, destroySrc := openExportDB(t, BTree)
+	defer destroySrc()
+	values := make(map[string][]byte)
+	for i := 0; i < 2500; i++ {
+		value := utils.RandomValue(64)
+		assert.Nil(t, src.Put(utils.GetTestKey(i), value))
+		values[string(utils.GetTestKey(i))] = value
+	}
+	assert.Nil(t, src.Delete(utils.GetTestKey(0)))
+	delete(values, string(utils.GetTestKey(0)))
+
+	var buf bytes.Buffer
+	assert.Nil(t, src.Export(&buf, format))
+
+	// 导入到不同索引类型的数据库
+	dst, destroyDst := openExportDB(t, BPTree)
+	defer destroyDst()
+	assert.Nil(t, dst.Import(bytes.NewReader(buf.Bytes()), format))
+	assert.Equal(t, len(values), len(dst.ListKeys()))
+	for key, value := range values {
+		val, err := dst.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+}
+
+func TestDB_ExportImportBinary(t *testing.T) {
+	testExportRoundTrip(t, ExportBinary)
+}
+
+func TestDB_ExportImportJSONLines(t *testing.T) {
+	testExportRoundTrip(t, ExportJSONLines)
+}
+
+func TestDB_ImportTruncatedBinary(t *testing.T) {
+	src, destroySrc := openExportDB(t, BTree)
+	defer destroySrc()
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, src.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	var buf bytes.Buffer
+	assert.Nil(t, src.Export(&buf, ExportBinary))
+	exported := buf.Bytes()
+
+	dst, destroyDst := openExportDB(t, BTree)
+	defer destroyDst()
+	// 在记录中间截断，以及截断结束标识之后的记录数量
+	for _, size := range []int{len(exported) / 2, len(exported) - 1, 3} {
+		assert.Equal(t, ErrInvalidExportData, dst.Import(bytes.NewReader(exported[:size]), ExportBinary))
+	}
+	assert.Equal(t, ErrUnsupportedFormat, dst.Import(bytes.NewReader(exported), 0))
+}
+
+func TestDB_ImportTruncatedJSONLines(t *testing.T) {
+	src, destroySrc := openExportDB(t, BTree)
+	defer destroySrc()
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, src.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	var buf bytes.Buffer
+	assert.Nil(t, src.Export(&buf, ExportJSONLines))
+	lines := bytes.SplitAfter(buf.Bytes(), []byte("\n"))
+	lines = lines[:len(lines)-1]
+	assert.Equal(t, 101, len(lines))
+	assert.Equal(t, "{\"count\":100}\n", string(lines[100]))
+
+	dst, destroyDst := openExportDB(t, BTree)
+	defer destroyDst()
+	// 缺少最后一行，丢失中间的行，以及最后一行之后还有数据
+	for _, data := range [][]byte{
+		bytes.Join(lines[:100], nil),
+		bytes.Join(append(append([][]byte{}, lines[:50]...), lines[51:]...), nil),
+		bytes.Join(append(append([][]byte{}, lines...), lines[0]), nil),
+	} {
+		assert.Equal(t, ErrInvalidExportData, dst.Import(bytes.NewReader(data), ExportJSONLines))
+	}
+}
+
+func TestDB_ExportExcludesSecondaryIndex(t *testing.T) {
+	src, destroySrc := openExportDB(t, BTree)
+	defer destroySrc()
+	assert.Nil(t, src.Put([]byte("u1"), []byte("beijing:a")))
+	assert.Nil(t, src.Put([]byte("u2"), []byte("shanghai:b")))
+	assert.Nil(t, src.RegisterIndex("city", cityIndex(new(int))))
+	assert.Nil(t, src.Put([]byte("u3"), []byte("beijing:c")))
+
+	var buf bytes.Buffer
+	assert.Nil(t, src.Export(&buf, ExportJSONLines))
+	var lines int
+	scanner := bufio.NewScanner(bytes.NewReader(buf.Bytes()))
+	for scanner.Scan() {
+		lines++
+	}
+	// 3 条记录以及最后一行的记录数量
+	assert.Equal(t, 4, lines)
+	var binBuf bytes.Buffer
+	assert.Nil(t, src.Export(&binBuf, ExportBinary))
+	assert.False(t, bytes.Contains(binBuf.Bytes(), secondaryIndexPrefix))
+
+	// 导入时根据目标数据库中注册的二级索引重新生成
+	dst, destroyDst := openExportDB(t, BTree)
+	defer destroyDst()
+	assert.Nil(t, dst.RegisterIndex("city", cityIndex(new(int))))
+	assert.Nil(t, dst.Import(bytes.NewReader(buf.Bytes()), ExportJSONLines))
+	assert.Equal(t, 3, len(dst.ListKeys()))
+	assert.Equal(t, []string{"u1", "u3"}, queryIndexKeys(t, dst, "city", "beijing"))
+}
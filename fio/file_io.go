@@ -35,6 +35,11 @@ func (fio *FileIO) Close() error {
 	return fio.fd.Close()
 }
 
+// Truncate 将文件截断到 size 大小，之后的写入从新的末尾开始
+func (fio *FileIO) Truncate(size int64) error {
+	return fio.fd.Truncate(size)
+}
+
 func (fio *FileIO) Size() (int64, error) {
 	stat, err := fio.fd.Stat()
 	if err != nil {
@@ -91,3 +91,29 @@ func TestFileIO_Close(t *testing.T) {
 	err = fio.Close()
 	assert.Nil(t, err)
 }
+
+func TestFileIO_Truncate(t *testing.T) {
+	path := filepath.Join("/tmp", "a.data")
+	fio, err := NewFileIOManager(path)
+	defer destroyFile(path)
+
+	assert.Nil(t, err)
+	_, err = fio.Write([]byte("key-a"))
+	assert.Nil(t, err)
+	_, err = fio.Write([]byte("key-b"))
+	assert.Nil(t, err)
+
+	err = fio.Truncate(5)
+	assert.Nil(t, err)
+	size, err := fio.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), size)
+
+	// 截断之后追加写入的数据紧接在新的末尾
+	_, err = fio.Write([]byte("key-c"))
+	assert.Nil(t, err)
+	b := make([]byte, 5)
+	_, err = fio.Read(b, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key-c"), b)
+}
@@ -8,6 +8,7 @@ type IOManager interface {
 	Sync() error
 	Close() error
 	Size() (int64, error)
+	Truncate(int64) error
 }
 
 func NewIOManager(fileName string) (IOManager, error) {
@@ -0,0 +1,217 @@
+package KV
+
+import (
+	"KV/data"
+	"io"
+)
+
+// 旧的数据文件不会再写入，后台任务在文件末尾写入 footer，记录数据的统计信息、key 的范围以及校验值
+// manifest 中列出了已经写入 footer 的数据文件，启动时读取 footer，文件被截断时能够立即发现
+// 写入 footer 时不单独更新 manifest，下一次切换文件、merge 或者关闭时写入的 manifest 会列出这些数据文件
+// merge 生成的数据文件在写入时直接生成 footer
+
+// 启动时读取 manifest 中列出的数据文件的 footer，并校验文件中的数据
+// 校验值不一致时不再信任 footer 中的统计信息，扫描整个文件确认其中的记录都是完整的，
+// 之后这个文件的 footer 为 nil，和没有 footer 的文件一样处理，不会再次写入 footer
+func (db *DB) loadFooters() error {
+	for _, fileId := range db.manifest.FooterFileIds {
+		dataFile, ok := db.olderFiles[fileId]
+		if !ok {
+			continue
+		}
+		footer, err := dataFile.ReadFooter()
+		if err != nil {
+			if err == data.ErrFooterNotFound || err == data.ErrInvalidFooter {
+				return ErrDataDirectoryCorrupted
+			}
+			return err
+		}
+		if err := dataFile.VerifyChecksum(footer); err != nil {
+			if err != data.ErrInvalidFooter {
+				return err
+			}
+			if err := scanDataFile(dataFile); err != nil {
+				return err
+			}
+			footer = nil
+		}
+		db.footers[fileId] = footer
+	}
+	return nil
+}
+
+// 依次读取数据文件中的所有记录，记录不完整或者校验失败时返回 ErrDataDirectoryCorrupted
+func scanDataFile(dataFile *data.DataFile) error {
+	reader, err := dataFile.NewReader(0)
+	if err != nil {
+		return err
+	}
+	for {
+		_, _, err := reader.Next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			if err == data.ErrInvalidCRC || err == data.ErrInvalidRecordSize {
+				return ErrDataDirectoryCorrupted
+			}
+			return err
+		}
+	}
+}
+
+// 通知后台任务为新的旧数据文件写入 footer
+func (db *DB) notifySeal() {
+	select {
+	case db.sealCh <- struct{}{}:
+	default:
+	}
+}
+
+// 后台为没有 footer 的旧数据文件写入 footer
+func (db *DB) runSealTask() {
+	defer db.bgWait.Done()
+	for {
+		select {
+		case <-db.sealCh:
+			_ = db.sealDataFiles()
+		case <-db.closeCh:
+			return
+		}
+	}
+}
+
+// 依次为没有 footer 的旧数据文件写入 footer
+func (db *DB) sealDataFiles() error {
+	db.mu.RLock()
+	var fileIds []uint32
+	for fileId := range db.olderFiles {
+		if _, ok := db.footers[fileId]; !ok {
+			fileIds = append(fileIds, fileId)
+		}
+	}
+	db.mu.RUnlock()
+	sortFileIds(fileIds)
+
+	for _, fileId := range fileIds {
+		select {
+		case <-db.closeCh:
+			return nil
+		default:
+		}
+		if err := db.sealDataFile(fileId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 读取整个数据文件统计 footer，然后写入文件末尾
+// 读取时不持有锁，写入之前确认数据文件没有被 merge 替换，merge 进行中时等待下一次通知
+func (db *DB) sealDataFile(fileId uint32) error {
+	db.mu.RLock()
+	dataFile, ok := db.olderFiles[fileId]
+	db.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	// 写入 footer 之后还没有来得及更新 manifest 时不需要重新统计
+	footer, err := dataFile.ReadFooter()
+	sealed := err == nil
+	if err != nil {
+		if err != data.ErrFooterNotFound {
+			return err
+		}
+		footer, err = dataFile.BuildFooter(func(logRecord *data.LogRecord, pos *data.LogRecordPos) ([]byte, bool) {
+			if logRecord.Type == data.LogRecordTxnFinished {
+				return nil, false
+			}
+			realKey, _ := parseLogRecordKey(logRecord.Key)
+			if logRecord.Type != data.LogRecordNormal {
+				return realKey, false
+			}
+			indexPos := db.index.Get(realKey)
+			return realKey, indexPos != nil && indexPos.Fid == pos.Fid && indexPos.Offset == pos.Offset
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.isMerging {
+		return nil
+	}
+	// 同一个 id 可能已经被替换为其他的数据文件，统计的 footer 不属于它
+	if db.olderFiles[fileId] != dataFile {
+		return nil
+	}
+	if !sealed {
+		size, err := dataFile.IoManager.Size()
+		if err != nil {
+			return err
+		}
+		if err := dataFile.WriteFooter(footer); err != nil {
+			return err
+		}
+		if err := dataFile.Sync(); err != nil {
+			return err
+		}
+		// footer 本身是可以回收的
+		if db.fileStats != nil {
+			newSize, err := dataFile.IoManager.Size()
+			if err != nil {
+				return err
+			}
+			db.fileStat(fileId).deadSize += newSize - size
+		}
+	}
+	db.footers[fileId] = footer
+	return nil
+}
+
+// 将还没有在 manifest 中列出的 footer 写入 manifest，在关闭时调用
+// 在访问此方法前必须持有互斥锁
+func (db *DB) writeFooterManifest() error {
+	manifest := db.newManifest(db.activeFile.FileId, nil, nil)
+	if len(manifest.FooterFileIds) == len(db.manifest.FooterFileIds) {
+		return nil
+	}
+	return db.writeManifest(manifest)
+}
+
+// VerifyDataFiles 校验所有已经写入 footer 的旧数据文件，文件被截断或者损坏时返回 data.ErrInvalidFooter
+func (db *DB) VerifyDataFiles() error {
+	db.mu.Lock()
+	dataFiles := make([]*data.DataFile, 0, len(db.footers))
+	for fileId := range db.footers {
+		if dataFile, ok := db.olderFiles[fileId]; ok {
+			dataFiles = append(dataFiles, dataFile)
+		}
+	}
+	// 校验期间 merge 替换掉的数据文件不会被删除
+	epoch := db.fileEpoch
+	db.readers[epoch]++
+	db.mu.Unlock()
+
+	defer func() {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		if db.readers[epoch]--; db.readers[epoch] <= 0 {
+			delete(db.readers, epoch)
+		}
+		_ = db.releaseRetiredFiles()
+	}()
+
+	for _, dataFile := range dataFiles {
+		if _, err := dataFile.VerifyFooter(); err != nil {
+			if err == data.ErrFooterNotFound {
+				return data.ErrInvalidFooter
+			}
+			return err
+		}
+	}
+	return nil
+}
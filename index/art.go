@@ -58,6 +58,10 @@ func (art *AdaptiveRadixTree) Size() int {
 	return art.tree.Size()
 }
 
+func (art *AdaptiveRadixTree) Close() error {
+	return nil
+}
+
 type artIterator struct {
 	curr    int
 	reverse bool
@@ -98,11 +102,11 @@ func (arti *artIterator) Rewind() {
 func (arti *artIterator) Seek(key []byte) {
 	if arti.reverse {
 		arti.curr = sort.Search(len(arti.values), func(i int) bool {
-			return bytes.Compare(key, arti.values[i].key) <= 0
+			return bytes.Compare(arti.values[i].key, key) <= 0
 		})
 	} else {
 		arti.curr = sort.Search(len(arti.values), func(i int) bool {
-			return bytes.Compare(key, arti.values[i].key) >= 0
+			return bytes.Compare(arti.values[i].key, key) >= 0
 		})
 	}
 }
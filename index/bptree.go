@@ -12,28 +12,35 @@ const (
 
 var (
 	indexBucketName = []byte("bitcask-index")
+	metaBucketName  = []byte("bitcask-meta")
+	checkpointKey   = []byte("checkpoint")
 )
 
 type BPlusTree struct {
 	tree *bolt.DB
 }
 
-func NewBPTree(dirPath string, syncWrite bool) *BPlusTree {
-	opt := bolt.DefaultOptions
-	opt.NoSync = !syncWrite
+// NewBPTree 打开数据目录中的 B+ 树索引文件，syncWrites 为 false 时提交事务不持久化
+func NewBPTree(dirPath string, syncWrites bool) (*BPlusTree, error) {
+	opt := *bolt.DefaultOptions
+	opt.NoSync = !syncWrites
 
-	bpt, err := bolt.Open(filepath.Join(dirPath, bptreeIndexFileName), 0644, nil)
+	bpt, err := bolt.Open(filepath.Join(dirPath, bptreeIndexFileName), 0644, &opt)
 	if err != nil {
-		panic("failed to open BPTree")
+		return nil, err
 	}
 
 	if err := bpt.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(indexBucketName)
+		if _, err := tx.CreateBucketIfNotExists(indexBucketName); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(metaBucketName)
 		return err
 	}); err != nil {
-		panic("fail to create bucket")
+		_ = bpt.Close()
+		return nil, err
 	}
-	return &BPlusTree{tree: bpt}
+	return &BPlusTree{tree: bpt}, nil
 }
 
 func (bpt *BPlusTree) Put(key []byte, pos *data.LogRecordPos) bool {
@@ -42,7 +49,6 @@ func (bpt *BPlusTree) Put(key []byte, pos *data.LogRecordPos) bool {
 		return bucket.Put(key, data.EncodeLogRecordPos(pos))
 	}); err != nil {
 		panic("fail to put value in BPTree")
-		return false
 	}
 	return true
 }
@@ -100,6 +106,82 @@ func (bpt *BPlusTree) Size() int {
 	return size
 }
 
+func (bpt *BPlusTree) Close() error {
+	return bpt.tree.Close()
+}
+
+// Checkpoint 取出索引已经覆盖到的数据位置
+func (bpt *BPlusTree) Checkpoint() *data.LogRecordPos {
+	var pos *data.LogRecordPos
+
+	if err := bpt.tree.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(metaBucketName)
+		val := bucket.Get(checkpointKey)
+		if len(val) != 0 {
+			pos = data.DecodeLogRecordPos(val)
+		}
+		return nil
+	}); err != nil {
+		panic("fail to get checkpoint in BPTree")
+	}
+
+	return pos
+}
+
+// SetCheckpoint 更新索引已经覆盖到的数据位置
+func (bpt *BPlusTree) SetCheckpoint(pos *data.LogRecordPos) bool {
+	if err := bpt.tree.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(metaBucketName)
+		return bucket.Put(checkpointKey, data.EncodeLogRecordPos(pos))
+	}); err != nil {
+		panic("fail to put checkpoint in BPTree")
+	}
+	return true
+}
+
+// Batch 在一个事务中执行 fn 中的所有更新，fn 返回错误时全部回滚
+func (bpt *BPlusTree) Batch(fn func(batch Batch) error) error {
+	return bpt.tree.Update(func(tx *bolt.Tx) error {
+		return fn(&bptreeBatch{bucket: tx.Bucket(indexBucketName), meta: tx.Bucket(metaBucketName)})
+	})
+}
+
+// 事务中的索引操作
+type bptreeBatch struct {
+	bucket *bolt.Bucket
+	meta   *bolt.Bucket
+}
+
+func (bb *bptreeBatch) Put(key []byte, pos *data.LogRecordPos) bool {
+	return bb.bucket.Put(key, data.EncodeLogRecordPos(pos)) == nil
+}
+
+func (bb *bptreeBatch) Get(key []byte) *data.LogRecordPos {
+	if val := bb.bucket.Get(key); len(val) != 0 {
+		return data.DecodeLogRecordPos(val)
+	}
+	return nil
+}
+
+func (bb *bptreeBatch) Delete(key []byte) bool {
+	if val := bb.bucket.Get(key); len(val) == 0 {
+		return false
+	}
+	return bb.bucket.Delete(key) == nil
+}
+
+func (bb *bptreeBatch) Checkpoint() *data.LogRecordPos {
+	if val := bb.meta.Get(checkpointKey); len(val) != 0 {
+		return data.DecodeLogRecordPos(val)
+	}
+	return nil
+}
+
+// SetCheckpoint 高水位和事务中的其他更新一起提交
+func (bb *bptreeBatch) SetCheckpoint(pos *data.LogRecordPos) bool {
+	return bb.meta.Put(checkpointKey, data.EncodeLogRecordPos(pos)) == nil
+}
+
 type bptreeIterator struct {
 	tx        *bolt.Tx
 	cursor    *bolt.Cursor
@@ -149,5 +231,5 @@ func (bi *bptreeIterator) Value() *data.LogRecordPos {
 }
 
 func (bpt *bptreeIterator) Close() {
-	_ = bpt.tx.Commit()
+	_ = bpt.tx.Rollback()
 }
@@ -0,0 +1,95 @@
+package index
+
+import (
+	"KV/data"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBPlusTree_Checkpoint(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "bptree-checkpoint")
+	_ = os.MkdirAll(path, os.ModePerm)
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+
+	bpt, err := NewBPTree(path, false)
+	assert.Nil(t, err)
+	// 1.没有高水位
+	assert.Nil(t, bpt.Checkpoint())
+
+	// 2.更新高水位
+	res := bpt.SetCheckpoint(&data.LogRecordPos{Fid: 3, Offset: 128})
+	assert.True(t, res)
+	cp := bpt.Checkpoint()
+	assert.Equal(t, uint32(3), cp.Fid)
+	assert.Equal(t, int64(128), cp.Offset)
+
+	// 3.重新打开后高水位依然存在
+	assert.Nil(t, bpt.Close())
+	bpt2, err := NewBPTree(path, false)
+	assert.Nil(t, err)
+	cp2 := bpt2.Checkpoint()
+	assert.Equal(t, uint32(3), cp2.Fid)
+	assert.Equal(t, int64(128), cp2.Offset)
+	assert.Nil(t, bpt2.Close())
+}
+
+func TestBPlusTree_PutWithSize(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "bptree-put")
+	_ = os.MkdirAll(path, os.ModePerm)
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+
+	bpt, err := NewBPTree(path, false)
+	assert.Nil(t, err)
+	defer bpt.Close()
+
+	res := bpt.Put([]byte("aac"), &data.LogRecordPos{Fid: 1, Offset: 12, Size: 30})
+	assert.True(t, res)
+	pos := bpt.Get([]byte("aac"))
+	assert.Equal(t, uint32(1), pos.Fid)
+	assert.Equal(t, int64(12), pos.Offset)
+	assert.Equal(t, uint32(30), pos.Size)
+}
+
+func TestBPlusTree_Batch(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "bptree-batch")
+	_ = os.MkdirAll(path, os.ModePerm)
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+
+	bpt, err := NewBPTree(path, false)
+	assert.Nil(t, err)
+	defer bpt.Close()
+	bpt.Put([]byte("aac"), &data.LogRecordPos{Fid: 1, Offset: 12, Size: 30})
+
+	// 1.批量更新
+	err = bpt.Batch(func(batch Batch) error {
+		assert.Equal(t, uint32(1), batch.Get([]byte("aac")).Fid)
+		assert.True(t, batch.Put([]byte("aac"), &data.LogRecordPos{Fid: 5, Offset: 0, Size: 30}))
+		assert.True(t, batch.Put([]byte("abc"), &data.LogRecordPos{Fid: 5, Offset: 30, Size: 30}))
+		assert.False(t, batch.Delete([]byte("not-exist")))
+		assert.True(t, batch.(Checkpointer).SetCheckpoint(&data.LogRecordPos{Fid: 5, Offset: 60}))
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(5), bpt.Get([]byte("aac")).Fid)
+	assert.Equal(t, int64(30), bpt.Get([]byte("abc")).Offset)
+	assert.Equal(t, int64(60), bpt.Checkpoint().Offset)
+
+	// 2.返回错误时全部回滚，高水位也不会更新
+	err = bpt.Batch(func(batch Batch) error {
+		batch.Delete([]byte("aac"))
+		batch.(Checkpointer).SetCheckpoint(&data.LogRecordPos{Fid: 6, Offset: 0})
+		return errors.New("rollback")
+	})
+	assert.NotNil(t, err)
+	assert.NotNil(t, bpt.Get([]byte("aac")))
+	assert.Equal(t, uint32(5), bpt.Checkpoint().Fid)
+}
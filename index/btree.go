@@ -30,7 +30,9 @@ func (bt *BTree) Put(key []byte, pos *data.LogRecordPos) bool {
 
 func (bt *BTree) Get(key []byte) *data.LogRecordPos {
 	it := &Item{key: key}
+	bt.lock.RLock()
 	btreeItem := bt.tree.Get(it)
+	bt.lock.RUnlock()
 	if btreeItem == nil {
 		return nil
 	}
@@ -49,9 +51,15 @@ func (bt *BTree) Delete(key []byte) bool {
 }
 
 func (bt *BTree) Size() int {
+	bt.lock.RLock()
+	defer bt.lock.RUnlock()
 	return bt.tree.Len()
 }
 
+func (bt *BTree) Close() error {
+	return nil
+}
+
 type btreeIterator struct {
 	curr    int
 	reverse bool
@@ -97,11 +105,11 @@ func (bti *btreeIterator) Rewind() {
 func (bti *btreeIterator) Seek(key []byte) {
 	if bti.reverse {
 		bti.curr = sort.Search(len(bti.values), func(i int) bool {
-			return bytes.Compare(key, bti.values[i].key) <= 0
+			return bytes.Compare(bti.values[i].key, key) <= 0
 		})
 	} else {
 		bti.curr = sort.Search(len(bti.values), func(i int) bool {
-			return bytes.Compare(key, bti.values[i].key) >= 0
+			return bytes.Compare(bti.values[i].key, key) >= 0
 		})
 	}
 }
@@ -0,0 +1,391 @@
+package index
+
+import (
+	"KV/data"
+	"bytes"
+	"sort"
+	"sync"
+	"unsafe"
+)
+
+const (
+	// 每个 slab 的大小
+	arenaSlabSize = 4 * 1024 * 1024
+
+	// 每个分块中最多存放的索引条数
+	maxChunkItems = 512
+)
+
+// CompactTree 内存紧凑的索引，适合 key 数量非常大的场景
+// key 存放在大块的 arena slab 中，位置信息以定长值的形式内联存储在有序分块中
+// 堆上只有 slab 和分块这些少量的指针，减少内存占用和 GC 扫描的开销
+type CompactTree struct {
+	chunks []*compactChunk // 按照 key 有序排列的分块
+	arena  *keyArena
+	size   int
+	lock   *sync.RWMutex
+}
+
+// 一条索引，不包含任何指针
+type compactEntry struct {
+	slab   uint32 // key 所在的 slab
+	keyOff uint32 // key 在 slab 中的偏移
+	keyLen uint32
+	fid    uint32
+	offset int64
+	size   uint32
+}
+
+// 有序分块，被迭代器引用时标记为共享，修改前需要先复制
+type compactChunk struct {
+	entries []compactEntry
+	shared  bool
+}
+
+// key 存储区，只追加写入，被删除的 key 占用的空间在垃圾过多时统一回收
+type keyArena struct {
+	slabs   [][]byte
+	live    int64
+	garbage int64
+}
+
+func NewCompactTree() *CompactTree {
+	return &CompactTree{
+		arena: &keyArena{},
+		lock:  new(sync.RWMutex),
+	}
+}
+
+func (ct *CompactTree) Put(key []byte, pos *data.LogRecordPos) bool {
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+
+	if len(ct.chunks) == 0 {
+		ct.chunks = append(ct.chunks, &compactChunk{})
+	}
+	ci, idx, found := ct.find(key)
+	chunk := ct.mutableChunk(ci)
+
+	// key 已经存在，只需要更新位置信息
+	if found {
+		entry := &chunk.entries[idx]
+		entry.fid, entry.offset, entry.size = pos.Fid, pos.Offset, pos.Size
+		return true
+	}
+
+	slab, keyOff := ct.arena.add(key)
+	entry := compactEntry{
+		slab:   slab,
+		keyOff: keyOff,
+		keyLen: uint32(len(key)),
+		fid:    pos.Fid,
+		offset: pos.Offset,
+		size:   pos.Size,
+	}
+	chunk.entries = append(chunk.entries, compactEntry{})
+	copy(chunk.entries[idx+1:], chunk.entries[idx:])
+	chunk.entries[idx] = entry
+	ct.size++
+
+	// 分块已满，拆分成两个
+	if len(chunk.entries) > maxChunkItems {
+		half := len(chunk.entries) / 2
+		next := &compactChunk{entries: make([]compactEntry, len(chunk.entries)-half, maxChunkItems+1)}
+		copy(next.entries, chunk.entries[half:])
+		chunk.entries = chunk.entries[:half]
+
+		ct.chunks = append(ct.chunks, nil)
+		copy(ct.chunks[ci+2:], ct.chunks[ci+1:])
+		ct.chunks[ci+1] = next
+	}
+	return true
+}
+
+// Get 根据 key 取出对应的索引位置信息
+func (ct *CompactTree) Get(key []byte) *data.LogRecordPos {
+	ct.lock.RLock()
+	defer ct.lock.RUnlock()
+
+	if len(ct.chunks) == 0 {
+		return nil
+	}
+	ci, idx, found := ct.find(key)
+	if !found {
+		return nil
+	}
+	return ct.chunks[ci].entries[idx].pos()
+}
+
+// Delete 根据 key 删除对应的索引位置信息
+func (ct *CompactTree) Delete(key []byte) bool {
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+
+	if len(ct.chunks) == 0 {
+		return false
+	}
+	ci, idx, found := ct.find(key)
+	if !found {
+		return false
+	}
+
+	chunk := ct.mutableChunk(ci)
+	ct.arena.release(chunk.entries[idx].keyLen)
+	chunk.entries = append(chunk.entries[:idx], chunk.entries[idx+1:]...)
+	ct.size--
+
+	// 分块为空直接移除，过小则和后一个分块合并
+	if len(chunk.entries) == 0 {
+		ct.chunks = append(ct.chunks[:ci], ct.chunks[ci+1:]...)
+	} else if len(chunk.entries) < maxChunkItems/4 && ci+1 < len(ct.chunks) &&
+		len(chunk.entries)+len(ct.chunks[ci+1].entries) <= maxChunkItems {
+		chunk.entries = append(chunk.entries, ct.chunks[ci+1].entries...)
+		ct.chunks = append(ct.chunks[:ci+1], ct.chunks[ci+2:]...)
+	}
+
+	if ct.arena.needCompact() {
+		ct.compact()
+	}
+	return true
+}
+
+func (ct *CompactTree) Size() int {
+	ct.lock.RLock()
+	defer ct.lock.RUnlock()
+	return ct.size
+}
+
+func (ct *CompactTree) Close() error {
+	return nil
+}
+
+// MemoryUsage 索引占用的内存大小，包括 key 存储区和所有的分块
+func (ct *CompactTree) MemoryUsage() int64 {
+	ct.lock.RLock()
+	defer ct.lock.RUnlock()
+
+	var usage int64
+	for _, slab := range ct.arena.slabs {
+		usage += int64(cap(slab))
+	}
+	entrySize := int64(unsafe.Sizeof(compactEntry{}))
+	chunkSize := int64(unsafe.Sizeof(compactChunk{}) + unsafe.Sizeof(&compactChunk{}))
+	for _, chunk := range ct.chunks {
+		usage += chunkSize + int64(cap(chunk.entries))*entrySize
+	}
+	return usage
+}
+
+func (ct *CompactTree) Iterator(reverse bool) Iterator {
+	// 迭代器引用当前的分块，之后的修改会先复制分块，不影响迭代器
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+
+	chunks := make([]*compactChunk, len(ct.chunks))
+	for i, chunk := range ct.chunks {
+		chunk.shared = true
+		chunks[i] = chunk
+	}
+	iterator := &compactIterator{
+		chunks:  chunks,
+		slabs:   ct.arena.snapshot(),
+		reverse: reverse,
+	}
+	iterator.Rewind()
+	return iterator
+}
+
+// 查找 key 所在的分块及在分块中的位置，key 不存在时返回应该插入的位置
+func (ct *CompactTree) find(key []byte) (int, int, bool) {
+	// 第一个首个 key 大于目标 key 的分块，其前一个分块就是 key 所在的分块
+	ci := sort.Search(len(ct.chunks), func(i int) bool {
+		entries := ct.chunks[i].entries
+		return len(entries) > 0 && bytes.Compare(ct.arena.key(&entries[0]), key) > 0
+	}) - 1
+	if ci < 0 {
+		ci = 0
+	}
+
+	entries := ct.chunks[ci].entries
+	idx := sort.Search(len(entries), func(i int) bool {
+		return bytes.Compare(ct.arena.key(&entries[i]), key) >= 0
+	})
+	found := idx < len(entries) && bytes.Equal(ct.arena.key(&entries[idx]), key)
+	return ci, idx, found
+}
+
+// 取出可以修改的分块，分块被迭代器引用时先复制一份
+func (ct *CompactTree) mutableChunk(ci int) *compactChunk {
+	chunk := ct.chunks[ci]
+	if chunk.shared {
+		entries := make([]compactEntry, len(chunk.entries), maxChunkItems+1)
+		copy(entries, chunk.entries)
+		chunk = &compactChunk{entries: entries}
+		ct.chunks[ci] = chunk
+	}
+	return chunk
+}
+
+// 将所有存活的 key 复制到新的 slab 中，释放被删除的 key 占用的空间
+// 旧的 slab 不会被修改，仍然被迭代器引用时可以继续读取
+func (ct *CompactTree) compact() {
+	arena := &keyArena{}
+	for ci := range ct.chunks {
+		chunk := ct.mutableChunk(ci)
+		for i := range chunk.entries {
+			entry := &chunk.entries[i]
+			entry.slab, entry.keyOff = arena.add(ct.arena.key(entry))
+		}
+	}
+	ct.arena = arena
+}
+
+func (e *compactEntry) pos() *data.LogRecordPos {
+	return &data.LogRecordPos{Fid: e.fid, Offset: e.offset, Size: e.size}
+}
+
+// 追加写入 key，返回所在的 slab 及偏移
+func (a *keyArena) add(key []byte) (uint32, uint32) {
+	last := len(a.slabs) - 1
+	if last < 0 || len(a.slabs[last])+len(key) > cap(a.slabs[last]) {
+		slabSize := arenaSlabSize
+		if len(key) > slabSize {
+			slabSize = len(key)
+		}
+		a.slabs = append(a.slabs, make([]byte, 0, slabSize))
+		last++
+	}
+	keyOff := len(a.slabs[last])
+	a.slabs[last] = append(a.slabs[last], key...)
+	a.live += int64(len(key))
+	return uint32(last), uint32(keyOff)
+}
+
+// 复制 slab 列表，并且将每个 slab 截断到当前的长度
+// 之后写入的 key 只会追加到 slab 已有长度之后，迭代器读取的部分不会被修改
+func (a *keyArena) snapshot() [][]byte {
+	slabs := make([][]byte, len(a.slabs))
+	for i, slab := range a.slabs {
+		slabs[i] = slab[:len(slab):len(slab)]
+	}
+	return slabs
+}
+
+func (a *keyArena) key(e *compactEntry) []byte {
+	return slabKey(a.slabs, e)
+}
+
+func (a *keyArena) release(keyLen uint32) {
+	a.live -= int64(keyLen)
+	a.garbage += int64(keyLen)
+}
+
+// 被删除的 key 超过存活的 key 时回收空间
+func (a *keyArena) needCompact() bool {
+	return a.garbage >= arenaSlabSize && a.garbage > a.live
+}
+
+func slabKey(slabs [][]byte, e *compactEntry) []byte {
+	end := e.keyOff + e.keyLen
+	return slabs[e.slab][e.keyOff:end:end]
+}
+
+// CompactTree 索引迭代器
+type compactIterator struct {
+	chunks  []*compactChunk
+	slabs   [][]byte
+	reverse bool
+	chunk   int // 当前分块
+	idx     int // 当前分块中的位置
+}
+
+func (cti *compactIterator) Rewind() {
+	if cti.reverse {
+		cti.chunk = len(cti.chunks) - 1
+		cti.idx = 0
+		if cti.chunk >= 0 {
+			cti.idx = len(cti.chunks[cti.chunk].entries) - 1
+		}
+	} else {
+		cti.chunk, cti.idx = 0, 0
+	}
+	cti.skipEmpty()
+}
+
+// Seek 正向遍历时定位到第一个大于等于 key 的位置，反向遍历时定位到第一个小于等于 key 的位置
+func (cti *compactIterator) Seek(key []byte) {
+	// 定位到第一个首个 key 大于目标 key 的分块
+	c := sort.Search(len(cti.chunks), func(i int) bool {
+		entries := cti.chunks[i].entries
+		return len(entries) > 0 && bytes.Compare(slabKey(cti.slabs, &entries[0]), key) > 0
+	})
+
+	if cti.reverse {
+		cti.chunk = c - 1
+		if cti.chunk < 0 {
+			cti.idx = -1
+			return
+		}
+		entries := cti.chunks[cti.chunk].entries
+		cti.idx = sort.Search(len(entries), func(i int) bool {
+			return bytes.Compare(slabKey(cti.slabs, &entries[i]), key) > 0
+		}) - 1
+	} else {
+		cti.chunk = c - 1
+		if cti.chunk < 0 {
+			cti.chunk = 0
+		}
+		if cti.chunk >= len(cti.chunks) {
+			return
+		}
+		entries := cti.chunks[cti.chunk].entries
+		cti.idx = sort.Search(len(entries), func(i int) bool {
+			return bytes.Compare(slabKey(cti.slabs, &entries[i]), key) >= 0
+		})
+	}
+	cti.skipEmpty()
+}
+
+func (cti *compactIterator) Next() {
+	if cti.reverse {
+		cti.idx--
+	} else {
+		cti.idx++
+	}
+	cti.skipEmpty()
+}
+
+func (cti *compactIterator) Valid() bool {
+	return cti.chunk >= 0 && cti.chunk < len(cti.chunks) &&
+		cti.idx >= 0 && cti.idx < len(cti.chunks[cti.chunk].entries)
+}
+
+func (cti *compactIterator) Key() []byte {
+	return slabKey(cti.slabs, &cti.chunks[cti.chunk].entries[cti.idx])
+}
+
+func (cti *compactIterator) Value() *data.LogRecordPos {
+	return cti.chunks[cti.chunk].entries[cti.idx].pos()
+}
+
+func (cti *compactIterator) Close() {
+	cti.chunks = nil
+	cti.slabs = nil
+}
+
+// 当前分块遍历完之后移动到相邻的分块
+func (cti *compactIterator) skipEmpty() {
+	if cti.reverse {
+		for cti.chunk >= 0 && cti.idx < 0 {
+			cti.chunk--
+			if cti.chunk >= 0 {
+				cti.idx = len(cti.chunks[cti.chunk].entries) - 1
+			}
+		}
+	} else {
+		for cti.chunk < len(cti.chunks) && cti.idx >= len(cti.chunks[cti.chunk].entries) {
+			cti.chunk++
+			cti.idx = 0
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package index
+
+import (
+	"KV/data"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCompactTree_Put(t *testing.T) {
+	ct := NewCompactTree()
+
+	res1 := ct.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 100})
+	assert.True(t, res1)
+
+	res2 := ct.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 2})
+	assert.True(t, res2)
+	assert.Equal(t, 2, ct.Size())
+
+	// 大量数据，触发分块拆分
+	for i := 0; i < 10000; i++ {
+		ct.Put([]byte(fmt.Sprintf("key-%05d", i)), &data.LogRecordPos{Fid: 2, Offset: int64(i), Size: 10})
+	}
+	assert.Equal(t, 10002, ct.Size())
+	assert.Greater(t, ct.MemoryUsage(), int64(0))
+}
+
+func TestCompactTree_Get(t *testing.T) {
+	ct := NewCompactTree()
+	assert.Nil(t, ct.Get([]byte("not-exist")))
+
+	ct.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 100})
+	pos1 := ct.Get(nil)
+	assert.Equal(t, uint32(1), pos1.Fid)
+	assert.Equal(t, int64(100), pos1.Offset)
+
+	ct.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 2})
+	ct.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 3, Size: 7})
+	pos2 := ct.Get([]byte("a"))
+	assert.Equal(t, uint32(1), pos2.Fid)
+	assert.Equal(t, int64(3), pos2.Offset)
+	assert.Equal(t, uint32(7), pos2.Size)
+
+	for i := 10000; i > 0; i-- {
+		ct.Put([]byte(fmt.Sprintf("key-%05d", i)), &data.LogRecordPos{Fid: 2, Offset: int64(i)})
+	}
+	for i := 1; i <= 10000; i++ {
+		pos := ct.Get([]byte(fmt.Sprintf("key-%05d", i)))
+		assert.NotNil(t, pos)
+		assert.Equal(t, int64(i), pos.Offset)
+	}
+}
+
+func TestCompactTree_Delete(t *testing.T) {
+	ct := NewCompactTree()
+	assert.False(t, ct.Delete([]byte("not-exist")))
+
+	ct.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 100})
+	assert.True(t, ct.Delete(nil))
+	assert.Nil(t, ct.Get(nil))
+
+	// 删除大量数据，触发分块合并和 key 存储区的回收
+	value := make([]byte, 1024)
+	for i := 0; i < 10000; i++ {
+		key := append([]byte(fmt.Sprintf("key-%05d-", i)), value...)
+		ct.Put(key, &data.LogRecordPos{Fid: 2, Offset: int64(i)})
+	}
+	for i := 0; i < 10000; i++ {
+		if i%10 == 0 {
+			continue
+		}
+		key := append([]byte(fmt.Sprintf("key-%05d-", i)), value...)
+		assert.True(t, ct.Delete(key))
+	}
+	assert.Equal(t, 1000, ct.Size())
+	for i := 0; i < 10000; i += 10 {
+		key := append([]byte(fmt.Sprintf("key-%05d-", i)), value...)
+		pos := ct.Get(key)
+		assert.NotNil(t, pos)
+		assert.Equal(t, int64(i), pos.Offset)
+	}
+	assert.Less(t, ct.MemoryUsage(), int64(4*arenaSlabSize))
+}
+
+func TestCompactTree_Iterator(t *testing.T) {
+	ct := NewCompactTree()
+	// 1.为空的情况
+	iter1 := ct.Iterator(false)
+	assert.Equal(t, false, iter1.Valid())
+
+	// 2.有多条数据
+	for i := 0; i < 2000; i++ {
+		ct.Put([]byte(fmt.Sprintf("key-%05d", i)), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	iter2 := ct.Iterator(false)
+	var count int
+	for iter2.Rewind(); iter2.Valid(); iter2.Next() {
+		assert.Equal(t, []byte(fmt.Sprintf("key-%05d", count)), iter2.Key())
+		assert.Equal(t, int64(count), iter2.Value().Offset)
+		count++
+	}
+	assert.Equal(t, 2000, count)
+
+	// 3.反向遍历
+	iter3 := ct.Iterator(true)
+	count = 1999
+	for iter3.Rewind(); iter3.Valid(); iter3.Next() {
+		assert.Equal(t, []byte(fmt.Sprintf("key-%05d", count)), iter3.Key())
+		count--
+	}
+	assert.Equal(t, -1, count)
+
+	// 4.测试 seek
+	iter4 := ct.Iterator(false)
+	iter4.Seek([]byte("key-01000"))
+	assert.Equal(t, []byte("key-01000"), iter4.Key())
+	iter4.Seek([]byte("key-010005"))
+	assert.Equal(t, []byte("key-01001"), iter4.Key())
+	iter4.Seek([]byte("zz"))
+	assert.False(t, iter4.Valid())
+
+	// 5.反向遍历的 seek
+	iter5 := ct.Iterator(true)
+	iter5.Seek([]byte("key-010005"))
+	assert.Equal(t, []byte("key-01000"), iter5.Key())
+	iter5.Seek([]byte("a"))
+	assert.False(t, iter5.Valid())
+
+	// 6.迭代器创建之后的修改不影响迭代器
+	iter6 := ct.Iterator(false)
+	ct.Delete([]byte("key-00000"))
+	ct.Put([]byte("key-00001"), &data.LogRecordPos{Fid: 9, Offset: 9})
+	iter6.Rewind()
+	assert.Equal(t, []byte("key-00000"), iter6.Key())
+	iter6.Next()
+	assert.Equal(t, uint32(1), iter6.Value().Fid)
+	assert.Equal(t, uint32(9), ct.Get([]byte("key-00001")).Fid)
+}
+
+func TestCompactTree_IteratorConcurrentPut(t *testing.T) {
+	ct := NewCompactTree()
+	for i := 0; i < 1000; i++ {
+		ct.Put([]byte(fmt.Sprintf("key-%05d", i)), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+
+	// 遍历的同时写入新的 key，迭代器只能看到创建时已有的 key
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1000; i < 5000; i++ {
+			ct.Put([]byte(fmt.Sprintf("key-%05d", i)), &data.LogRecordPos{Fid: 2, Offset: int64(i)})
+		}
+	}()
+	for r := 0; r < 20; r++ {
+		iter := ct.Iterator(false)
+		size := ct.Size()
+		var count int
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			assert.Equal(t, []byte(fmt.Sprintf("key-%05d", count)), iter.Key())
+			count++
+		}
+		assert.GreaterOrEqual(t, count, 1000)
+		assert.LessOrEqual(t, count, size)
+		iter.Close()
+	}
+	<-done
+}
@@ -3,7 +3,9 @@ package index
 import (
 	"KV/data"
 	"bytes"
+	"errors"
 	"github.com/google/btree"
+	"sync"
 )
 
 type Indexer interface {
@@ -19,6 +21,38 @@ type Indexer interface {
 	Iterator(reverse bool) Iterator
 
 	Size() int
+
+	// Close 关闭索引
+	Close() error
+}
+
+// Checkpointer 持久化索引实现的接口，记录索引已经覆盖到的数据位置（高水位）
+// 启动时只需要重放高水位之后的数据
+type Checkpointer interface {
+	// Checkpoint 取出高水位，Offset 表示该文件中已经被索引覆盖的数据末尾，没有记录时返回 nil
+	Checkpoint() *data.LogRecordPos
+
+	// SetCheckpoint 更新高水位
+	SetCheckpoint(pos *data.LogRecordPos) bool
+}
+
+// MemoryReporter 内存索引可以实现的接口，统计索引自身占用的内存
+type MemoryReporter interface {
+	// MemoryUsage 索引占用的内存大小，单位为字节
+	MemoryUsage() int64
+}
+
+// Batcher 持久化索引可以实现的接口，在一个事务中执行一批更新，减少持久化的次数
+// 传给 fn 的 Batch 同时实现了 Checkpointer 时，高水位和索引在同一个事务中更新
+type Batcher interface {
+	Batch(fn func(batch Batch) error) error
+}
+
+// Batch 批量更新时可以执行的索引操作
+type Batch interface {
+	Put(key []byte, pos *data.LogRecordPos) bool
+	Get(key []byte) *data.LogRecordPos
+	Delete(key []byte) bool
 }
 
 type IndexType = int8
@@ -30,20 +64,89 @@ const (
 	// ART 自适应基数树索引
 	ART
 	BPTree
+
+	// Compact 内存紧凑索引
+	Compact
+)
+
+var (
+	ErrUnsupportedIndexType = errors.New("unsupported index type")
+	ErrIndexTypeExists      = errors.New("index type is already registered")
+)
+
+// Config 初始化索引时的配置
+type Config struct {
+	DirPath      string            // 数据目录，持久化索引的文件存放在这里
+	SyncWrites   bool              // 每次写入是否持久化
+	DataFileSize int64             // 数据文件的大小
+	Params       map[string]string // 自定义索引的额外参数
+}
+
+// IndexerFactory 索引工厂
+type IndexerFactory struct {
+	// New 根据配置创建索引
+	New func(config Config) (Indexer, error)
+
+	// Persistent 索引本身是否持久化，持久化的索引在启动时不需要从数据文件中重建
+	// 实现了 Checkpointer 的持久化索引会在启动时重放高水位之后写入的数据
+	Persistent bool
+}
+
+var (
+	registryLock = new(sync.RWMutex)
+	registry     = make(map[IndexType]IndexerFactory)
 )
 
+func init() {
+	builtins := map[IndexType]IndexerFactory{
+		Btree: {New: func(Config) (Indexer, error) { return NewBTree(), nil }},
+		ART:   {New: func(Config) (Indexer, error) { return NewART(), nil }},
+		BPTree: {
+			New: func(config Config) (Indexer, error) {
+				bpt, err := NewBPTree(config.DirPath, config.SyncWrites)
+				if err != nil {
+					return nil, err
+				}
+				return bpt, nil
+			},
+			Persistent: true,
+		},
+		Compact: {New: func(Config) (Indexer, error) { return NewCompactTree(), nil }},
+	}
+	for typ, factory := range builtins {
+		registry[typ] = factory
+	}
+}
+
+// RegisterIndexer 注册自定义的索引类型，之后可以通过 Options.IndexType 使用
+func RegisterIndexer(typ IndexType, factory IndexerFactory) error {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if _, ok := registry[typ]; ok {
+		return ErrIndexTypeExists
+	}
+	registry[typ] = factory
+	return nil
+}
+
 // NewIndexer 根据类型初始化索引
-func NewIndexer(typ IndexType, dirPath string, sync bool) Indexer {
-	switch typ {
-	case Btree:
-		return NewBTree()
-	case ART:
-		return NewART()
-	case BPTree:
-		return NewBPTree(dirPath, sync)
-	default:
-		panic("unsupported index type")
+func NewIndexer(typ IndexType, config Config) (Indexer, error) {
+	registryLock.RLock()
+	factory, ok := registry[typ]
+	registryLock.RUnlock()
+
+	if !ok {
+		return nil, ErrUnsupportedIndexType
 	}
+	return factory.New(config)
+}
+
+// IsPersistent 判断索引类型是否持久化
+func IsPersistent(typ IndexType) bool {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	return registry[typ].Persistent
 }
 
 type Item struct {
@@ -0,0 +1,54 @@
+package index
+
+import (
+	"KV/data"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewIndexer(t *testing.T) {
+	// 1.内置的索引类型
+	bt, err := NewIndexer(Btree, Config{})
+	assert.Nil(t, err)
+	assert.IsType(t, &BTree{}, bt)
+	assert.False(t, IsPersistent(Btree))
+	assert.True(t, IsPersistent(BPTree))
+
+	// 2.不支持的索引类型
+	_, err = NewIndexer(IndexType(100), Config{})
+	assert.Equal(t, ErrUnsupportedIndexType, err)
+
+	// 3.持久化索引打开失败时返回错误
+	_, err = NewIndexer(BPTree, Config{DirPath: filepath.Join(os.TempDir(), "bptree-not-exist", "index")})
+	assert.NotNil(t, err)
+}
+
+func TestRegisterIndexer(t *testing.T) {
+	var typ IndexType = 101
+	var config Config
+	err := RegisterIndexer(typ, IndexerFactory{
+		New: func(c Config) (Indexer, error) {
+			config = c
+			return NewART(), nil
+		},
+		Persistent: true,
+	})
+	assert.Nil(t, err)
+
+	// 重复注册
+	err = RegisterIndexer(typ, IndexerFactory{})
+	assert.Equal(t, ErrIndexTypeExists, err)
+	err = RegisterIndexer(Btree, IndexerFactory{})
+	assert.Equal(t, ErrIndexTypeExists, err)
+
+	indexer, err := NewIndexer(typ, Config{DirPath: "/tmp/custom", Params: map[string]string{"a": "b"}})
+	assert.Nil(t, err)
+	assert.True(t, IsPersistent(typ))
+	assert.Equal(t, "/tmp/custom", config.DirPath)
+	assert.Equal(t, "b", config.Params["a"])
+
+	indexer.Put([]byte("key"), &data.LogRecordPos{Fid: 1, Offset: 2})
+	assert.Equal(t, int64(2), indexer.Get([]byte("key")).Offset)
+}
@@ -9,26 +9,34 @@ type Iterator struct {
 	indexIter index.Iterator
 	db        *DB
 	option    IteratorOptions
+	epoch     uint64 // 创建时的 epoch，关闭之前 merge 替换掉的数据文件不会被删除
+	closed    bool
 }
 
 func (db *DB) NewIterator(op IteratorOptions) *Iterator {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
 	indexIterator := db.index.Iterator(op.Reverse)
+	db.readers[db.fileEpoch]++
 	return &Iterator{
 		indexIter: indexIterator,
 		db:        db,
 		option:    op,
+		epoch:     db.fileEpoch,
 	}
 }
 
 func (it *Iterator) SkipToNext() {
 	prefixLen := len(it.option.Prefix)
-	if prefixLen == 0 {
-		return
-	}
 
 	for ; it.indexIter.Valid(); it.indexIter.Next() {
 		k := it.indexIter.Key()
-		if prefixLen <= len(k) && bytes.Compare(it.option.Prefix, k[:prefixLen]) == 0 {
+		// 跳过内部使用的 key
+		if isInternalKey(k) {
+			continue
+		}
+		if prefixLen == 0 || prefixLen <= len(k) && bytes.Compare(it.option.Prefix, k[:prefixLen]) == 0 {
 			break
 		}
 	}
@@ -67,4 +75,15 @@ func (it *Iterator) Value() ([]byte, error) {
 
 func (it *Iterator) Close() {
 	it.indexIter.Close()
+
+	it.db.mu.Lock()
+	defer it.db.mu.Unlock()
+	if it.closed {
+		return
+	}
+	it.closed = true
+	if it.db.readers[it.epoch]--; it.db.readers[it.epoch] <= 0 {
+		delete(it.db.readers, it.epoch)
+	}
+	_ = it.db.releaseRetiredFiles()
 }
@@ -0,0 +1,219 @@
+package KV
+
+import (
+	"KV/data"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 数据目录中有效的文件由 MANIFEST 描述，启动时只加载其中列出的文件，没有列出的数据文件、hint 文件和 blob 文件都会被删除
+// 切换活跃文件以及 merge 生效时重写 MANIFEST，merge 生成的文件在 MANIFEST 重写之前都是不可见的
+
+// 启动时根据 manifest 打开数据文件
+// 旧版本的数据目录中没有 manifest，根据目录中的文件生成
+func (db *DB) loadManifest() error {
+	manifest, err := data.ReadManifest(db.options.DirPath)
+	if err != nil {
+		return err
+	}
+	if manifest == nil {
+		return db.createManifest()
+	}
+	db.manifest = manifest
+
+	// 没有生效的 merge 结果直接丢弃
+	if err := os.RemoveAll(db.getMergePath()); err != nil {
+		return err
+	}
+	if err := db.removeUnlistedFiles(); err != nil {
+		return err
+	}
+
+	if err := db.openManifestFiles(); err != nil {
+		return err
+	}
+	if err := db.loadFooters(); err != nil {
+		return err
+	}
+
+	// 持久化索引中可能仍然保存着被替换的旧数据文件中的位置
+	if len(manifest.MergedFileIds) > 0 {
+		if db.persistentIndex {
+			if err := db.applyMergeHints(db.options.DirPath, db.lastMergeHintFileIds(), manifest.MergedFileIds); err != nil {
+				return err
+			}
+		}
+		newManifest := db.newManifest(manifest.ActiveFileId, nil, nil)
+		newManifest.MergedFileIds = nil
+		return db.writeManifest(newManifest)
+	}
+	return nil
+}
+
+// 打开 manifest 中列出的数据文件和 blob 文件
+func (db *DB) openManifestFiles() error {
+	for _, fileId := range db.manifest.DataFileIds {
+		if _, err := os.Stat(data.GetDataFileName(db.options.DirPath, fileId)); err != nil {
+			if os.IsNotExist(err) {
+				return ErrDataDirectoryCorrupted
+			}
+			return err
+		}
+		dataFile, err := db.openDataFile(db.options.DirPath, fileId)
+		if err != nil {
+			return err
+		}
+		db.olderFiles[fileId] = dataFile
+		db.fileIds = append(db.fileIds, int(fileId))
+	}
+	dataFile, err := db.openDataFile(db.options.DirPath, db.manifest.ActiveFileId)
+	if err != nil {
+		return err
+	}
+	db.activeFile = dataFile
+	db.fileIds = append(db.fileIds, int(db.manifest.ActiveFileId))
+	return db.loadBlobFiles()
+}
+
+// 根据目录中的文件生成 manifest
+func (db *DB) createManifest() error {
+	if err := db.loadMergeFiles(); err != nil {
+		return err
+	}
+	if err := db.loadDataFiles(); err != nil {
+		return err
+	}
+	if db.activeFile == nil {
+		return nil
+	}
+	manifest := db.newManifest(db.activeFile.FileId, nil, nil)
+	for _, fileId := range manifest.DataFileIds {
+		if _, err := os.Stat(data.GetHintFileName(db.options.DirPath, fileId)); err == nil {
+			manifest.HintFileIds = append(manifest.HintFileIds, fileId)
+		}
+	}
+	return db.writeManifest(manifest)
+}
+
+// 删除数据目录中没有被 manifest 列出的数据文件、hint 文件和 blob 文件
+func (db *DB) removeUnlistedFiles() error {
+	dataFileIds := make(map[uint32]struct{}, len(db.manifest.DataFileIds)+1)
+	dataFileIds[db.manifest.ActiveFileId] = struct{}{}
+	for _, fileId := range db.manifest.DataFileIds {
+		dataFileIds[fileId] = struct{}{}
+	}
+	hintFileIds := make(map[uint32]struct{}, len(db.manifest.HintFileIds))
+	for _, fileId := range db.manifest.HintFileIds {
+		hintFileIds[fileId] = struct{}{}
+	}
+	blobFileIds := make(map[uint32]struct{}, len(db.manifest.BlobFileIds))
+	for _, fileId := range db.manifest.BlobFileIds {
+		blobFileIds[fileId] = struct{}{}
+	}
+
+	dirEntries, err := os.ReadDir(db.options.DirPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range dirEntries {
+		var listed map[uint32]struct{}
+		var suffix string
+		switch {
+		case strings.HasSuffix(entry.Name(), data.DataFileNameSuffix):
+			listed, suffix = dataFileIds, data.DataFileNameSuffix
+		case strings.HasSuffix(entry.Name(), data.HintFileNameSuffix):
+			listed, suffix = hintFileIds, data.HintFileNameSuffix
+		case strings.HasSuffix(entry.Name(), data.BlobFileNameSuffix):
+			listed, suffix = blobFileIds, data.BlobFileNameSuffix
+		default:
+			continue
+		}
+		fileId, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), suffix), 10, 32)
+		if err != nil {
+			return ErrDataDirectoryCorrupted
+		}
+		if _, ok := listed[uint32(fileId)]; ok {
+			continue
+		}
+		if err := os.Remove(filepath.Join(db.options.DirPath, entry.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// 最近一次 merge 生成的数据文件对应的 hint 文件
+// merge 生成的数据文件使用 [MergeFirstFileId, MergeBoundary) 之间预留的 id
+func (db *DB) lastMergeHintFileIds() []uint32 {
+	var fileIds []uint32
+	for _, fileId := range db.manifest.HintFileIds {
+		if fileId >= db.manifest.MergeFirstFileId && fileId < db.manifest.MergeBoundary {
+			fileIds = append(fileIds, fileId)
+		}
+	}
+	return fileIds
+}
+
+// 根据当前打开的数据文件生成新的 manifest
+// removed 中的数据文件不再列出，added 为 merge 生成的数据文件，都有对应的 hint 文件
+// 在访问此方法前必须持有互斥锁
+func (db *DB) newManifest(activeFileId uint32, removed, added []uint32) *data.Manifest {
+	manifest := &data.Manifest{ActiveFileId: activeFileId}
+	removedIds := make(map[uint32]struct{}, len(removed))
+	for _, fileId := range removed {
+		removedIds[fileId] = struct{}{}
+	}
+
+	for fileId := range db.olderFiles {
+		if _, ok := removedIds[fileId]; !ok {
+			manifest.DataFileIds = append(manifest.DataFileIds, fileId)
+		}
+	}
+	manifest.DataFileIds = append(manifest.DataFileIds, added...)
+	manifest.HintFileIds = append(manifest.HintFileIds, added...)
+	if db.manifest != nil {
+		for _, fileId := range db.manifest.HintFileIds {
+			if _, ok := removedIds[fileId]; !ok {
+				manifest.HintFileIds = append(manifest.HintFileIds, fileId)
+			}
+		}
+		manifest.MergeBoundary = db.manifest.MergeBoundary
+		manifest.MergeFirstFileId = db.manifest.MergeFirstFileId
+		manifest.MergedFileIds = db.manifest.MergedFileIds
+	}
+	// 活跃的 blob 文件排在最后
+	for fileId := range db.blobFiles {
+		manifest.BlobFileIds = append(manifest.BlobFileIds, fileId)
+	}
+	sortFileIds(manifest.DataFileIds)
+	sortFileIds(manifest.HintFileIds)
+	sortFileIds(manifest.BlobFileIds)
+	for _, fileId := range manifest.DataFileIds {
+		if _, ok := db.footers[fileId]; ok {
+			manifest.FooterFileIds = append(manifest.FooterFileIds, fileId)
+		}
+	}
+	if db.activeBlobFile != nil {
+		manifest.BlobFileIds = append(manifest.BlobFileIds, db.activeBlobFile.FileId)
+	}
+	return manifest
+}
+
+// 写入新的 manifest
+// 在访问此方法前必须持有互斥锁
+func (db *DB) writeManifest(manifest *data.Manifest) error {
+	if err := data.WriteManifest(db.options.DirPath, manifest); err != nil {
+		return err
+	}
+	db.manifest = manifest
+	return nil
+}
+
+func sortFileIds(fileIds []uint32) {
+	sort.Slice(fileIds, func(i, j int) bool {
+		return fileIds[i] < fileIds[j]
+	})
+}
@@ -2,64 +2,247 @@ package KV
 
 import (
 	"KV/data"
+	"KV/index"
+	"KV/utils"
+	"context"
+	"errors"
 	"io"
 	"os"
 	"path"
 	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
-	mergeDirName   = "-merge"
-	mergeFinishKey = "merge.finished"
+	mergeDirName = "-merge"
+
+	// 每读取这么多数据汇报一次 merge 进度
+	mergeProgressBytes = 4 * 1024 * 1024
 )
 
+// MergeProgress merge 的进度
+type MergeProgress struct {
+	TotalFiles     int   // 参与 merge 的数据文件数
+	FilesProcessed int   // 已经处理完的数据文件数
+	BytesRead      int64 // 从旧数据文件中读取的字节数
+	BytesWritten   int64 // 写入新数据文件和 hint 文件的字节数
+	RecordsCopied  int64 // 复制的有效记录数
+}
+
+// 数据文件中有效数据和无效数据的大小
+type fileStat struct {
+	liveSize  int64
+	liveCount int64 // 有效记录的数量，用于估算 merge 生成的 hint 文件的大小
+	deadSize  int64
+}
+
+// Merge 清理无效数据
+// 挑选出无效数据比例达到阈值的数据文件，将其中有效的记录重写到新的数据文件中，完成后立即生效
 func (db *DB) Merge() error {
+	return db.MergeContext(context.Background(), nil)
+}
+
+// MergeContext 和 Merge 相同，ctx 被取消时尽快停止并删除没有完成的 merge 目录
+// progress 不为空时，每处理完一个数据文件以及每读取一定量的数据时汇报一次进度
+func (db *DB) MergeContext(ctx context.Context, progress func(MergeProgress)) error {
 	if db.activeFile == nil {
 		return nil
 	}
 	db.mu.Lock()
 
+	if db.failed {
+		db.mu.Unlock()
+		return ErrDatabaseFailed
+	}
 	if db.isMerging {
 		db.mu.Unlock()
 		return ErrMergeIsProgress
 	}
 
+	if err := db.loadFileStats(); err != nil {
+		db.mu.Unlock()
+		return err
+	}
+	mergeFiles := db.pickMergeFiles()
+	if len(mergeFiles) == 0 {
+		db.mu.Unlock()
+		return nil
+	}
+	groups := db.mergeGroups(mergeFiles)
+	var reservedIds uint32
+	for _, group := range groups {
+		reservedIds += group.fileIds
+	}
+	if err := db.checkMergeSpace(mergeFiles, reservedIds); err != nil {
+		db.mu.Unlock()
+		return err
+	}
+
 	db.isMerging = true
 
 	defer func() {
+		db.mu.Lock()
 		db.isMerging = false
+		db.mu.Unlock()
+		// merge 期间没有写入 footer 的旧数据文件
+		db.notifySeal()
 	}()
 
-	//处理活跃文件
+	//处理活跃文件，merge 生成的数据文件中的记录可能引用活跃 blob 文件中的数据
+	if err := db.syncBlobFile(); err != nil {
+		db.mu.Unlock()
+		return err
+	}
 	if err := db.activeFile.Sync(); err != nil {
 		db.mu.Unlock()
 		return err
 	}
-	db.olderFiles[db.activeFile.FileId] = db.activeFile
+	activeFileId := db.activeFile.FileId
+	db.olderFiles[activeFileId] = db.activeFile
 
-	if err := db.setActiveDataFile(); err != nil {
+	// merge 之后的数据文件使用活跃文件之后预留的 id
+	// 保证重放时排在没有参与 merge 的旧数据文件之后、新写入的数据之前
+	firstFileId := activeFileId + 1
+	lastFileId := activeFileId + reservedIds
+	if err := db.openActiveDataFile(lastFileId + 1); err != nil {
 		db.mu.Unlock()
 		return err
 	}
+	unmerged := db.unmergedFiles(mergeFiles)
 
-	//记录当前文件，不参与 merge
-	nonMergeFileId := db.activeFile.FileId
+	db.mu.Unlock()
 
-	var mergeFiles []*data.DataFile
-	for _, file := range db.olderFiles {
-		mergeFiles = append(mergeFiles, file)
+	// 失败时删除写了一半的 merge 目录，不影响当前的数据文件
+	mergePath := db.getMergePath()
+	err := db.writeMergeFiles(ctx, mergePath, groups, firstFileId, unmerged, progress)
+	if err != nil {
+		_ = os.RemoveAll(mergePath)
+		return err
+	}
 
+	return db.installMergeFiles(mergePath, mergeFiles, firstFileId, lastFileId+1)
+}
+
+// 获取磁盘可用空间，测试时可以替换
+var availableDiskSize = utils.AvailableDiskSize
+
+// 估算 merge 需要的磁盘空间，检查磁盘空间是否足够
+// 包括有效数据、每条有效记录对应的 hint 记录以及每个预留的新数据文件的 footer，当前平台不支持获取可用空间时不做检查
+// 在访问此方法前必须持有互斥锁
+func (db *DB) checkMergeSpace(mergeFiles []*data.DataFile, outputFiles uint32) error {
+	var liveSize, liveCount int64
+	for _, file := range mergeFiles {
+		if stat := db.fileStats[file.FileId]; stat != nil {
+			liveSize += stat.liveSize
+			liveCount += stat.liveCount
+		}
 	}
 
-	db.mu.Unlock()
+	// hint 记录中的 key 不会超过数据记录的长度，也不会超过 key 的最大长度
+	maxKeySize := liveSize
+	if db.options.MaxKeySize > 0 {
+		maxKeySize = min(maxKeySize, int64(db.options.MaxKeySize))
+	}
+	hintKeySize := liveSize
+	if db.options.MaxKeySize > 0 {
+		hintKeySize = min(hintKeySize, liveCount*int64(db.options.MaxKeySize))
+	}
+	hintSize := liveCount*db.codec.MaxEncodedSize(0, data.MaxLogRecordPosSize) + hintKeySize
+	footerSize := int64(outputFiles) * db.codec.MaxFooterSize(maxKeySize)
+	needSize := liveSize + hintSize + footerSize
 
-	sort.Slice(mergeFiles, func(i, j int) bool {
-		return mergeFiles[i].FileId < mergeFiles[j].FileId
-	})
-	mergePath := db.getMergePath()
-	if _, err := os.Stat(mergePath); err != nil {
+	availableSize, err := availableDiskSize(db.options.DirPath)
+	if err == errors.ErrUnsupported {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if uint64(needSize) >= availableSize {
+		return ErrNoEnoughSpaceForMerge
+	}
+	return nil
+}
+
+// 没有参与 merge 的旧数据文件，footer 为空时文件还没有写入 footer
+type unmergedFile struct {
+	fileId uint32
+	footer *data.Footer
+}
+
+// 取出没有参与 merge 的旧数据文件以及它们的 footer
+// 被替换之后还没有删除的旧数据文件没有在 manifest 中列出，重启之后不会被重放，不需要考虑
+// 在访问此方法前必须持有互斥锁
+func (db *DB) unmergedFiles(mergeFiles []*data.DataFile) []unmergedFile {
+	merged := make(map[uint32]struct{}, len(mergeFiles))
+	for _, file := range mergeFiles {
+		merged[file.FileId] = struct{}{}
+	}
+
+	var files []unmergedFile
+	for fileId := range db.olderFiles {
+		if _, ok := merged[fileId]; !ok {
+			files = append(files, unmergedFile{fileId: fileId, footer: db.footers[fileId]})
+		}
+	}
+	return files
+}
+
+// 判断 id 小于 fileId 的没有参与 merge 的数据文件中是否可能有 [start, end) 范围内的 key
+// 根据 footer 中 key 的范围跳过不可能包含这些 key 的数据文件，没有 footer 的数据文件无法判断，认为可能有
+func mayContainKeys(files []unmergedFile, fileId uint32, start, end []byte) bool {
+	for _, file := range files {
+		if file.fileId >= fileId {
+			continue
+		}
+		if file.footer == nil || file.footer.Overlaps(start, end) {
+			return true
+		}
+	}
+	return false
+}
+
+// merge 的一组连续的数据文件，以及为这组数据文件预留的新数据文件 id 数量
+type mergeGroup struct {
+	files   []*data.DataFile
+	fileIds uint32
+}
+
+// 参与 merge 的数据文件按照 id 顺序分成连续的几组，每个 worker 处理一组
+// 新数据文件写满时才会使用下一个 id，相邻两个新数据文件的大小之和一定超过 DataFileSize，
+// 每组根据有效数据的大小预留 2*ceil(有效数据/DataFileSize)+1 个 id，merge 之后的数据文件仍然保持原来的先后顺序
+// 在访问此方法前必须持有互斥锁
+func (db *DB) mergeGroups(mergeFiles []*data.DataFile) []mergeGroup {
+	workers := db.options.MergeWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	groupSize := (len(mergeFiles) + workers - 1) / workers
+
+	var groups []mergeGroup
+	for start := 0; start < len(mergeFiles); start += groupSize {
+		files := mergeFiles[start:min(start+groupSize, len(mergeFiles))]
+		var liveSize int64
+		for _, file := range files {
+			if stat := db.fileStats[file.FileId]; stat != nil {
+				liveSize += stat.liveSize
+			}
+		}
+		fileIds := 2*((liveSize+db.options.DataFileSize-1)/db.options.DataFileSize) + 1
+		groups = append(groups, mergeGroup{files: files, fileIds: uint32(fileIds)})
+	}
+	return groups
+}
+
+// 将每组数据文件中的有效数据写入 merge 目录，使用从 firstFileId 开始预留的 id
+// 删除标记只有在没有参与 merge 的更旧的数据文件中可能存在被它删除的数据时才保留
+func (db *DB) writeMergeFiles(ctx context.Context, mergePath string, groups []mergeGroup,
+	firstFileId uint32, unmerged []unmergedFile, progress func(MergeProgress)) error {
+	if _, err := os.Stat(mergePath); err == nil {
 		if err := os.RemoveAll(mergePath); err != nil {
 			return err
 		}
@@ -69,78 +252,460 @@ func (db *DB) Merge() error {
 		return err
 	}
 
-	mergeOption := db.options
-	mergeOption.DirPath = mergePath
-	mergeOption.SyncWrites = false
-	mergeDB, err := Open(mergeOption)
+	var totalFiles int
+	for _, group := range groups {
+		totalFiles += len(group.files)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	tracker := &mergeTracker{
+		stat:     MergeProgress{TotalFiles: totalFiles},
+		progress: progress,
+	}
+	var wg sync.WaitGroup
+	var errs []error
+	var errsLock sync.Mutex
+	nextFileId := firstFileId
+	for _, group := range groups {
+		writer := &mergeWriter{
+			dirPath:    mergePath,
+			fileSize:   db.options.DataFileSize,
+			nextFileId: nextFileId,
+			lastFileId: nextFileId + group.fileIds - 1,
+			limiter:    db.mergeLimiter,
+			codec:      db.codec,
+		}
+		nextFileId += group.fileIds
+
+		wg.Add(1)
+		go func(files []*data.DataFile) {
+			defer wg.Done()
+			defer writer.close()
+			if err := db.mergeDataFiles(ctx, files, writer, unmerged, tracker); err != nil {
+				// 出错时让其他 worker 尽快停止
+				errsLock.Lock()
+				errs = append(errs, err)
+				errsLock.Unlock()
+				cancel()
+			}
+		}(group.files)
+	}
+	wg.Wait()
+
+	// 优先返回导致其他 worker 停止的错误
+	for _, err := range errs {
+		if err != context.Canceled {
+			return err
+		}
+	}
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// 将 merge 生成的数据文件替换到当前的数据库中，[firstFileId, mergeBoundary) 为预留的 id，mergeBoundary 为 merge 开始时打开的活跃文件 id
+// 移动过来的文件在 manifest 重写之前都是不可见的，重写 manifest 之后 merge 才真正生效
+func (db *DB) installMergeFiles(mergePath string, mergeFiles []*data.DataFile, firstFileId, mergeBoundary uint32) error {
+	mergeFileNames, _ := readMergeDir(mergePath)
+	outputFileIds, err := parseFileIds(mergeFileNames, data.DataFileNameSuffix)
 	if err != nil {
+		_ = os.RemoveAll(mergePath)
+		return err
+	}
+	mergedFileIds := make([]uint32, len(mergeFiles))
+	for i, dataFile := range mergeFiles {
+		mergedFileIds[i] = dataFile.FileId
+	}
+
+	// 写入中的索引快照可能包含旧数据文件中的位置
+	db.snapshotMu.Lock()
+	defer db.snapshotMu.Unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// manifest 生效之前出错时，删除已经移动过来的文件，关闭打开的文件，数据库仍然使用原来的数据文件
+	var movedFiles []string
+	var outputFiles []*data.DataFile
+	rollback := func(err error) error {
+		for _, dataFile := range outputFiles {
+			_ = dataFile.Close()
+			delete(db.footers, dataFile.FileId)
+		}
+		for _, fileName := range movedFiles {
+			_ = os.Remove(fileName)
+		}
+		_ = os.RemoveAll(mergePath)
 		return err
 	}
-	hintFile, err := data.OpenHintFile(mergePath)
+
+	if err := data.RemoveIndexSnapshot(db.options.DirPath); err != nil {
+		return rollback(err)
+	}
+	for _, fileName := range mergeFileNames {
+		srcPath := path.Join(mergePath, fileName)
+		dstPath := path.Join(db.options.DirPath, fileName)
+		if err := os.Rename(srcPath, dstPath); err != nil {
+			return rollback(err)
+		}
+		movedFiles = append(movedFiles, dstPath)
+	}
+	for _, fileId := range outputFileIds {
+		dataFile, err := db.openDataFile(db.options.DirPath, fileId)
+		if err != nil {
+			return rollback(err)
+		}
+		outputFiles = append(outputFiles, dataFile)
+	}
+	for _, dataFile := range outputFiles {
+		footer, err := dataFile.ReadFooter()
+		if err != nil {
+			return rollback(err)
+		}
+		db.footers[dataFile.FileId] = footer
+	}
+	// hint 文件提前读取到内存中，manifest 生效之后更新索引时不需要再读取文件
+	hints, err := db.readMergeHints(db.options.DirPath, outputFileIds)
 	if err != nil {
+		return rollback(err)
+	}
+
+	// 持久化索引在 manifest 生效之后才更新，中途崩溃时在启动时根据 manifest 继续更新
+	manifest := db.newManifest(db.activeFile.FileId, mergedFileIds, outputFileIds)
+	manifest.MergeBoundary = mergeBoundary
+	manifest.MergeFirstFileId = firstFileId
+	manifest.MergedFileIds = nil
+	if db.persistentIndex {
+		manifest.MergedFileIds = mergedFileIds
+	}
+	if err := db.writeManifest(manifest); err != nil {
+		return rollback(err)
+	}
+
+	// manifest 已经生效，无法回滚，更新索引失败时内存中的索引和数据文件不一致，数据库不能再使用
+	// 重新打开时根据 manifest 重建索引，持久化索引根据 MergedFileIds 继续更新
+	for _, dataFile := range outputFiles {
+		db.olderFiles[dataFile.FileId] = dataFile
+	}
+	if err := db.applyHints(hints, mergedFileIds); err != nil {
+		db.failed = true
 		return err
 	}
 
+	// 旧数据文件可能仍然被之前创建的迭代器读取，等到没有迭代器引用之后再删除
+	db.fileEpoch++
 	for _, dataFile := range mergeFiles {
-		var offset int64 = 0
+		delete(db.olderFiles, dataFile.FileId)
+		delete(db.footers, dataFile.FileId)
+		if db.fileStats != nil {
+			delete(db.fileStats, dataFile.FileId)
+		}
+		db.retiredFiles[dataFile.FileId] = &retiredFile{file: dataFile, epoch: db.fileEpoch}
+	}
 
+	// 以下步骤失败时内存和磁盘上的状态仍然一致：MergedFileIds 没有清除时重新打开会再次更新索引，
+	// merge 目录会在下次 merge 时删除，旧数据文件会在下次释放时删除
+	if db.persistentIndex {
+		manifest = db.newManifest(db.activeFile.FileId, nil, nil)
+		manifest.MergedFileIds = nil
+		if err := db.writeManifest(manifest); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(mergePath); err != nil {
+		return err
+	}
+	return db.releaseRetiredFiles()
+}
+
+// 从文件名中解析出以 suffix 结尾的文件的 id
+func parseFileIds(fileNames []string, suffix string) ([]uint32, error) {
+	var fileIds []uint32
+	for _, fileName := range fileNames {
+		if !strings.HasSuffix(fileName, suffix) {
+			continue
+		}
+		fileId, err := strconv.Atoi(strings.TrimSuffix(fileName, suffix))
+		if err != nil {
+			return nil, ErrDataDirectoryCorrupted
+		}
+		fileIds = append(fileIds, uint32(fileId))
+	}
+	return fileIds, nil
+}
+
+// 被 merge 替换的旧数据文件，或者被回收的旧 blob 文件
+type retiredFile struct {
+	file  *data.DataFile
+	epoch uint64 // 被替换之后的 epoch，在这之前创建的迭代器可能仍然引用这个文件
+}
+
+// 删除已经没有迭代器引用的旧数据文件和 blob 文件
+// 在访问此方法前必须持有互斥锁
+func (db *DB) releaseRetiredFiles() error {
+	for fileId, retired := range db.retiredFiles {
+		if db.isFileReferenced(retired.epoch) {
+			continue
+		}
+		if err := retired.file.Close(); err != nil {
+			return err
+		}
+		for _, fileName := range []string{
+			data.GetDataFileName(db.options.DirPath, fileId),
+			data.GetHintFileName(db.options.DirPath, fileId),
+		} {
+			if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		delete(db.retiredFiles, fileId)
+	}
+	for fileId, retired := range db.retiredBlobFiles {
+		if db.isFileReferenced(retired.epoch) {
+			continue
+		}
+		if err := retired.file.Close(); err != nil {
+			return err
+		}
+		if err := os.Remove(data.GetBlobFileName(db.options.DirPath, fileId)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		delete(db.retiredBlobFiles, fileId)
+	}
+	return nil
+}
+
+// 判断是否还有 epoch 之前创建的迭代器
+// 在访问此方法前必须持有互斥锁
+func (db *DB) isFileReferenced(epoch uint64) bool {
+	for readerEpoch := range db.readers {
+		if readerEpoch < epoch {
+			return true
+		}
+	}
+	return false
+}
+
+// 将数据文件中的有效数据依次写入 writer
+func (db *DB) mergeDataFiles(ctx context.Context, mergeFiles []*data.DataFile, writer *mergeWriter,
+	unmerged []unmergedFile, tracker *mergeTracker) error {
+	var delta MergeProgress
+	var written int64
+	report := func() {
+		delta.BytesWritten, written = writer.written-written, writer.written
+		tracker.add(delta)
+		delta = MergeProgress{}
+	}
+
+	for _, dataFile := range mergeFiles {
+		reader, err := dataFile.NewReader(0)
+		if err != nil {
+			return err
+		}
+
+		var offset int64 = 0
 		for {
-			logRecord, size, err := dataFile.ReadLogRecord(offset)
+			logRecord, size, err := reader.Next()
 			if err != nil {
 				if err == io.EOF {
-					return nil
+					break
 				}
 				return err
 			}
+			// 同时检查 ctx 是否已经被取消
+			if err := db.mergeLimiter.Wait(ctx, size); err != nil {
+				return err
+			}
+			if delta.BytesRead += size; delta.BytesRead >= mergeProgressBytes {
+				report()
+			}
+
 			realKey, _ := parseLogRecordKey(logRecord.Key)
 			logRecordPos := db.index.Get(realKey)
-			if logRecordPos != nil && logRecordPos.Fid == dataFile.FileId && logRecordPos.Offset == offset {
-				logRecord.Key = logRecordKeyWithSeqNo(realKey, nonTransactionSeqNo)
-				pos, err := mergeDB.appendLogRecord(logRecord)
-				if err != nil {
-					return err
-				}
 
-				// 写到 hint 文件
-				if err := dataFile.WriteHint(realKey, pos); err != nil {
+			var keep bool
+			switch logRecord.Type {
+			case data.LogRecordNormal:
+				keep = logRecordPos != nil && logRecordPos.Fid == dataFile.FileId && logRecordPos.Offset == offset
+			case data.LogRecordDeleted:
+				// 没有参与 merge 的更旧的数据文件中可能还有被删除的数据，需要保留删除标记，避免重启后重新出现
+				// key 已经被重新写入时，新的数据会覆盖旧的数据，不需要保留
+				keep = logRecordPos == nil && mayContainKeys(unmerged, dataFile.FileId, realKey, append(append([]byte(nil), realKey...), 0))
+			case data.LogRecordRangeDeleted:
+				// 范围删除标记同样只在更旧的数据文件没有全部参与 merge 时保留，并记录它最初写入的位置
+				// 范围内仍然有在它之前写入的 key，说明删除标记所在的事务没有完成，不需要保留
+				end, origin, ok := decodeRangeTombstone(logRecord.Value)
+				if !ok {
+					return ErrDataDirectoryCorrupted
+				}
+				if origin == nil {
+					origin = &data.LogRecordPos{Fid: dataFile.FileId, Offset: offset}
+				}
+				keep = mayContainKeys(unmerged, origin.Fid, realKey, end) && len(db.rangeKeys(realKey, end, origin)) == 0
+				logRecord.Value = encodeRangeTombstone(end, origin)
+			}
+			if keep {
+				logRecord.Key = logRecordKeyWithSeqNo(realKey, nonTransactionSeqNo)
+				if err := writer.write(ctx, realKey, logRecord); err != nil {
 					return err
 				}
-
+				delta.RecordsCopied++
 			}
 			offset += size
 		}
+		delta.FilesProcessed++
+		report()
 	}
 
-	//持久化
-	if err := hintFile.Sync(); err != nil {
-		return err
+	//写入 footer 并持久化
+	return writer.finish()
+}
+
+// 汇总各个 worker 的 merge 进度
+// 回调在锁外执行，同一时间只有一个 worker 调用回调，其他 worker 的进度由正在调用回调的 worker 汇报
+type mergeTracker struct {
+	mu       sync.Mutex
+	stat     MergeProgress
+	seq      uint64 // 每次更新进度时递增
+	reported uint64 // 已经汇报过的进度对应的 seq
+	reportMu sync.Mutex
+	progress func(MergeProgress)
+}
+
+func (mt *mergeTracker) add(delta MergeProgress) {
+	mt.mu.Lock()
+	mt.stat.FilesProcessed += delta.FilesProcessed
+	mt.stat.BytesRead += delta.BytesRead
+	mt.stat.BytesWritten += delta.BytesWritten
+	mt.stat.RecordsCopied += delta.RecordsCopied
+	mt.seq++
+	mt.mu.Unlock()
+	mt.report()
+}
+
+// 汇报最新的进度，返回时之前所有的更新都已经汇报过，或者正在由其他 worker 汇报
+func (mt *mergeTracker) report() {
+	if mt.progress == nil {
+		return
 	}
+	for mt.reportMu.TryLock() {
+		for {
+			mt.mu.Lock()
+			if mt.reported == mt.seq {
+				mt.mu.Unlock()
+				break
+			}
+			stat := mt.stat
+			mt.reported = mt.seq
+			mt.mu.Unlock()
+			mt.progress(stat)
+		}
+		mt.reportMu.Unlock()
 
-	if err := mergeDB.Sync(); err != nil {
-		return err
+		// 释放之前其他 worker 更新的进度可能没有被汇报
+		mt.mu.Lock()
+		done := mt.reported == mt.seq
+		mt.mu.Unlock()
+		if done {
+			return
+		}
 	}
+}
 
-	mergeFinishFile, err := data.OpenMergeFinishFile(mergePath)
+// merge 时写入新的数据文件及对应的 hint 文件
+// 依次使用预留的文件 id，预留的 id 用完之后仍然需要新的数据文件时 merge 失败
+type mergeWriter struct {
+	dirPath    string
+	fileSize   int64
+	nextFileId uint32
+	lastFileId uint32
+	dataFile   *data.DataFile
+	hintFile   *data.DataFile
+	limiter    *utils.RateLimiter
+	codec      *data.Codec
+	footer     *data.FooterBuilder // 当前数据文件的 footer
+	written    int64               // 已经写入的字节数
+}
+
+func (mw *mergeWriter) write(ctx context.Context, key []byte, logRecord *data.LogRecord) error {
+	encRecord, size, err := mw.codec.EncodeLogRecord(logRecord)
 	if err != nil {
 		return err
 	}
+	// 空的数据文件中写入超过文件大小的记录时不需要切换
+	if mw.dataFile == nil || (mw.dataFile.WriteOff > 0 && mw.dataFile.WriteOff+size > mw.fileSize) {
+		if mw.nextFileId > mw.lastFileId {
+			return ErrMergeFileIdsExhausted
+		}
+		if err := mw.openNext(); err != nil {
+			return err
+		}
+	}
 
-	mergeFinRecord := &data.LogRecord{
-		Key:   []byte(mergeFinishKey),
-		Value: []byte(strconv.Itoa(int(nonMergeFileId))),
+	writeOff, hintOff := mw.dataFile.WriteOff, mw.hintFile.WriteOff
+	if err := mw.dataFile.Write(encRecord); err != nil {
+		return err
 	}
+	_, _ = mw.footer.Write(encRecord)
+	mw.footer.AddRecord(key, logRecord.Type == data.LogRecordNormal)
+	pos := &data.LogRecordPos{Fid: mw.dataFile.FileId, Offset: writeOff, Size: uint32(size)}
+	if err := mw.hintFile.WriteHint(key, logRecord.Type, pos); err != nil {
+		return err
+	}
+	n := size + mw.hintFile.WriteOff - hintOff
+	mw.written += n
+	return mw.limiter.Wait(ctx, n)
+}
 
-	encRecord, _ := data.EncodeLogRecord(mergeFinRecord)
+func (mw *mergeWriter) openNext() error {
+	if err := mw.finish(); err != nil {
+		return err
+	}
+	mw.close()
 
-	if err := mergeFinishFile.Write(encRecord); err != nil {
+	dataFile, err := data.OpenDataFile(mw.dirPath, mw.nextFileId)
+	if err != nil {
 		return err
 	}
+	hintFile, err := data.OpenHintFile(mw.dirPath, mw.nextFileId)
+	if err != nil {
+		_ = dataFile.Close()
+		return err
+	}
+	dataFile.Codec, hintFile.Codec = mw.codec, mw.codec
+	mw.dataFile, mw.hintFile = dataFile, hintFile
+	mw.footer = &data.FooterBuilder{}
+	mw.nextFileId++
+	return nil
+}
 
-	if err := mergeFinishFile.Sync(); err != nil {
+// 在当前数据文件末尾写入 footer 并持久化
+func (mw *mergeWriter) finish() error {
+	if mw.dataFile == nil {
+		return nil
+	}
+	if err := mw.dataFile.WriteFooter(mw.footer.Footer()); err != nil {
+		return err
+	}
+	if err := mw.dataFile.Sync(); err != nil {
 		return err
 	}
+	return mw.hintFile.Sync()
+}
 
-	return nil
+func (mw *mergeWriter) close() {
+	if mw.dataFile != nil {
+		_ = mw.dataFile.Close()
+		_ = mw.hintFile.Close()
+		mw.dataFile, mw.hintFile = nil, nil
+	}
+}
+
+// SetMergeRate 修改 merge 读写数据的速率，单位为字节每秒，为 0 时不限速
+// 正在进行的 merge 也会使用新的速率
+func (db *DB) SetMergeRate(bytesPerSecond int64) {
+	db.mergeLimiter.SetRate(bytesPerSecond)
 }
 
 func (db *DB) getMergePath() string {
@@ -150,15 +715,69 @@ func (db *DB) getMergePath() string {
 	return filepath.Join(dir, base+mergeDirName)
 }
 
+// 完成旧版本写入了 merge 完成标识但是还没有生效的 merge，只用于还没有 manifest 的数据目录
 func (db *DB) loadMergeFiles() error {
 	mergePath := db.getMergePath()
 	if _, err := os.Stat(mergePath); os.IsNotExist(err) {
-		return err
+		return nil
 	}
 
 	defer func() {
 		_ = os.RemoveAll(mergePath)
 	}()
+	mergeFileNames, mergeFinished := readMergeDir(mergePath)
+	//未完成
+	if !mergeFinished {
+		return nil
+	}
+
+	mergedFileIds, err := db.getMergedFileIds(mergePath)
+	if err != nil {
+		return err
+	}
+
+	// 数据文件被重写之后，快照中的位置信息失效
+	if err := data.RemoveIndexSnapshot(db.options.DirPath); err != nil {
+		return err
+	}
+
+	// 持久化索引中仍然保存着旧数据文件中的位置，需要先更新到新的数据文件
+	if db.persistentIndex {
+		hintFileIds, err := parseFileIds(mergeFileNames, data.HintFileNameSuffix)
+		if err != nil {
+			return err
+		}
+		if err := db.applyMergeHints(mergePath, hintFileIds, mergedFileIds); err != nil {
+			return err
+		}
+	}
+
+	// 删除参与 merge 的旧数据文件，上一次没有处理完时这些文件可能已经被删除了
+	for _, fileId := range mergedFileIds {
+		for _, fileName := range []string{
+			data.GetDataFileName(db.options.DirPath, fileId),
+			data.GetHintFileName(db.options.DirPath, fileId),
+		} {
+			if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	//新的数据文件移动过来
+	for _, fileName := range mergeFileNames {
+		srcPath := path.Join(mergePath, fileName)
+		dstPath := path.Join(db.options.DirPath, fileName)
+
+		if err := os.Rename(srcPath, dstPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 取出 merge 目录中需要移动的数据文件和 hint 文件，以及 merge 是否已经完成
+func readMergeDir(mergePath string) ([]string, bool) {
 	dirEntries, _ := os.ReadDir(mergePath)
 
 	//查找标识 merge
@@ -169,79 +788,287 @@ func (db *DB) loadMergeFiles() error {
 		if entry.Name() == data.MergeFinishFileName {
 			mergeFinished = true
 		}
-		mergeFileNames = append(mergeFileNames, entry.Name())
-	}
-	//未完成
-	if !mergeFinished {
-		return nil
+		// 只需要移动数据文件和 hint 文件
+		if strings.HasSuffix(entry.Name(), data.DataFileNameSuffix) ||
+			strings.HasSuffix(entry.Name(), data.HintFileNameSuffix) {
+			mergeFileNames = append(mergeFileNames, entry.Name())
+		}
 	}
+	return mergeFileNames, mergeFinished
+}
+
+// hint 文件中的一条记录
+type mergeHint struct {
+	key []byte
+	typ data.LogRecordType
+	pos *data.LogRecordPos
+}
 
-	nonMergeFileId, err := db.getNonMergeFileId(mergePath)
+// 根据 merge 生成的 hint 文件更新索引
+// 只更新位置仍然在参与 merge 的旧数据文件中的 key，merge 之后再次写入的 key 保持不变
+// 已经更新过的 key 不会再次更新，中途崩溃之后可以重新执行
+// 在访问此方法前必须持有互斥锁
+func (db *DB) applyMergeHints(dirPath string, hintFileIds []uint32, mergedFileIds []uint32) error {
+	hints, err := db.readMergeHints(dirPath, hintFileIds)
 	if err != nil {
 		return err
 	}
+	return db.applyHints(hints, mergedFileIds)
+}
 
-	//删除旧文件
-	var fileId uint32 = 0
-	for ; fileId < nonMergeFileId; fileId++ {
-		fileName := data.GetDataFileName(mergePath, fileId)
-		if _, err := os.Stat(fileName); err != nil {
-			_ = os.Remove(fileName)
+// 读取 hint 文件中的所有记录，每个 hint 文件对应一组
+func (db *DB) readMergeHints(dirPath string, hintFileIds []uint32) ([][]mergeHint, error) {
+	hints := make([][]mergeHint, len(hintFileIds))
+	for i, fileId := range hintFileIds {
+		_, err := db.loadIndexFromHintFile(dirPath, fileId,
+			func(key []byte, typ data.LogRecordType, pos *data.LogRecordPos) {
+				hints[i] = append(hints[i], mergeHint{key: key, typ: typ, pos: pos})
+			})
+		if err != nil {
+			return nil, err
 		}
-
 	}
+	return hints, nil
+}
 
-	//新的数据文件移动过来
-	for _, fileName := range mergeFileNames {
-		srcPath := path.Join(mergePath, fileName)
-		dstPath := path.Join(db.options.DirPath, fileName)
+// 将读取到的 hint 记录更新到索引中
+// 在访问此方法前必须持有互斥锁
+func (db *DB) applyHints(hints [][]mergeHint, mergedFileIds []uint32) error {
+	merged := make(map[uint32]struct{}, len(mergedFileIds))
+	for _, fileId := range mergedFileIds {
+		merged[fileId] = struct{}{}
+	}
 
-		if err := os.Rename(srcPath, dstPath); err != nil {
+	for _, fileHints := range hints {
+		// 每个 hint 文件的更新在一个事务中完成
+		apply := func(batch index.Batch) error {
+			for _, hint := range fileHints {
+				var applied bool
+				if oldPos := batch.Get(hint.key); oldPos != nil && hint.typ == data.LogRecordNormal {
+					if _, ok := merged[oldPos.Fid]; ok {
+						applied = batch.Put(hint.key, hint.pos)
+					}
+				}
+				// 没有被索引引用的记录都是可以回收的
+				if db.fileStats != nil {
+					if applied {
+						stat := db.fileStat(hint.pos.Fid)
+						stat.liveSize += int64(hint.pos.Size)
+						stat.liveCount++
+					} else {
+						db.fileStat(hint.pos.Fid).deadSize += int64(hint.pos.Size)
+					}
+				}
+			}
+			return nil
+		}
+		if err := db.batchIndex(nil, apply); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (db *DB) getNonMergeFileId(dirPath string) (uint32, error) {
+// 取出参与 merge 的数据文件 id
+func (db *DB) getMergedFileIds(dirPath string) ([]uint32, error) {
 	dataFile, err := data.OpenMergeFinishFile(dirPath)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
+	defer dataFile.Close()
 	logRecord, _, err := dataFile.ReadLogRecord(0)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	nonMergeFileId, err := strconv.Atoi(string(logRecord.Key))
-	if err != nil {
-		return 0, err
+	var fileIds []uint32
+	for _, s := range strings.Split(string(logRecord.Value), ",") {
+		fileId, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, err
+		}
+		fileIds = append(fileIds, uint32(fileId))
 	}
-	return uint32(nonMergeFileId), nil
+	return fileIds, nil
 }
 
-func (db *DB) loadIndexFromHintFile() error {
-	hintFileName := filepath.Join(db.options.DirPath, data.HintFileName)
+// 从 hint 文件中加载数据文件的索引，数据文件没有对应的 hint 文件时返回 false
+func (db *DB) loadIndexFromHintFile(dirPath string, fileId uint32,
+	updateIndex func(key []byte, typ data.LogRecordType, pos *data.LogRecordPos)) (bool, error) {
+	hintFileName := data.GetHintFileName(dirPath, fileId)
 	if _, err := os.Stat(hintFileName); os.IsNotExist(err) {
-		return err
+		return false, nil
 	}
-	hintFile, err := data.OpenHintFile(hintFileName)
+	hintFile, err := data.OpenHintFile(dirPath, fileId)
 	if err != nil {
-		return err
+		return false, err
 	}
+	hintFile.Codec = db.codec
+	defer hintFile.Close()
 
-	var offset int64 = 0
+	reader, err := hintFile.NewReader(0)
+	if err != nil {
+		return false, err
+	}
 	for {
-		logRecord, size, err := hintFile.ReadLogRecord(offset)
+		logRecord, _, err := reader.Next()
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			return err
+			return false, err
 		}
 		pos := data.DecodeLogRecordPos(logRecord.Value)
-		db.index.Put(logRecord.Key, pos)
-		offset += size
+		updateIndex(logRecord.Key, logRecord.Type, pos)
 	}
+	return true, nil
+}
+
+// 取出数据文件的统计信息，不存在时创建
+// 在访问此方法前必须持有互斥锁
+func (db *DB) fileStat(fileId uint32) *fileStat {
+	stat, ok := db.fileStats[fileId]
+	if !ok {
+		stat = &fileStat{}
+		db.fileStats[fileId] = stat
+	}
+	return stat
+}
+
+// 记录新写入的数据和被覆盖的旧数据
+// 在访问此方法前必须持有互斥锁
+func (db *DB) updateFileStats(oldPos *data.LogRecordPos, typ data.LogRecordType, pos *data.LogRecordPos) {
+	if db.fileStats == nil {
+		return
+	}
+	if oldPos != nil {
+		stat := db.fileStat(oldPos.Fid)
+		stat.liveSize -= int64(oldPos.Size)
+		stat.liveCount--
+		stat.deadSize += int64(oldPos.Size)
+	}
+	// 删除标记和事务完成标识不会被索引引用，写入之后就是可以回收的
+	if typ == data.LogRecordNormal {
+		stat := db.fileStat(pos.Fid)
+		stat.liveSize += int64(pos.Size)
+		stat.liveCount++
+	} else {
+		db.fileStat(pos.Fid).deadSize += int64(pos.Size)
+	}
+}
+
+// 根据索引统计每个数据文件中有效数据的大小，数据文件中剩下的部分都是可以回收的
+// 只在第一次需要时统计，之后随着写入更新
+// 在访问此方法前必须持有互斥锁
+func (db *DB) loadFileStats() error {
+	if db.fileStats != nil || db.activeFile == nil {
+		return nil
+	}
+
+	fileStats := make(map[uint32]*fileStat)
+	fileStats[db.activeFile.FileId] = &fileStat{deadSize: db.activeFile.WriteOff}
+	for fileId, file := range db.olderFiles {
+		size, err := file.IoManager.Size()
+		if err != nil {
+			return err
+		}
+		fileStats[fileId] = &fileStat{deadSize: size}
+	}
+
+	iterator := db.index.Iterator(false)
+	defer iterator.Close()
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		pos := iterator.Value()
+		if stat, ok := fileStats[pos.Fid]; ok {
+			stat.liveSize += int64(pos.Size)
+			stat.liveCount++
+			stat.deadSize -= int64(pos.Size)
+		}
+	}
+	db.fileStats = fileStats
 	return nil
 }
+
+// 挑选出无效数据比例达到阈值的数据文件，按照文件 id 排序
+// 在访问此方法前必须持有互斥锁
+func (db *DB) pickMergeFiles() []*data.DataFile {
+	files := make([]*data.DataFile, 0, len(db.olderFiles)+1)
+	for _, file := range db.olderFiles {
+		files = append(files, file)
+	}
+	files = append(files, db.activeFile)
+
+	var mergeFiles []*data.DataFile
+	for _, file := range files {
+		stat := db.fileStats[file.FileId]
+		if stat == nil || stat.liveSize+stat.deadSize == 0 {
+			continue
+		}
+		ratio := float32(stat.deadSize) / float32(stat.liveSize+stat.deadSize)
+		if ratio >= db.options.MergeFileGarbageRatio {
+			mergeFiles = append(mergeFiles, file)
+		}
+	}
+
+	sort.Slice(mergeFiles, func(i, j int) bool {
+		return mergeFiles[i].FileId < mergeFiles[j].FileId
+	})
+	return mergeFiles
+}
+
+// 统计当前可以回收的空间和数据文件的总大小
+func (db *DB) reclaimableSize() (int64, int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.loadFileStats(); err != nil {
+		return 0, 0, err
+	}
+	var reclaimSize, totalSize int64
+	for _, stat := range db.fileStats {
+		reclaimSize += stat.deadSize
+		totalSize += stat.liveSize + stat.deadSize
+	}
+	return reclaimSize, totalSize, nil
+}
+
+// 判断是否需要自动 merge
+func (db *DB) shouldMerge() (bool, error) {
+	reclaimSize, totalSize, err := db.reclaimableSize()
+	if err != nil || totalSize == 0 {
+		return false, err
+	}
+	if reclaimSize < db.options.MergeMinReclaimSize {
+		return false, nil
+	}
+	return float32(reclaimSize)/float32(totalSize) >= db.options.MergeRatio, nil
+}
+
+// 定期检查无效数据的比例，超过阈值时自动 merge
+func (db *DB) runAutoMergeTask(interval time.Duration) {
+	defer db.bgWait.Done()
+
+	// 关闭数据库时取消正在进行的 merge
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-db.closeCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if ok, err := db.shouldMerge(); err == nil && ok {
+				_ = db.MergeContext(ctx, nil)
+			}
+		case <-db.closeCh:
+			return
+		}
+	}
+}
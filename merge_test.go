@@ -0,0 +1,895 @@
+package KV
+
+import (
+	"KV/data"
+	"KV/utils"
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 模拟进程崩溃，不写入索引快照和 seq-no 文件，被 merge 替换的旧数据文件也不会删除
+func crashDB(db *DB) {
+	db.closeOnce.Do(func() {
+		close(db.closeCh)
+	})
+	db.bgWait.Wait()
+	_ = db.index.Close()
+	db.closeDataFiles()
+	for _, retired := range db.retiredFiles {
+		_ = retired.file.Close()
+	}
+}
+
+func TestDB_MergeDeletedKeysNeverResurrect(t *testing.T) {
+	seed := time.Now().UnixNano()
+	t.Logf("seed: %d", seed)
+	rnd := rand.New(rand.NewSource(seed))
+
+	for _, typ := range []IndexerType{BTree, BPTree} {
+		opts := DefaultOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go-merge")
+		opts.DirPath = dir
+		opts.DataFileSize = 16 * 1024
+		opts.IndexType = typ
+
+		db, err := Open(opts)
+		assert.Nil(t, err)
+
+		expected := make(map[string][]byte)
+		put := func(key []byte) {
+			value := utils.RandomValue(rnd.Intn(128) + 1)
+			assert.Nil(t, db.Put(key, value))
+			expected[string(key)] = value
+		}
+		del := func(key []byte) {
+			assert.Nil(t, db.Delete(key))
+			delete(expected, string(key))
+		}
+
+		// 很少修改的冷数据，所在的数据文件无效数据较少，通常不参与 merge
+		for i := 0; i < 1000; i++ {
+			put(utils.GetTestKey(i))
+		}
+		for round := 0; round < 20; round++ {
+			for i := 0; i < 150; i++ {
+				switch n := rnd.Intn(20); {
+				case n < 3:
+					del(utils.GetTestKey(rnd.Intn(1000)))
+				case n < 4:
+					put(utils.GetTestKey(rnd.Intn(1000)))
+				case n < 6:
+					del(utils.GetTestKey(1000 + rnd.Intn(50)))
+				default:
+					put(utils.GetTestKey(1000 + rnd.Intn(50)))
+				}
+			}
+
+			// 迭代器会让被替换的旧数据文件保留下来，崩溃之后这些文件不能被重放
+			var iter *Iterator
+			if typ != BPTree && rnd.Intn(2) == 0 {
+				iter = db.NewIterator(DefaultIteratorOptions)
+			}
+			db.options.MergeFileGarbageRatio = rnd.Float32()
+			assert.Nil(t, db.Merge())
+
+			switch rnd.Intn(3) {
+			case 0:
+				crashDB(db)
+				db, err = Open(opts)
+				assert.Nil(t, err)
+			case 1:
+				if iter != nil {
+					iter.Close()
+				}
+				assert.Nil(t, db.Close())
+				db, err = Open(opts)
+				assert.Nil(t, err)
+			default:
+				if iter != nil {
+					iter.Close()
+				}
+			}
+
+			assert.Equal(t, len(expected), len(db.ListKeys()), "round %d", round)
+			for key, value := range expected {
+				val, err := db.Get([]byte(key))
+				assert.Nil(t, err)
+				assert.Equal(t, value, val)
+			}
+		}
+
+		assert.Nil(t, db.Close())
+		_ = os.RemoveAll(dir)
+		_ = os.RemoveAll(db.getMergePath())
+	}
+}
+
+func TestDB_OpenRemovesUnlistedFiles(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-manifest")
+	opts.DirPath = dir
+	opts.DataFileSize = 16 * 1024
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i%100), utils.GetTestKey(i)))
+	}
+	activeFileId := db.activeFile.FileId
+	assert.Nil(t, db.Close())
+
+	// 模拟 merge 生成的文件已经移动过来，但是 manifest 还没有重写时崩溃，文件中是旧的数据
+	buf, err := os.ReadFile(data.GetDataFileName(dir, 0))
+	assert.Nil(t, err)
+	for _, fileName := range []string{
+		data.GetDataFileName(dir, activeFileId+1),
+		data.GetHintFileName(dir, 0),
+	} {
+		assert.Nil(t, os.WriteFile(fileName, buf, 0644))
+	}
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	defer db.Close()
+	for _, fileName := range []string{
+		data.GetDataFileName(dir, activeFileId+1),
+		data.GetHintFileName(dir, 0),
+	} {
+		_, err := os.Stat(fileName)
+		assert.True(t, os.IsNotExist(err))
+	}
+	assert.Equal(t, activeFileId, db.activeFile.FileId)
+	for i := 900; i < 1000; i++ {
+		val, err := db.Get(utils.GetTestKey(i % 100))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+}
+
+func TestDB_BlobGC(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-blob")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.BlobThreshold = 256
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	values := make(map[int][]byte)
+	for r := 0; r < 2; r++ {
+		for i := 0; i < 200; i++ {
+			values[i] = utils.RandomValue(1024)
+			assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+		}
+	}
+	assert.Nil(t, db.Put(utils.GetTestKey(200), []byte("small")))
+	blobFiles, _ := filepath.Glob(filepath.Join(dir, "*"+data.BlobFileNameSuffix))
+	assert.Greater(t, len(blobFiles), 1)
+
+	// 第一轮写入的 value 都已经无效，对应的 blob 文件会被删除
+	assert.Nil(t, db.BlobGC())
+	remaining, _ := filepath.Glob(filepath.Join(dir, "*"+data.BlobFileNameSuffix))
+	assert.Less(t, len(remaining), len(blobFiles))
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	defer db.Close()
+	for i, value := range values {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+	val, err := db.Get(utils.GetTestKey(200))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("small"), val)
+}
+
+func TestDB_AutoBlobGC(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-auto-blob-gc")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.BlobThreshold = 256
+	opts.BlobGCInterval = 10 * time.Millisecond
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	values := make(map[int][]byte)
+	for r := 0; r < 2; r++ {
+		for i := 0; i < 200; i++ {
+			values[i] = utils.RandomValue(1024)
+			assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+		}
+	}
+
+	// 两轮写入的 value 一共需要 7 个 blob 文件，第一轮写入的 value 所在的 blob 文件在后台被回收
+	blobFileCount := func() int {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+		return len(db.manifest.BlobFileIds)
+	}
+	assert.Eventually(t, func() bool {
+		return blobFileCount() <= 5
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, db.Close())
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	defer db.Close()
+	for i, value := range values {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+}
+
+func TestDB_MergeRangeTombstone(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-range")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.MergeFileGarbageRatio = 0.5
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	// 0 号文件中大部分数据仍然有效，不参与 merge
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), []byte("old")))
+	}
+	for i := 0; db.activeFile.FileId == 0; i++ {
+		assert.Nil(t, db.Put([]byte(fmt.Sprintf("live-%d", i)), utils.RandomValue(1024)))
+	}
+	// 1 号文件中写入范围删除标记，其余都是无效数据，参与 merge
+	for i := 0; db.activeFile.FileId == 1; i++ {
+		if i == 30 {
+			assert.Nil(t, db.DeletePrefix([]byte("bitcask-go-key")))
+		}
+		assert.Nil(t, db.Put([]byte("garbage"), utils.RandomValue(1024)))
+	}
+	// 2 号文件中重新写入被删除的 key
+	assert.Nil(t, db.Put(utils.GetTestKey(7), []byte("new")))
+	for i := 0; db.activeFile.FileId == 2; i++ {
+		assert.Nil(t, db.Put([]byte(fmt.Sprintf("live-2-%d", i)), utils.RandomValue(1024)))
+	}
+	assert.Nil(t, db.Merge())
+	assert.Contains(t, db.manifest.DataFileIds, uint32(0))
+	assert.NotContains(t, db.manifest.DataFileIds, uint32(1))
+
+	// merge 之后的删除标记排在 2 号文件之后重放，只删除在它之前写入的数据
+	crashDB(db)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	defer db.Close()
+	for i := 0; i < 50; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		if i == 7 {
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("new"), val)
+			continue
+		}
+		assert.Equal(t, ErrKeyNotFound, err)
+	}
+}
+
+func TestDB_DataFileFooter(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-footer")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(256)))
+	}
+	// 等待后台任务为所有旧的数据文件写入 footer
+	sealed := func() bool {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+		for fileId := range db.olderFiles {
+			if db.footers[fileId] == nil {
+				return false
+			}
+		}
+		return len(db.olderFiles) > 0
+	}
+	for i := 0; i < 100 && !sealed(); i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.True(t, sealed())
+	assert.Nil(t, db.VerifyDataFiles())
+	// 写入 footer 时不更新 manifest，下一次切换数据文件时列出
+	db.mu.RLock()
+	listed := len(db.manifest.FooterFileIds)
+	olderFiles := len(db.olderFiles)
+	db.mu.RUnlock()
+	assert.True(t, listed < olderFiles)
+	for i := 0; db.activeFile.FileId == db.manifest.ActiveFileId && len(db.olderFiles) == olderFiles; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(256)))
+	}
+	db.mu.RLock()
+	assert.Equal(t, olderFiles, len(db.manifest.FooterFileIds))
+	db.mu.RUnlock()
+
+	// merge 生成的数据文件直接写入 footer
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+	db.mu.RLock()
+	assert.NotEmpty(t, db.manifest.HintFileIds)
+	for _, fileId := range db.manifest.HintFileIds {
+		assert.NotNil(t, db.footers[fileId])
+	}
+	db.mu.RUnlock()
+	for i := 0; i < 100 && !sealed(); i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.True(t, sealed())
+	assert.Nil(t, db.VerifyDataFiles())
+	assert.Nil(t, db.Close())
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for i := 500; i < 1000; i++ {
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, db.Close())
+
+	// 旧的数据文件被截断
+	manifest, err := data.ReadManifest(dir)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, manifest.FooterFileIds)
+	fileName := data.GetDataFileName(dir, manifest.FooterFileIds[0])
+	stat, err := os.Stat(fileName)
+	assert.Nil(t, err)
+	assert.Nil(t, os.Truncate(fileName, stat.Size()-1))
+	_, err = Open(opts)
+	assert.Equal(t, ErrDataDirectoryCorrupted, err)
+}
+
+func TestDB_DataFileFooterChecksumMismatch(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-footer-checksum")
+	opts.DirPath = dir
+	opts.DataFileSize = 16 * 1024
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	sealed := func() bool {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+		return db.footers[0] != nil
+	}
+	for i := 0; i < 100 && !sealed(); i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.True(t, sealed())
+	assert.Nil(t, db.Close())
+
+	manifest, err := data.ReadManifest(dir)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, manifest.FooterFileIds)
+	fileId := manifest.FooterFileIds[0]
+
+	// 1.重新写入校验值错误的 footer，记录本身都是完整的
+	dataFile, err := data.OpenDataFile(dir, fileId)
+	assert.Nil(t, err)
+	footer, err := dataFile.ReadFooter()
+	assert.Nil(t, err)
+	reader, err := dataFile.NewReader(0)
+	assert.Nil(t, err)
+	var offset int64
+	for {
+		_, size, err := reader.Next()
+		if err != nil {
+			break
+		}
+		offset += size
+	}
+	assert.Nil(t, dataFile.Close())
+	fileName := data.GetDataFileName(dir, fileId)
+	assert.Nil(t, os.Truncate(fileName, offset))
+	dataFile, err = data.OpenDataFile(dir, fileId)
+	assert.Nil(t, err)
+	footer.Checksum ^= 1
+	assert.Nil(t, dataFile.WriteFooter(footer))
+	assert.Nil(t, dataFile.Close())
+
+	// 启动时扫描整个文件，之后不再信任这个 footer
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	cached, ok := db.footers[fileId]
+	assert.True(t, ok)
+	assert.Nil(t, cached)
+	for i := 0; i < 500; i++ {
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, data.ErrInvalidFooter, db.VerifyDataFiles())
+	assert.Nil(t, db.Close())
+
+	// 2.文件中的记录被破坏时启动失败
+	f, err := os.OpenFile(fileName, os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, 200)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+	_, err = Open(opts)
+	assert.Equal(t, ErrDataDirectoryCorrupted, err)
+}
+
+func TestDB_AutoMerge(t *testing.T) {
+	for _, minReclaimSize := range []int64{1, 1024 * 1024 * 1024} {
+		opts := DefaultOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go-auto-merge")
+		opts.DirPath = dir
+		opts.DataFileSize = 16 * 1024
+		opts.MergeRatio = 0.3
+		opts.MergeCheckInterval = 10 * time.Millisecond
+		opts.MergeMinReclaimSize = minReclaimSize
+
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		// 第一轮写入的数据全部被覆盖，无效数据的比例约为一半
+		for r := 0; r < 2; r++ {
+			for i := 0; i < 500; i++ {
+				assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+			}
+		}
+
+		merged := func() bool {
+			db.mu.RLock()
+			defer db.mu.RUnlock()
+			return db.fileEpoch > 0
+		}
+		if minReclaimSize == 1 {
+			assert.Eventually(t, merged, 5*time.Second, 10*time.Millisecond)
+		} else {
+			// 可以回收的数据没有达到最小值时不会 merge
+			ok, err := db.shouldMerge()
+			assert.Nil(t, err)
+			assert.False(t, ok)
+			time.Sleep(100 * time.Millisecond)
+			assert.False(t, merged())
+		}
+		for i := 0; i < 500; i++ {
+			_, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+		}
+		assert.Nil(t, db.Close())
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func TestDB_MergeRateChangedDuringMerge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-rate")
+	opts.DirPath = dir
+	opts.DataFileSize = 16 * 1024
+	opts.MergeBytesPerSecond = 1024
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer db.Close()
+	for r := 0; r < 2; r++ {
+		for i := 0; i < 500; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+		}
+	}
+
+	// 按照 1KB/s 需要一分钟以上，取消限速之后正在进行的 merge 立即加速
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		db.SetMergeRate(0)
+	}()
+	start := time.Now()
+	assert.Nil(t, db.Merge())
+	elapsed := time.Since(start)
+	assert.GreaterOrEqual(t, elapsed, 150*time.Millisecond)
+	assert.Less(t, elapsed, 10*time.Second)
+
+	for i := 0; i < 500; i++ {
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+}
+
+func TestDB_MergeProgress(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-progress")
+	opts.DirPath = dir
+	opts.DataFileSize = 16 * 1024
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer db.Close()
+	for r := 0; r < 2; r++ {
+		for i := 0; i < 500; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+		}
+	}
+
+	// 回调在锁外执行，回调中可以访问数据库，进度单调递增
+	var progresses []MergeProgress
+	err = db.MergeContext(context.Background(), func(progress MergeProgress) {
+		_, err := db.Get(utils.GetTestKey(0))
+		assert.Nil(t, err)
+		progresses = append(progresses, progress)
+	})
+	assert.Nil(t, err)
+	assert.NotEmpty(t, progresses)
+	for i := 1; i < len(progresses); i++ {
+		assert.GreaterOrEqual(t, progresses[i].FilesProcessed, progresses[i-1].FilesProcessed)
+		assert.GreaterOrEqual(t, progresses[i].BytesRead, progresses[i-1].BytesRead)
+		assert.GreaterOrEqual(t, progresses[i].RecordsCopied, progresses[i-1].RecordsCopied)
+	}
+	last := progresses[len(progresses)-1]
+	assert.True(t, last.TotalFiles > 0)
+	assert.Equal(t, last.TotalFiles, last.FilesProcessed)
+}
+
+func TestDB_MergeCanceled(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-cancel")
+	opts.DirPath = dir
+	opts.DataFileSize = 16 * 1024
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer db.Close()
+	values := make(map[string][]byte)
+	for r := 0; r < 2; r++ {
+		for i := 0; i < 500; i++ {
+			value := utils.RandomValue(64)
+			assert.Nil(t, db.Put(utils.GetTestKey(i), value))
+			values[string(utils.GetTestKey(i))] = value
+		}
+	}
+
+	// 第一次汇报进度时取消，merge 不会生效，merge 目录被删除
+	ctx, cancel := context.WithCancel(context.Background())
+	err = db.MergeContext(ctx, func(MergeProgress) {
+		cancel()
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, uint64(0), db.fileEpoch)
+	_, err = os.Stat(db.getMergePath())
+	assert.True(t, os.IsNotExist(err))
+
+	for key, value := range values {
+		val, err := db.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+	// 取消之后可以再次 merge
+	assert.Nil(t, db.Merge())
+}
+
+func TestDB_MergeKeepsFilesForOpenIterator(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-iterator")
+	opts.DirPath = dir
+	opts.DataFileSize = 16 * 1024
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer db.Close()
+	for r := 0; r < 2; r++ {
+		for i := 0; i < 500; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(r*1000+i)))
+		}
+	}
+
+	// merge 之前创建的迭代器引用的数据文件在迭代器关闭之前不会被删除
+	iterator := db.NewIterator(DefaultIteratorOptions)
+	assert.Nil(t, db.Merge())
+	assert.True(t, len(db.retiredFiles) > 0)
+	var retiredFileNames []string
+	for fileId := range db.retiredFiles {
+		retiredFileNames = append(retiredFileNames, data.GetDataFileName(dir, fileId))
+	}
+	for _, fileName := range retiredFileNames {
+		_, err := os.Stat(fileName)
+		assert.Nil(t, err)
+	}
+
+	var count int
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		value, err := iterator.Value()
+		assert.Nil(t, err)
+		expected, err := db.Get(iterator.Key())
+		assert.Nil(t, err)
+		assert.Equal(t, expected, value)
+		count++
+	}
+	assert.Equal(t, 500, count)
+
+	iterator.Close()
+	assert.Equal(t, 0, len(db.retiredFiles))
+	for _, fileName := range retiredFileNames {
+		_, err := os.Stat(fileName)
+		assert.True(t, os.IsNotExist(err))
+	}
+}
+
+func TestDB_MergeInstallRollback(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-rollback")
+	opts.DirPath = dir
+	opts.DataFileSize = 16 * 1024
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for r := 0; r < 2; r++ {
+		for i := 0; i < 500; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(r*1000+i)))
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+
+	// merge 文件写完之后让 manifest 无法写入，移动过来的文件被删除，仍然使用原来的数据文件
+	blocker := filepath.Join(dir, data.ManifestFileName+".tmp")
+	err = db.MergeContext(context.Background(), func(progress MergeProgress) {
+		if progress.FilesProcessed == progress.TotalFiles {
+			_ = os.MkdirAll(blocker, os.ModePerm)
+		}
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, uint64(0), db.fileEpoch)
+	_, err = os.Stat(db.getMergePath())
+	assert.True(t, os.IsNotExist(err))
+	for _, entry := range entries {
+		_, err := os.Stat(filepath.Join(dir, entry.Name()))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 500; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(1000+i), val)
+	}
+
+	// 之后可以继续写入和 merge
+	assert.Nil(t, os.Remove(blocker))
+	assert.Nil(t, db.Put(utils.GetTestKey(0), utils.GetTestKey(0)))
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	defer db.Close()
+	for i := 0; i < 500; i++ {
+		expected := utils.GetTestKey(1000 + i)
+		if i == 0 {
+			expected = utils.GetTestKey(0)
+		}
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, expected, val)
+	}
+}
+
+func TestDB_MergeNoEnoughSpace(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-space")
+	opts.DirPath = dir
+	opts.DataFileSize = 16 * 1024
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer db.Close()
+	// 覆盖四分之三的 key，旧数据文件中仍然有有效数据
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	for i := 0; i < 500; i++ {
+		if i%4 != 0 {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(1000+i)))
+		}
+	}
+
+	db.mu.Lock()
+	assert.Nil(t, db.loadFileStats())
+	var liveSize int64
+	for _, file := range db.pickMergeFiles() {
+		liveSize += db.fileStats[file.FileId].liveSize
+	}
+	db.mu.Unlock()
+	assert.True(t, liveSize > 0)
+
+	// 可用空间只够写入有效数据，不够写入 hint 文件和 footer
+	defer func(fn func(string) (uint64, error)) {
+		availableDiskSize = fn
+	}(availableDiskSize)
+	availableDiskSize = func(string) (uint64, error) {
+		return uint64(liveSize) + 1, nil
+	}
+	assert.Equal(t, ErrNoEnoughSpaceForMerge, db.Merge())
+	assert.False(t, db.isMerging)
+	assert.Equal(t, uint64(0), db.fileEpoch)
+	_, err = os.Stat(db.getMergePath())
+	assert.True(t, os.IsNotExist(err))
+
+	availableDiskSize = func(string) (uint64, error) {
+		return 1 << 40, nil
+	}
+	assert.Nil(t, db.Merge())
+	for i := 0; i < 500; i++ {
+		expected := utils.GetTestKey(1000 + i)
+		if i%4 == 0 {
+			expected = utils.GetTestKey(i)
+		}
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, expected, val)
+	}
+}
+
+func TestDB_MergeWorkers(t *testing.T) {
+	for _, typ := range []IndexerType{BTree, BPTree} {
+		opts := DefaultOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go-merge-workers")
+		opts.DirPath = dir
+		opts.DataFileSize = 16 * 1024
+		opts.IndexType = typ
+		opts.MergeWorkers = 4
+
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		// 每个数据文件中都留下一部分有效数据，多个 worker 同时写入各自预留的 id
+		values := make(map[string][]byte)
+		for r := 0; r < 3; r++ {
+			for i := 0; i < 2000; i++ {
+				if r > 0 && i%3 == 0 {
+					continue
+				}
+				value := utils.RandomValue(64)
+				assert.Nil(t, db.Put(utils.GetTestKey(i), value))
+				values[string(utils.GetTestKey(i))] = value
+			}
+		}
+		assert.Nil(t, db.Merge())
+
+		// 新数据文件除了 footer 之外不超过 DataFileSize
+		first, boundary := db.manifest.MergeFirstFileId, db.manifest.MergeBoundary
+		assert.True(t, first > 0 && first < boundary)
+		maxFooterSize := db.codec.MaxFooterSize(int64(len(utils.GetTestKey(0))))
+		var outputs int
+		for fileId, dataFile := range db.olderFiles {
+			if fileId < first || fileId >= boundary {
+				continue
+			}
+			outputs++
+			size, err := dataFile.IoManager.Size()
+			assert.Nil(t, err)
+			assert.LessOrEqual(t, size, opts.DataFileSize+maxFooterSize)
+		}
+		assert.True(t, outputs > 1)
+		assert.Nil(t, db.Close())
+
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		for key, value := range values {
+			val, err := db.Get([]byte(key))
+			assert.Nil(t, err)
+			assert.Equal(t, value, val)
+		}
+		assert.Nil(t, db.Close())
+		_ = os.RemoveAll(dir)
+	}
+}
+
+// 没有参与 merge 的旧数据文件的 footer 中 key 的范围不包含被删除的 key 时，不需要保留删除标记
+func TestDB_MergeDropsTombstonesByFooterRange(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-footer-range")
+	opts.DirPath = dir
+	opts.DataFileSize = 4 * 1024
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(append([]byte("a-"), utils.GetTestKey(i)...), utils.RandomValue(64)))
+	}
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(append([]byte("b-"), utils.GetTestKey(i)...), utils.RandomValue(64)))
+	}
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Delete(append([]byte("b-"), utils.GetTestKey(i)...)))
+	}
+	// 等待后台任务为所有旧的数据文件写入 footer
+	sealed := func() bool {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+		for fileId := range db.olderFiles {
+			if db.footers[fileId] == nil {
+				return false
+			}
+		}
+		return true
+	}
+	for i := 0; i < 100 && !sealed(); i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.True(t, sealed())
+
+	assert.Nil(t, db.Merge())
+	db.mu.RLock()
+	hintFileIds := db.manifest.HintFileIds
+	assert.NotEmpty(t, hintFileIds)
+	for _, fileId := range hintFileIds {
+		reader, err := db.olderFiles[fileId].NewReader(0)
+		assert.Nil(t, err)
+		for {
+			logRecord, _, err := reader.Next()
+			if err != nil {
+				break
+			}
+			assert.NotEqual(t, data.LogRecordDeleted, logRecord.Type)
+		}
+	}
+	db.mu.RUnlock()
+	crashDB(db)
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	defer db.Close()
+	for i := 0; i < 100; i++ {
+		_, err := db.Get(append([]byte("a-"), utils.GetTestKey(i)...))
+		assert.Nil(t, err)
+		_, err = db.Get(append([]byte("b-"), utils.GetTestKey(i)...))
+		assert.Equal(t, ErrKeyNotFound, err)
+	}
+}
@@ -1,6 +1,10 @@
 package KV
 
-import "os"
+import (
+	"KV/data"
+	"os"
+	"time"
+)
 
 type Options struct {
 	// 数据库数据目录
@@ -12,8 +16,68 @@ type Options struct {
 	// 每次写数据是否持久化
 	SyncWrites bool
 
-	// 索引类型
+	// 索引类型，可以通过 index.RegisterIndexer 注册自定义的索引类型
 	IndexType IndexerType
+
+	// 自定义索引的额外参数
+	IndexParams map[string]string
+
+	// 定期写入内存索引快照的间隔，为 0 时只在关闭数据库时写入
+	IndexSnapshotInterval time.Duration
+
+	// 无效数据占数据文件总大小的比例达到该值时自动 merge，为 0 时不自动 merge
+	MergeRatio float32
+
+	// 检查是否需要自动 merge 的时间间隔
+	MergeCheckInterval time.Duration
+
+	// 可以回收的空间小于该值时不进行自动 merge
+	MergeMinReclaimSize int64
+
+	// 数据文件中无效数据的比例达到该值时才参与 merge，为 0 时所有的旧数据文件都参与 merge
+	MergeFileGarbageRatio float32
+
+	// merge 读写数据的速率，单位为字节每秒，为 0 时不限速
+	MergeBytesPerSecond int64
+
+	// 同时处理数据文件的 merge worker 数量，每个 worker 处理一组连续的数据文件
+	MergeWorkers int
+
+	// value 的压缩算法，为 nil 时不压缩，可以使用内置的 data.FlateCompressor 或者自定义的算法
+	// 修改之后已经写入的记录仍然可以读取，但是使用自定义算法压缩的记录需要继续配置该算法
+	Compression data.Compressor
+
+	// value 的长度达到该值时才压缩
+	CompressionThreshold int
+
+	// 加密使用的密钥，不为 nil 时数据文件、hint 文件和索引快照中的 value 都使用 AES-GCM 加密
+	// 可以使用 data.KeyRing 或者自定义的实现，轮换密钥之后旧的密钥仍然需要用于读取之前写入的记录
+	Encryption data.KeyProvider
+
+	// 是否同时加密 key，持久化索引会以明文保存 key，不能同时使用
+	EncryptKeys bool
+
+	// value 的长度超过该值时写入单独的 blob 文件，数据文件中只保存 blob 文件中的位置，为 0 时不使用 blob 文件
+	// merge 数据文件时不会重写 blob 文件中的 value，blob 文件通过 BlobGC 单独回收
+	BlobThreshold int
+
+	// blob 文件中无效数据的比例达到该值时才会被 BlobGC 回收
+	BlobGCRatio float32
+
+	// 后台定期执行 BlobGC 的时间间隔，只回收无效数据的比例达到 BlobGCRatio 的 blob 文件，为 0 时不自动回收
+	BlobGCInterval time.Duration
+
+	// 生成记录写入时间的时钟，为 nil 时使用 time.Now
+	Clock func() time.Time
+
+	// key 的最大长度，超过时写入返回 ErrKeyTooLarge，为 0 时不限制
+	MaxKeySize int
+
+	// value 的最大长度，超过时写入返回 ErrValueTooLarge，不能超过 DataFileSize，为 0 时使用 DataFileSize
+	MaxValueSize int
+
+	// 活跃文件末尾的记录没有写完整时是否截断，为 false 时启动返回 data.ErrInvalidRecordSize
+	RepairTruncatedTail bool
 }
 
 // IteratorOptions 索引迭代器配置项
@@ -42,6 +106,9 @@ const (
 	// ART Adpative Radix Tree 自适应基数树索引
 	ART
 	BPTree
+
+	// Compact 内存紧凑索引，key 数量非常大时使用
+	Compact
 )
 
 var DefaultOptions = Options{
@@ -49,6 +116,25 @@ var DefaultOptions = Options{
 	DataFileSize: 256 * 1024 * 1024, // 256MB
 	SyncWrites:   false,
 	IndexType:    BTree,
+
+	IndexSnapshotInterval: 0,
+	MergeRatio:            0,
+	MergeCheckInterval:    time.Minute,
+	MergeMinReclaimSize:   64 * 1024 * 1024, // 64MB
+	MergeFileGarbageRatio: 0.5,
+	MergeBytesPerSecond:   0,
+	MergeWorkers:          4,
+	Compression:           nil,
+	CompressionThreshold:  512,
+	Encryption:            nil,
+	EncryptKeys:           false,
+	BlobThreshold:         0,
+	BlobGCRatio:           0.5,
+	BlobGCInterval:        0,
+	Clock:                 time.Now,
+	MaxKeySize:            0,
+	MaxValueSize:          0,
+	RepairTruncatedTail:   false,
 }
 
 var DefaultIteratorOptions = IteratorOptions{
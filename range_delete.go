@@ -0,0 +1,182 @@
+package KV
+
+import (
+	"KV/data"
+	"KV/index"
+	"bytes"
+	"encoding/binary"
+)
+
+// 范围删除只写入一条删除标记，重放时删除索引中范围内的所有 key
+// merge 之后删除标记可能被移动到更新的数据文件中，value 中会保存它最初写入的位置，
+// 重放时只删除在这个位置之前写入的数据，不会删除之后重新写入的 key
+
+// DeleteRange 删除 [start, end) 范围内的所有 key，end 为空时删除 start 之后的所有 key
+func (db *DB) DeleteRange(start, end []byte) error {
+	if len(end) > 0 && bytes.Compare(start, end) >= 0 {
+		return ErrInvalidKeyRange
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// 范围内没有 key 时不需要写入删除标记
+	keys := db.rangeKeys(start, end, nil)
+	if len(keys) == 0 {
+		return nil
+	}
+
+	// 需要同时删除二级索引记录时，和删除标记一起通过事务写入
+	var indexRecords []*data.LogRecord
+	for _, key := range keys {
+		records, err := db.secondaryIndexRecords(key, nil, data.LogRecordDeleted)
+		if err != nil {
+			return err
+		}
+		indexRecords = append(indexRecords, records...)
+	}
+	indexRecords = append(indexRecords, db.staleIndexDefRecords()...)
+	if len(indexRecords) > 0 {
+		records := append([]*data.LogRecord{{
+			Key:   start,
+			Value: encodeRangeTombstone(end, nil),
+			Type:  data.LogRecordRangeDeleted,
+		}}, indexRecords...)
+		return db.writeTransaction(records, db.options.SyncWrites)
+	}
+
+	logRecord := &data.LogRecord{
+		Key:   logRecordKeyWithSeqNo(start, nonTransactionSeqNo),
+		Value: encodeRangeTombstone(end, nil),
+		Type:  data.LogRecordRangeDeleted,
+	}
+	pos, err := db.appendLogRecord(logRecord)
+	if err != nil {
+		return err
+	}
+	return db.batchIndex(pos, func(batch index.Batch) error {
+		db.applyRangeTombstone(batch, keys, pos)
+		return nil
+	})
+}
+
+// DeletePrefix 删除以 prefix 为前缀的所有 key
+func (db *DB) DeletePrefix(prefix []byte) error {
+	if len(prefix) == 0 {
+		return ErrKeyIsEmpty
+	}
+	return db.DeleteRange(prefix, prefixEnd(prefix))
+}
+
+// 以 prefix 为前缀的 key 的上界，prefix 全部为 0xff 时没有上界，返回 nil
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// 找出索引中 [start, end) 范围内的 key，origin 不为空时只包含在它之前写入的 key
+// 在访问此方法前必须持有互斥锁
+func (db *DB) rangeKeys(start, end []byte, origin *data.LogRecordPos) [][]byte {
+	iterator := db.index.Iterator(false)
+	defer iterator.Close()
+
+	var keys [][]byte
+	for iterator.Seek(start); iterator.Valid(); iterator.Next() {
+		key := iterator.Key()
+		if len(end) > 0 && bytes.Compare(key, end) >= 0 {
+			break
+		}
+		if isInternalKey(key) {
+			continue
+		}
+		if origin != nil {
+			pos := iterator.Value()
+			if pos.Fid > origin.Fid || pos.Fid == origin.Fid && pos.Offset >= origin.Offset {
+				continue
+			}
+		}
+		keys = append(keys, append([]byte(nil), key...))
+	}
+	return keys
+}
+
+// 从索引中删除范围内的 key，pos 为删除标记的位置
+// 在访问此方法前必须持有互斥锁
+func (db *DB) applyRangeTombstone(batch index.Batch, keys [][]byte, pos *data.LogRecordPos) {
+	for _, key := range keys {
+		// 被删除的数据都是可以回收的
+		if oldPos := batch.Get(key); oldPos != nil && db.fileStats != nil {
+			stat := db.fileStat(oldPos.Fid)
+			stat.liveSize -= int64(oldPos.Size)
+			stat.liveCount--
+			stat.deadSize += int64(oldPos.Size)
+		}
+		batch.Delete(key)
+	}
+	// 删除标记本身也是可以回收的
+	db.updateFileStats(nil, data.LogRecordRangeDeleted, pos)
+}
+
+// 重放范围删除标记，hint 文件中没有范围的终点，需要从数据文件中读取
+// 在访问此方法前必须持有互斥锁
+func (db *DB) replayRangeTombstone(pos *data.LogRecordPos) error {
+	dataFile := db.dataFileById(pos.Fid)
+	if dataFile == nil {
+		return ErrDataFileNotFound
+	}
+	logRecord, _, err := dataFile.ReadLogRecord(pos.Offset)
+	if err != nil {
+		return err
+	}
+	start, _ := parseLogRecordKey(logRecord.Key)
+	end, origin, ok := decodeRangeTombstone(logRecord.Value)
+	if !ok {
+		return ErrDataDirectoryCorrupted
+	}
+	if origin == nil {
+		origin = pos
+	}
+	keys := db.rangeKeys(start, end, origin)
+	return db.batchIndex(nil, func(batch index.Batch) error {
+		db.applyRangeTombstone(batch, keys, pos)
+		return nil
+	})
+}
+
+// 对范围删除标记的 value 进行编码
+//
+//	+-------------+-------------+--------------------+
+//	|  end 长度    |     end     |   最初写入的位置     |
+//	+-------------+-------------+--------------------+
+//	 变长（最大5）      变长         变长，merge 之后才有
+func encodeRangeTombstone(end []byte, origin *data.LogRecordPos) []byte {
+	buf := make([]byte, binary.MaxVarintLen32+len(end))
+	n := binary.PutUvarint(buf, uint64(len(end)))
+	n += copy(buf[n:], end)
+	if origin != nil {
+		return append(buf[:n], data.EncodeLogRecordPos(origin)...)
+	}
+	return buf[:n]
+}
+
+func decodeRangeTombstone(value []byte) ([]byte, *data.LogRecordPos, bool) {
+	endSize, n := binary.Uvarint(value)
+	if n <= 0 || uint64(len(value)-n) < endSize {
+		return nil, nil, false
+	}
+	var end []byte
+	if endSize > 0 {
+		end = value[n : n+int(endSize)]
+	}
+	var origin *data.LogRecordPos
+	if rest := value[n+int(endSize):]; len(rest) > 0 {
+		origin = data.DecodeLogRecordPos(rest)
+	}
+	return end, origin, true
+}
@@ -0,0 +1,374 @@
+package KV
+
+import (
+	"KV/data"
+	"KV/index"
+	"bytes"
+	"encoding/binary"
+)
+
+// 二级索引的每一条记录都以内部 key 的形式和数据存放在同一个索引中
+// key 的格式为：前缀 + 索引名长度 + 索引名 + 索引 key 长度 + 索引 key + 主键
+// 这样二级索引可以和数据一起通过事务写入、merge、hint 文件以及持久化索引保存下来
+var secondaryIndexPrefix = []byte("\x00kv-sidx\x00")
+
+// 已经建立完成的二级索引会写入一条定义记录，key 为前缀 + 0 + 索引名，重新打开之后注册同名索引时不需要重建
+// 索引名不为空，长度的编码不会是 0，不会和索引记录冲突
+// 打开之后没有注册的索引在第一次写入时删除定义记录，下次注册时重新校正
+var indexDefPrefix = append(append([]byte(nil), secondaryIndexPrefix...), 0)
+
+// 注册索引时每次持有锁处理的 key 数量
+const registerIndexBatchNum = 1000
+
+// IndexFunc 从 value 中提取零个或多个二级索引 key
+type IndexFunc func(value []byte) [][]byte
+
+// RegisterIndex 注册二级索引，之后的 Put、Delete 和 WriteBatch 会同步维护这个索引
+// 注册时会根据当前数据校正已有的索引记录，补齐缺失的、删除多余的，之前已经建立完成的索引不会重新校正
+// 同一个索引名对应的 fn 需要保持不变，提取规则变化时应该使用新的索引名
+func (db *DB) RegisterIndex(name string, fn IndexFunc) error {
+	if len(name) == 0 {
+		return ErrIndexNameIsEmpty
+	}
+
+	// 注册之后写入的数据会同步维护索引，校正时只需要处理注册之前的数据
+	db.mu.Lock()
+	if db.secondaryIndexes == nil {
+		db.secondaryIndexes = make(map[string]IndexFunc)
+	}
+	db.secondaryIndexes[name] = fn
+	_, built := db.indexDefs[name]
+	db.mu.Unlock()
+	if built {
+		return nil
+	}
+
+	// 不持有锁扫描索引，每一批 key 在持有锁时按照当前的数据校正
+	keys := db.scanIndexKeys(nil, func(key []byte) bool { return !isInternalKey(key) })
+	for i := 0; i < len(keys); i += registerIndexBatchNum {
+		batch := keys[i:min(i+registerIndexBatchNum, len(keys))]
+		if err := db.addIndexRecords(name, fn, batch); err != nil {
+			return err
+		}
+	}
+
+	namePrefix := secondaryIndexNamePrefix(name)
+	entries := db.scanIndexKeys(namePrefix, func([]byte) bool { return true })
+	for i := 0; i < len(entries); i += registerIndexBatchNum {
+		batch := entries[i:min(i+registerIndexBatchNum, len(entries))]
+		if err := db.removeIndexRecords(name, fn, batch); err != nil {
+			return err
+		}
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.indexDefs[name]; ok {
+		return nil
+	}
+	records := []*data.LogRecord{{Key: indexDefKey(name), Type: data.LogRecordNormal}}
+	return db.writeTransaction(records, db.options.SyncWrites)
+}
+
+// 扫描索引中以 prefix 开头并且满足 filter 的 key
+// 迭代器关闭之后才会写入数据，持久化索引的读事务不能和写事务同时存在
+func (db *DB) scanIndexKeys(prefix []byte, filter func(key []byte) bool) [][]byte {
+	db.mu.RLock()
+	iterator := db.index.Iterator(false)
+	db.mu.RUnlock()
+	defer iterator.Close()
+
+	var keys [][]byte
+	if len(prefix) == 0 {
+		iterator.Rewind()
+	} else {
+		iterator.Seek(prefix)
+	}
+	for ; iterator.Valid() && bytes.HasPrefix(iterator.Key(), prefix); iterator.Next() {
+		if filter(iterator.Key()) {
+			keys = append(keys, append([]byte(nil), iterator.Key()...))
+		}
+	}
+	return keys
+}
+
+// 为一批 key 补齐缺失的索引记录
+func (db *DB) addIndexRecords(name string, fn IndexFunc, keys [][]byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var records []*data.LogRecord
+	for _, key := range keys {
+		pos := db.index.Get(key)
+		if pos == nil {
+			continue
+		}
+		value, err := db.getValueByPosition(pos)
+		if err == ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, indexKey := range extractIndexKeys(fn, value) {
+			entry := secondaryIndexKey(name, indexKey, key)
+			if db.index.Get(entry) == nil {
+				records = append(records, &data.LogRecord{Key: entry, Type: data.LogRecordNormal})
+			}
+		}
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	return db.writeTransaction(records, db.options.SyncWrites)
+}
+
+// 删除一批索引记录中和当前数据不一致的
+func (db *DB) removeIndexRecords(name string, fn IndexFunc, entries [][]byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	namePrefix := secondaryIndexNamePrefix(name)
+	var records []*data.LogRecord
+	for _, entry := range entries {
+		if db.index.Get(entry) == nil {
+			continue
+		}
+		indexKey, key, ok := parseSecondaryIndexKey(entry[len(namePrefix):])
+		valid := false
+		if ok {
+			if pos := db.index.Get(key); pos != nil {
+				value, err := db.getValueByPosition(pos)
+				if err != nil && err != ErrKeyNotFound {
+					return err
+				}
+				if err == nil {
+					for _, k := range extractIndexKeys(fn, value) {
+						if bytes.Equal(k, indexKey) {
+							valid = true
+							break
+						}
+					}
+				}
+			}
+		}
+		if !valid {
+			records = append(records, &data.LogRecord{Key: entry, Type: data.LogRecordDeleted})
+		}
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	return db.writeTransaction(records, db.options.SyncWrites)
+}
+
+// 启动时加载已经建立完成的二级索引
+func (db *DB) loadIndexDefs() {
+	db.indexDefs = make(map[string]struct{})
+	for _, key := range db.scanIndexKeys(indexDefPrefix, func([]byte) bool { return true }) {
+		db.indexDefs[string(key[len(indexDefPrefix):])] = struct{}{}
+	}
+}
+
+// 打开之后没有注册的索引不会被维护，写入数据时需要删除它的定义记录
+// 在访问此方法前必须持有互斥锁
+func (db *DB) staleIndexDefRecords() []*data.LogRecord {
+	var records []*data.LogRecord
+	for name := range db.indexDefs {
+		if _, ok := db.secondaryIndexes[name]; !ok {
+			records = append(records, &data.LogRecord{Key: indexDefKey(name), Type: data.LogRecordDeleted})
+		}
+	}
+	return records
+}
+
+// 事务中的定义记录生效之后同步更新内存中的索引定义
+// 在访问此方法前必须持有互斥锁
+func (db *DB) updateIndexDefs(records []*data.LogRecord) {
+	for _, record := range records {
+		if !bytes.HasPrefix(record.Key, indexDefPrefix) {
+			continue
+		}
+		name := string(record.Key[len(indexDefPrefix):])
+		if record.Type == data.LogRecordNormal {
+			db.indexDefs[name] = struct{}{}
+		} else {
+			delete(db.indexDefs, name)
+		}
+	}
+}
+
+// QueryIndex 根据二级索引查找数据，返回的迭代器依次给出主键及对应的 value，使用完之后需要关闭
+func (db *DB) QueryIndex(name string, indexKey []byte) *IndexIterator {
+	prefix := secondaryIndexKey(name, indexKey, nil)
+
+	db.mu.Lock()
+	indexIter := &IndexIterator{
+		indexIter: db.index.Iterator(false),
+		db:        db,
+		prefix:    prefix,
+		epoch:     db.fileEpoch,
+	}
+	db.readers[db.fileEpoch]++
+	db.mu.Unlock()
+
+	indexIter.Rewind()
+	return indexIter
+}
+
+// IndexIterator 二级索引迭代器
+type IndexIterator struct {
+	indexIter index.Iterator
+	db        *DB
+	prefix    []byte
+	epoch     uint64 // 创建时的 epoch，关闭之前 merge 替换掉的数据文件不会被删除
+	closed    bool
+}
+
+func (ii *IndexIterator) Rewind() {
+	ii.indexIter.Seek(ii.prefix)
+}
+
+func (ii *IndexIterator) Valid() bool {
+	return ii.indexIter.Valid() && bytes.HasPrefix(ii.indexIter.Key(), ii.prefix)
+}
+
+func (ii *IndexIterator) Next() {
+	ii.indexIter.Next()
+}
+
+// Key 当前记录的主键
+func (ii *IndexIterator) Key() []byte {
+	return ii.indexIter.Key()[len(ii.prefix):]
+}
+
+// Value 当前记录的 value
+func (ii *IndexIterator) Value() ([]byte, error) {
+	return ii.db.Get(ii.Key())
+}
+
+func (ii *IndexIterator) Close() {
+	ii.indexIter.Close()
+
+	ii.db.mu.Lock()
+	defer ii.db.mu.Unlock()
+	if ii.closed {
+		return
+	}
+	ii.closed = true
+	if ii.db.readers[ii.epoch]--; ii.db.readers[ii.epoch] <= 0 {
+		delete(ii.db.readers, ii.epoch)
+	}
+	_ = ii.db.releaseRetiredFiles()
+}
+
+// 计算写入或者删除 key 时二级索引需要做的变更
+// 在访问此方法前必须持有互斥锁
+func (db *DB) secondaryIndexRecords(key []byte, value []byte, typ data.LogRecordType) ([]*data.LogRecord, error) {
+	if len(db.secondaryIndexes) == 0 {
+		return nil, nil
+	}
+
+	// 取出旧的 value，用来计算需要删除的索引记录
+	var oldValue []byte
+	var exists bool
+	if pos := db.index.Get(key); pos != nil {
+		v, err := db.getValueByPosition(pos)
+		if err != nil && err != ErrKeyNotFound {
+			return nil, err
+		}
+		oldValue, exists = v, err == nil
+	}
+
+	var records []*data.LogRecord
+	for name, fn := range db.secondaryIndexes {
+		newKeys := make(map[string]struct{})
+		if typ == data.LogRecordNormal {
+			for _, indexKey := range extractIndexKeys(fn, value) {
+				newKeys[string(indexKey)] = struct{}{}
+			}
+		}
+		if exists {
+			for _, indexKey := range extractIndexKeys(fn, oldValue) {
+				if _, ok := newKeys[string(indexKey)]; ok {
+					delete(newKeys, string(indexKey))
+					continue
+				}
+				records = append(records, &data.LogRecord{
+					Key:  secondaryIndexKey(name, indexKey, key),
+					Type: data.LogRecordDeleted,
+				})
+			}
+		}
+		for indexKey := range newKeys {
+			records = append(records, &data.LogRecord{
+				Key:  secondaryIndexKey(name, []byte(indexKey), key),
+				Type: data.LogRecordNormal,
+			})
+		}
+	}
+	return records, nil
+}
+
+// 提取索引 key 并去重
+func extractIndexKeys(fn IndexFunc, value []byte) [][]byte {
+	indexKeys := fn(value)
+	seen := make(map[string]struct{}, len(indexKeys))
+	result := indexKeys[:0:0]
+	for _, indexKey := range indexKeys {
+		if _, ok := seen[string(indexKey)]; ok {
+			continue
+		}
+		seen[string(indexKey)] = struct{}{}
+		result = append(result, indexKey)
+	}
+	return result
+}
+
+func secondaryIndexNamePrefix(name string) []byte {
+	buf := make([]byte, len(secondaryIndexPrefix)+binary.MaxVarintLen64+len(name))
+	var idx = copy(buf, secondaryIndexPrefix)
+	idx += binary.PutUvarint(buf[idx:], uint64(len(name)))
+	idx += copy(buf[idx:], name)
+	return buf[:idx]
+}
+
+// 索引定义记录的 key
+func indexDefKey(name string) []byte {
+	return append(append([]byte(nil), indexDefPrefix...), name...)
+}
+
+// 从去掉索引名前缀的索引记录中解析出索引 key 和主键
+func parseSecondaryIndexKey(buf []byte) ([]byte, []byte, bool) {
+	size, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) < size {
+		return nil, nil, false
+	}
+	return buf[n : n+int(size)], buf[n+int(size):], true
+}
+
+func secondaryIndexKey(name string, indexKey []byte, key []byte) []byte {
+	namePrefix := secondaryIndexNamePrefix(name)
+	buf := make([]byte, len(namePrefix)+binary.MaxVarintLen64+len(indexKey)+len(key))
+	var idx = copy(buf, namePrefix)
+	idx += binary.PutUvarint(buf[idx:], uint64(len(indexKey)))
+	idx += copy(buf[idx:], indexKey)
+	idx += copy(buf[idx:], key)
+	return buf[:idx]
+}
+
+// 判断是否为内部使用的 key，内部 key 不对用户可见
+func isInternalKey(key []byte) bool {
+	return bytes.HasPrefix(key, secondaryIndexPrefix)
+}
+
+// 校验用户写入的 key
+func checkUserKey(key []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	if isInternalKey(key) {
+		return ErrKeyIsReserved
+	}
+	return nil
+}
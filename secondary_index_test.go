@@ -0,0 +1,128 @@
+package KV
+
+import (
+	"KV/utils"
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"sort"
+	"testing"
+)
+
+// value 的格式为 city:name，按照 city 建立索引
+func cityIndex(calls *int) IndexFunc {
+	return func(value []byte) [][]byte {
+		*calls++
+		if idx := bytes.IndexByte(value, ':'); idx > 0 {
+			return [][]byte{value[:idx]}
+		}
+		return nil
+	}
+}
+
+func queryIndexKeys(t *testing.T, db *DB, name string, indexKey string) []string {
+	iterator := db.QueryIndex(name, []byte(indexKey))
+	defer iterator.Close()
+
+	var keys []string
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		_, err := iterator.Value()
+		assert.Nil(t, err)
+		keys = append(keys, string(iterator.Key()))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestDB_SecondaryIndex(t *testing.T) {
+	for _, typ := range []IndexerType{BTree, BPTree} {
+		opts := DefaultOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go-sidx")
+		opts.DirPath = dir
+		opts.IndexType = typ
+
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		assert.Equal(t, ErrIndexNameIsEmpty, db.RegisterIndex("", cityIndex(new(int))))
+
+		// 1.注册之前写入的数据在注册时建立索引
+		assert.Nil(t, db.Put([]byte("u1"), []byte("beijing:a")))
+		assert.Nil(t, db.Put([]byte("u2"), []byte("shanghai:b")))
+		var calls int
+		assert.Nil(t, db.RegisterIndex("city", cityIndex(&calls)))
+		assert.Equal(t, []string{"u1"}, queryIndexKeys(t, db, "city", "beijing"))
+
+		// 2.注册之后的写入、更新和删除同步维护索引
+		assert.Nil(t, db.Put([]byte("u3"), []byte("beijing:c")))
+		assert.Nil(t, db.Put([]byte("u2"), []byte("beijing:b")))
+		assert.Equal(t, []string{"u1", "u2", "u3"}, queryIndexKeys(t, db, "city", "beijing"))
+		assert.Nil(t, queryIndexKeys(t, db, "city", "shanghai"))
+
+		assert.Nil(t, db.Delete([]byte("u1")))
+		wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+		assert.Nil(t, wb.Put([]byte("u4"), []byte("shanghai:d")))
+		assert.Nil(t, wb.Delete([]byte("u3")))
+		assert.Nil(t, wb.Commit())
+		assert.Equal(t, []string{"u2"}, queryIndexKeys(t, db, "city", "beijing"))
+		assert.Equal(t, []string{"u4"}, queryIndexKeys(t, db, "city", "shanghai"))
+
+		// 索引记录对用户不可见
+		assert.Equal(t, 2, len(db.ListKeys()))
+		assert.Nil(t, db.Close())
+
+		// 3.重新打开之后注册同名索引不需要重建
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		calls = 0
+		assert.Nil(t, db.RegisterIndex("city", cityIndex(&calls)))
+		assert.Equal(t, 0, calls)
+		assert.Equal(t, []string{"u2"}, queryIndexKeys(t, db, "city", "beijing"))
+		assert.Nil(t, db.Close())
+
+		// 4.没有注册索引时写入的数据，再次注册时重新校正
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		assert.Nil(t, db.Put([]byte("u2"), []byte("shanghai:b")))
+		assert.Nil(t, db.Put([]byte("u5"), []byte("beijing:e")))
+		assert.Nil(t, db.Close())
+
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		calls = 0
+		assert.Nil(t, db.RegisterIndex("city", cityIndex(&calls)))
+		assert.True(t, calls > 0)
+		assert.Equal(t, []string{"u5"}, queryIndexKeys(t, db, "city", "beijing"))
+		assert.Equal(t, []string{"u2", "u4"}, queryIndexKeys(t, db, "city", "shanghai"))
+		assert.Nil(t, db.Close())
+
+		_ = os.RemoveAll(dir)
+	}
+}
+
+// 注册索引时分批持有锁，超过一批的数据也能够完整建立索引
+func TestDB_RegisterIndexInBatches(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-sidx-batch")
+	opts.DirPath = dir
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	num := registerIndexBatchNum*2 + 10
+	for i := 0; i < num; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), []byte("beijing:x")))
+	}
+	assert.Nil(t, db.RegisterIndex("city", cityIndex(new(int))))
+	assert.Equal(t, num, len(queryIndexKeys(t, db, "city", "beijing")))
+
+	// 查询期间持有的 epoch 在关闭之后释放
+	iterator := db.QueryIndex("city", []byte("beijing"))
+	assert.Equal(t, 1, db.readers[db.fileEpoch])
+	iterator.Close()
+	iterator.Close()
+	assert.Equal(t, 0, len(db.readers))
+}
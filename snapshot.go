@@ -0,0 +1,132 @@
+package KV
+
+import (
+	"KV/data"
+	"KV/index"
+	"time"
+)
+
+// 内存索引快照，关闭数据库时写入，重启时直接加载，只需要重放快照之后写入的数据
+
+// 取出当前的索引及其覆盖到的数据位置
+// 在访问此方法前必须持有互斥锁
+func (db *DB) indexSnapshot() (index.Iterator, *data.LogRecordPos, uint64) {
+	if db.activeFile == nil {
+		return nil, nil, 0
+	}
+	mark := &data.LogRecordPos{Fid: db.activeFile.FileId, Offset: db.activeFile.WriteOff}
+	return db.index.Iterator(false), mark, db.seqNo
+}
+
+// 将索引写入快照文件
+func (db *DB) writeIndexSnapshot(iterator index.Iterator, mark *data.LogRecordPos, seqNo uint64) error {
+	defer iterator.Close()
+
+	writer, err := data.NewIndexSnapshotWriter(db.options.DirPath, db.codec)
+	if err != nil {
+		return err
+	}
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		if err := writer.Write(iterator.Key(), iterator.Value()); err != nil {
+			writer.Abort()
+			return err
+		}
+	}
+	if err := writer.Commit(mark, seqNo); err != nil {
+		writer.Abort()
+		return err
+	}
+	return nil
+}
+
+// SaveIndexSnapshot 将内存索引写入快照文件，持久化索引不需要快照
+func (db *DB) SaveIndexSnapshot() error {
+	if db.persistentIndex {
+		return nil
+	}
+
+	db.snapshotMu.Lock()
+	defer db.snapshotMu.Unlock()
+
+	db.mu.Lock()
+	if db.failed {
+		db.mu.Unlock()
+		return ErrDatabaseFailed
+	}
+	iterator, mark, seqNo := db.indexSnapshot()
+	db.mu.Unlock()
+	if iterator == nil {
+		return nil
+	}
+	return db.writeIndexSnapshot(iterator, mark, seqNo)
+}
+
+// 从快照文件中加载索引，并重放快照之后写入的数据
+// 快照不存在或者不可用时返回 false，需要从 hint 和数据文件中加载
+func (db *DB) loadIndexFromSnapshot() (bool, error) {
+	if len(db.fileIds) == 0 {
+		return false, nil
+	}
+
+	meta, err := data.LoadIndexSnapshot(db.options.DirPath, db.codec, func(key []byte, pos *data.LogRecordPos) {
+		db.index.Put(key, pos)
+	})
+	if err == nil && meta != nil && !db.isValidSnapshotMark(meta.Mark) {
+		err = data.ErrInvalidIndexSnapshot
+	}
+	if err == data.ErrInvalidIndexSnapshot {
+		// 快照损坏，丢弃已经加载的部分索引
+		if err := db.index.Close(); err != nil {
+			return false, err
+		}
+		indexer, err := index.NewIndexer(db.options.IndexType, indexConfig(db.options))
+		if err != nil {
+			return false, err
+		}
+		db.index = indexer
+		return false, data.RemoveIndexSnapshot(db.options.DirPath)
+	}
+	if err != nil || meta == nil {
+		return false, err
+	}
+
+	db.seqNo = meta.SeqNo
+	if _, err := db.replayDataFiles(meta.Mark); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// 快照覆盖到的数据必须仍然存在，否则说明数据文件被截断或者丢失了
+func (db *DB) isValidSnapshotMark(mark *data.LogRecordPos) bool {
+	var dataFile *data.DataFile
+	if db.activeFile.FileId == mark.Fid {
+		dataFile = db.activeFile
+	} else {
+		dataFile = db.olderFiles[mark.Fid]
+	}
+	if dataFile == nil {
+		return false
+	}
+	size, err := dataFile.IoManager.Size()
+	if err != nil {
+		return false
+	}
+	return mark.Offset <= size
+}
+
+// 定期写入索引快照，缩短崩溃之后的重启时间
+func (db *DB) runIndexSnapshotTask(interval time.Duration) {
+	defer db.bgWait.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			_ = db.SaveIndexSnapshot()
+		case <-db.closeCh:
+			return
+		}
+	}
+}
@@ -0,0 +1,525 @@
+package KV
+
+import (
+	"KV/data"
+	"KV/index"
+	"KV/utils"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// 离线转换数据目录中记录的编码格式，既可以升级也可以降级
+// 按照重放的顺序读取每条记录，使用目标格式重新编码写入新的目录，数据文件和 blob 文件的 id 保持不变
+// 记录的位置会发生变化，hint 文件、seq-no 文件以及记录中保存的 blob 位置、范围删除的起始位置都需要重新生成
+// 新旧目录中有效的 key 和 value 完全相同时才替换原来的目录，索引快照和持久化索引在下次启动时重新构建
+
+const upgradeDirName = "-upgrade"
+
+// UpgradeFormat 将已经关闭的数据库目录中的记录转换为 version 指定的格式
+// options 中的压缩和加密配置同时用于读取原来的记录以及写入新的记录，转换期间不能打开数据库
+// 转换为旧格式时不保存写入时间，blob 文件中的 value 写回数据文件，使用了加密或者范围删除的数据库不能转换为旧格式，返回 data.ErrFormatUnsupported
+func UpgradeFormat(options Options, version data.FormatVersion) error {
+	if err := checkOptions(options); err != nil {
+		return err
+	}
+	if version != data.FormatV1 && version != data.FormatV2 {
+		return data.ErrUnknownFormatVersion
+	}
+	if version == data.FormatV1 && options.Encryption != nil {
+		return data.ErrFormatUnsupported
+	}
+
+	src, err := openOffline(options)
+	if err != nil {
+		return err
+	}
+	if src.activeFile == nil {
+		src.closeDataFiles()
+		return nil
+	}
+	// 写入新的目录之前确认所有的记录都能够转换为旧格式，不能转换时原来的目录保持不变
+	if version == data.FormatV1 {
+		if err := checkFormatV1(src); err != nil {
+			src.closeDataFiles()
+			return err
+		}
+	}
+
+	dir := path.Dir(path.Clean(options.DirPath))
+	upgradePath := filepath.Join(dir, path.Base(options.DirPath)+upgradeDirName)
+	writer := &upgradeWriter{
+		src:     src,
+		dirPath: upgradePath,
+		version: version,
+		blobPos: make(map[uint32]map[int64]*data.LogRecordPos),
+		offsets: make(map[uint32]*fileOffsets),
+	}
+	err = writer.writeFiles()
+	if err == nil {
+		err = verifyUpgrade(src, options, upgradePath)
+	}
+	src.closeDataFiles()
+	if err != nil {
+		_ = os.RemoveAll(upgradePath)
+		return err
+	}
+	return replaceDir(options.DirPath, upgradePath)
+}
+
+// 加载数据目录并在内存中重建索引，不会修改数据目录以及 merge 目录中的文件
+// 启动时才会丢弃或者完成没有生效的 merge，存在 merge 目录时返回 ErrUpgradeMergePending
+// 索引在内存中重建，不需要根据 MergedFileIds 更新持久化索引，转换之后的 manifest 中也不再保留
+func openOffline(options Options) (*DB, error) {
+	if _, err := os.Stat(options.DirPath); err != nil {
+		return nil, err
+	}
+	indexer, err := index.NewIndexer(BTree, indexConfig(options))
+	if err != nil {
+		return nil, err
+	}
+	db := &DB{
+		options:          options,
+		mu:               new(sync.RWMutex),
+		olderFiles:       make(map[uint32]*data.DataFile),
+		index:            indexer,
+		readers:          make(map[uint64]int),
+		retiredFiles:     make(map[uint32]*retiredFile),
+		blobFiles:        make(map[uint32]*data.DataFile),
+		retiredBlobFiles: make(map[uint32]*retiredFile),
+		footers:          make(map[uint32]*data.Footer),
+		codec:            newCodec(options),
+		offline:          true,
+	}
+	if _, err := os.Stat(db.getMergePath()); err == nil {
+		return nil, ErrUpgradeMergePending
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	manifest, err := data.ReadManifest(options.DirPath)
+	if err != nil {
+		return nil, err
+	}
+	if manifest != nil {
+		db.manifest = manifest
+		err = db.openManifestFiles()
+	} else {
+		err = db.loadDataFiles()
+	}
+	if err == nil {
+		err = db.loadIndexFromDataFiles()
+	}
+	if err != nil {
+		db.closeDataFiles()
+		return nil, err
+	}
+	return db, nil
+}
+
+// 检查数据文件中的记录是否都能够转换为旧格式
+// 旧格式不支持范围删除，blob 中的 value 写回数据文件，仍然有效的记录引用的 blob 文件必须存在
+func checkFormatV1(src *DB) error {
+	for _, fid := range src.fileIds {
+		fileId := uint32(fid)
+		reader, err := src.dataFileById(fileId).NewReader(0)
+		if err != nil {
+			return err
+		}
+		var offset int64 = 0
+		for {
+			logRecord, size, err := reader.Next()
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				if err == data.ErrInvalidRecordSize && fileId == src.activeFile.FileId && src.options.RepairTruncatedTail {
+					break
+				}
+				return err
+			}
+			switch {
+			case logRecord.Type == data.LogRecordRangeDeleted:
+				return data.ErrFormatUnsupported
+			case logRecord.Blob:
+				realKey, _ := parseLogRecordKey(logRecord.Key)
+				pos := src.index.Get(realKey)
+				live := pos != nil && pos.Fid == fileId && pos.Offset == offset
+				if live && src.blobFileById(data.DecodeLogRecordPos(logRecord.Value).Fid) == nil {
+					return ErrDataFileNotFound
+				}
+			}
+			offset += size
+		}
+	}
+	return nil
+}
+
+// 转换格式时写入新的目录，并记录位置的变化
+type upgradeWriter struct {
+	src     *DB
+	dirPath string
+	version data.FormatVersion
+	blobPos map[uint32]map[int64]*data.LogRecordPos // 旧的 blob 记录位置对应的新位置
+	offsets map[uint32]*fileOffsets                 // 已经转换的数据文件中记录的新旧位置
+}
+
+// 数据文件中每条记录转换前后的 offset，按照旧的 offset 从小到大排列
+type fileOffsets struct {
+	old  []int64
+	new  []int64
+	size int64 // 转换之后的文件大小
+}
+
+func (uw *upgradeWriter) encode(logRecord *data.LogRecord) ([]byte, int64, error) {
+	return uw.src.codec.EncodeLogRecordFormat(logRecord, uw.version)
+}
+
+// 写入 blob 文件、数据文件、hint 文件、seq-no 文件以及 manifest
+func (uw *upgradeWriter) writeFiles() error {
+	if err := os.RemoveAll(uw.dirPath); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(uw.dirPath, os.ModePerm); err != nil {
+		return err
+	}
+
+	// 旧格式没有 blob 文件，value 在转换数据文件时写回
+	manifest := uw.src.manifest
+	if manifest != nil && uw.version != data.FormatV1 {
+		for _, fileId := range manifest.BlobFileIds {
+			if err := uw.writeBlobFile(fileId); err != nil {
+				return err
+			}
+		}
+	}
+
+	var olderFileIds, hintFileIds []uint32
+	hinted := make(map[uint32]bool)
+	if manifest != nil {
+		for _, fileId := range manifest.HintFileIds {
+			hinted[fileId] = true
+		}
+	}
+	for _, fid := range uw.src.fileIds {
+		fileId := uint32(fid)
+		if manifest == nil {
+			if _, err := os.Stat(data.GetHintFileName(uw.src.options.DirPath, fileId)); err == nil {
+				hinted[fileId] = true
+			}
+		}
+		if err := uw.writeDataFile(fileId, hinted[fileId]); err != nil {
+			return err
+		}
+		if fileId != uw.src.activeFile.FileId {
+			olderFileIds = append(olderFileIds, fileId)
+		}
+		if hinted[fileId] {
+			hintFileIds = append(hintFileIds, fileId)
+		}
+	}
+
+	if err := uw.writeSeqNo(); err != nil {
+		return err
+	}
+	// 旧格式的数据目录中没有 manifest，启动时根据目录中的文件生成
+	if uw.version != data.FormatV1 {
+		newManifest := &data.Manifest{
+			ActiveFileId: uw.src.activeFile.FileId,
+			DataFileIds:  olderFileIds,
+			HintFileIds:  hintFileIds,
+		}
+		if manifest != nil {
+			newManifest.MergeBoundary = manifest.MergeBoundary
+			newManifest.MergeFirstFileId = manifest.MergeFirstFileId
+			newManifest.BlobFileIds = manifest.BlobFileIds
+		}
+		if err := data.WriteManifest(uw.dirPath, newManifest); err != nil {
+			return err
+		}
+	}
+	return data.SyncDir(uw.dirPath)
+}
+
+// 转换 blob 文件，记录每条 blob 记录的新位置
+func (uw *upgradeWriter) writeBlobFile(fileId uint32) error {
+	srcFile := uw.src.blobFileById(fileId)
+	if srcFile == nil {
+		return ErrDataFileNotFound
+	}
+	reader, err := srcFile.NewReader(0)
+	if err != nil {
+		return err
+	}
+	blobFile, err := data.OpenBlobFile(uw.dirPath, fileId)
+	if err != nil {
+		return err
+	}
+	defer blobFile.Close()
+
+	positions := make(map[int64]*data.LogRecordPos)
+	var offset int64 = 0
+	for {
+		logRecord, size, err := reader.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		encRecord, newSize, err := uw.encode(logRecord)
+		if err != nil {
+			return err
+		}
+		positions[offset] = &data.LogRecordPos{Fid: fileId, Offset: blobFile.WriteOff, Size: uint32(newSize)}
+		if err := blobFile.Write(encRecord); err != nil {
+			return err
+		}
+		offset += size
+	}
+	uw.blobPos[fileId] = positions
+	return blobFile.Sync()
+}
+
+// 转换数据文件，hinted 为 true 时同时生成 hint 文件
+// footer 不会被复制，启动之后重新写入
+func (uw *upgradeWriter) writeDataFile(fileId uint32, hinted bool) error {
+	reader, err := uw.src.dataFileById(fileId).NewReader(0)
+	if err != nil {
+		return err
+	}
+	dataFile, err := data.OpenDataFile(uw.dirPath, fileId)
+	if err != nil {
+		return err
+	}
+	defer dataFile.Close()
+	var hintFile *data.DataFile
+	if hinted {
+		if hintFile, err = data.OpenHintFile(uw.dirPath, fileId); err != nil {
+			return err
+		}
+		defer hintFile.Close()
+	}
+
+	offsets := &fileOffsets{}
+	uw.offsets[fileId] = offsets
+	var offset int64 = 0
+	for {
+		logRecord, size, err := reader.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			// 活跃文件末尾没有写完整的记录不需要转换
+			if err == data.ErrInvalidRecordSize && fileId == uw.src.activeFile.FileId && uw.src.options.RepairTruncatedTail {
+				break
+			}
+			return err
+		}
+		oldOffset := offset
+		offset += size
+		keep, err := uw.convertRecord(logRecord)
+		if err != nil {
+			return err
+		}
+		if !keep {
+			continue
+		}
+
+		encRecord, newSize, err := uw.encode(logRecord)
+		if err != nil {
+			return err
+		}
+		pos := &data.LogRecordPos{Fid: fileId, Offset: dataFile.WriteOff, Size: uint32(newSize)}
+		if err := dataFile.Write(encRecord); err != nil {
+			return err
+		}
+		offsets.old = append(offsets.old, oldOffset)
+		offsets.new = append(offsets.new, pos.Offset)
+
+		// hint 记录和 merge 时写入的相同
+		if hintFile != nil {
+			realKey, _ := parseLogRecordKey(logRecord.Key)
+			encHint, _, err := uw.encode(&data.LogRecord{
+				Key:   realKey,
+				Value: data.EncodeLogRecordPos(pos),
+				Type:  logRecord.Type,
+			})
+			if err != nil {
+				return err
+			}
+			if err := hintFile.Write(encHint); err != nil {
+				return err
+			}
+		}
+	}
+	offsets.size = dataFile.WriteOff
+
+	if hintFile != nil {
+		if err := hintFile.Sync(); err != nil {
+			return err
+		}
+	}
+	return dataFile.Sync()
+}
+
+// 更新记录中保存的位置，返回 false 时记录已经无效，不需要写入
+func (uw *upgradeWriter) convertRecord(logRecord *data.LogRecord) (bool, error) {
+	switch {
+	case logRecord.Blob:
+		blobPos := data.DecodeLogRecordPos(logRecord.Value)
+		if uw.version == data.FormatV1 {
+			// blob 文件已经被回收，说明引用它的记录已经无效
+			value, err := uw.src.readBlobValue(blobPos)
+			if err == ErrDataFileNotFound {
+				return false, nil
+			}
+			if err != nil {
+				return false, err
+			}
+			logRecord.Value, logRecord.Blob = value, false
+			return true, nil
+		}
+		// blob 文件已经被回收时保留原来的位置，记录同样是无效的
+		if newPos, ok := uw.blobPos[blobPos.Fid][blobPos.Offset]; ok {
+			logRecord.Value = data.EncodeLogRecordPos(newPos)
+		}
+	case logRecord.Type == data.LogRecordRangeDeleted:
+		end, origin, ok := decodeRangeTombstone(logRecord.Value)
+		if !ok {
+			return false, ErrDataDirectoryCorrupted
+		}
+		if origin != nil {
+			newOrigin, err := uw.convertPos(origin)
+			if err != nil {
+				return false, err
+			}
+			logRecord.Value = encodeRangeTombstone(end, newOrigin)
+		}
+	}
+	return true, nil
+}
+
+// 将旧数据文件中的位置转换为新数据文件中的位置，保持和其他记录位置的先后顺序
+func (uw *upgradeWriter) convertPos(pos *data.LogRecordPos) (*data.LogRecordPos, error) {
+	offsets, ok := uw.offsets[pos.Fid]
+	if !ok {
+		// 数据文件已经被 merge 删除，其中不会再有记录，位置不需要转换
+		if uw.src.dataFileById(pos.Fid) == nil {
+			return pos, nil
+		}
+		return nil, ErrDataDirectoryCorrupted
+	}
+	i := sort.Search(len(offsets.old), func(i int) bool {
+		return offsets.old[i] >= pos.Offset
+	})
+	newOffset := offsets.size
+	if i < len(offsets.old) {
+		newOffset = offsets.new[i]
+	}
+	return &data.LogRecordPos{Fid: pos.Fid, Offset: newOffset}, nil
+}
+
+// 生成 seq-no 文件，事务序列号取 seq-no 文件和数据文件中最大的值
+func (uw *upgradeWriter) writeSeqNo() error {
+	seqNo, _, err := readSeqNoFile(uw.src.options.DirPath)
+	if err != nil {
+		return err
+	}
+	seqNo = max(seqNo, uw.src.seqNo)
+
+	// seq-no 文件不会加密
+	var codec *data.Codec
+	encRecord, _, err := codec.EncodeLogRecordFormat(&data.LogRecord{
+		Key:   []byte(seqkey),
+		Value: []byte(strconv.FormatUint(seqNo, 10)),
+	}, uw.version)
+	if err != nil {
+		return err
+	}
+	seqNoFile, err := data.OpenSeqNoFile(uw.dirPath)
+	if err != nil {
+		return err
+	}
+	defer seqNoFile.Close()
+	if err := seqNoFile.Write(encRecord); err != nil {
+		return err
+	}
+	return seqNoFile.Sync()
+}
+
+// 比较新旧目录中有效的 key 和 value
+func verifyUpgrade(src *DB, options Options, upgradePath string) error {
+	options.DirPath = upgradePath
+	dst, err := openOffline(options)
+	if err != nil {
+		return err
+	}
+	defer dst.closeDataFiles()
+
+	srcIterator := src.index.Iterator(false)
+	defer srcIterator.Close()
+	dstIterator := dst.index.Iterator(false)
+	defer dstIterator.Close()
+
+	dstIterator.Rewind()
+	for srcIterator.Rewind(); srcIterator.Valid(); srcIterator.Next() {
+		if !dstIterator.Valid() || !bytes.Equal(srcIterator.Key(), dstIterator.Key()) {
+			return ErrUpgradeVerifyFailed
+		}
+		srcValue, err := src.getValueByPosition(srcIterator.Value())
+		if err != nil {
+			return err
+		}
+		dstValue, err := dst.getValueByPosition(dstIterator.Value())
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(srcValue, dstValue) {
+			return ErrUpgradeVerifyFailed
+		}
+		dstIterator.Next()
+	}
+	if dstIterator.Valid() {
+		return ErrUpgradeVerifyFailed
+	}
+	return nil
+}
+
+// 使用转换之后的目录替换原来的目录
+// 不支持原子交换时先重命名原来的目录，第二次重命名失败时恢复
+func replaceDir(dirPath, upgradePath string) error {
+	err := utils.ExchangeDirs(upgradePath, dirPath)
+	if err == nil {
+		if err := data.SyncDir(filepath.Dir(filepath.Clean(dirPath))); err != nil {
+			return err
+		}
+		// 交换之后 upgradePath 中是原来的数据
+		return os.RemoveAll(upgradePath)
+	}
+	if !errors.Is(err, errors.ErrUnsupported) {
+		return err
+	}
+
+	backupPath := upgradePath + "-old"
+	if err := os.RemoveAll(backupPath); err != nil {
+		return err
+	}
+	if err := os.Rename(dirPath, backupPath); err != nil {
+		return err
+	}
+	if err := os.Rename(upgradePath, dirPath); err != nil {
+		_ = os.Rename(backupPath, dirPath)
+		return err
+	}
+	if err := data.SyncDir(filepath.Dir(filepath.Clean(dirPath))); err != nil {
+		return err
+	}
+	return os.RemoveAll(backupPath)
+}
@@ -0,0 +1,190 @@
+package KV
+
+import (
+	"KV/data"
+	"KV/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 读取目录中所有文件的内容
+func readDirFiles(t *testing.T, dir string) map[string][]byte {
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	files := make(map[string][]byte, len(entries))
+	for _, entry := range entries {
+		buf, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		assert.Nil(t, err)
+		files[entry.Name()] = buf
+	}
+	return files
+}
+
+func checkUpgradeValues(t *testing.T, opts Options, values map[string][]byte) {
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer db.Close()
+	assert.Equal(t, len(values), len(db.ListKeys()))
+	for key, value := range values {
+		val, err := db.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+}
+
+func TestUpgradeFormat(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-upgrade")
+	opts.DirPath = dir
+	opts.DataFileSize = 16 * 1024
+	opts.BlobThreshold = 512
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	values := make(map[string][]byte)
+	for i := 0; i < 500; i++ {
+		// 较大的 value 写入 blob 文件
+		value := utils.RandomValue(64)
+		if i%10 == 0 {
+			value = utils.RandomValue(1024)
+		}
+		assert.Nil(t, db.Put(utils.GetTestKey(i), value))
+		values[string(utils.GetTestKey(i))] = value
+	}
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+		delete(values, string(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Close())
+
+	// 1.降级为旧格式，没有 manifest 和 blob 文件，记录中没有 flags
+	assert.Nil(t, UpgradeFormat(opts, data.FormatV1))
+	files := readDirFiles(t, dir)
+	_, ok := files[data.ManifestFileName]
+	assert.False(t, ok)
+	for name := range files {
+		assert.NotEqual(t, data.BlobFileNameSuffix, filepath.Ext(name))
+	}
+	buf := files[filepath.Base(data.GetDataFileName(dir, 0))]
+	assert.Equal(t, byte(0), buf[4]&0x80)
+	_, err = os.Stat(dir + upgradeDirName)
+	assert.True(t, os.IsNotExist(err))
+	checkUpgradeValues(t, opts, values)
+
+	// 2.升级为当前格式
+	assert.Nil(t, UpgradeFormat(opts, data.FormatV2))
+	buf, err = os.ReadFile(data.GetDataFileName(dir, 0))
+	assert.Nil(t, err)
+	assert.NotEqual(t, byte(0), buf[4]&0x80)
+	manifest, err := data.ReadManifest(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, manifest)
+	checkUpgradeValues(t, opts, values)
+}
+
+// 不能转换为旧格式时直接返回，原来的目录保持不变
+func TestUpgradeFormatRefused(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-upgrade-refused")
+	opts.DirPath = dir
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	assert.Nil(t, db.DeleteRange(utils.GetTestKey(10), utils.GetTestKey(20)))
+	assert.Nil(t, db.Close())
+	files := readDirFiles(t, dir)
+
+	assert.Equal(t, data.ErrFormatUnsupported, UpgradeFormat(opts, data.FormatV1))
+	assert.Equal(t, data.ErrUnknownFormatVersion, UpgradeFormat(opts, 3))
+	assert.Equal(t, files, readDirFiles(t, dir))
+	_, err = os.Stat(dir + upgradeDirName)
+	assert.True(t, os.IsNotExist(err))
+}
+
+// 存在没有生效的 merge 结果时拒绝转换，数据目录和 merge 目录保持不变，启动一次之后才能转换
+func TestUpgradeFormatRefusesPendingMerge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-upgrade-merge")
+	opts.DirPath = dir
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	values := make(map[string][]byte)
+	for i := 0; i < 100; i++ {
+		value := utils.RandomValue(64)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), value))
+		values[string(utils.GetTestKey(i))] = value
+	}
+	mergePath := db.getMergePath()
+	assert.Nil(t, db.Close())
+	defer func() {
+		_ = os.RemoveAll(mergePath)
+	}()
+
+	assert.Nil(t, os.MkdirAll(mergePath, os.ModePerm))
+	assert.Nil(t, os.WriteFile(filepath.Join(mergePath, data.MergeFinishFileName), nil, 0644))
+	files := readDirFiles(t, dir)
+	mergeFiles := readDirFiles(t, mergePath)
+	assert.Equal(t, ErrUpgradeMergePending, UpgradeFormat(opts, data.FormatV1))
+	assert.Equal(t, files, readDirFiles(t, dir))
+	assert.Equal(t, mergeFiles, readDirFiles(t, mergePath))
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+	assert.Nil(t, UpgradeFormat(opts, data.FormatV1))
+	checkUpgradeValues(t, opts, values)
+}
+
+// 活跃文件末尾的记录不完整时和启动时一样需要配置 RepairTruncatedTail，转换失败时不会截断原来的文件
+func TestUpgradeFormatTruncatedTail(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-upgrade-tail")
+	opts.DirPath = dir
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	values := make(map[string][]byte)
+	for i := 0; i < 100; i++ {
+		value := utils.RandomValue(64)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), value))
+		values[string(utils.GetTestKey(i))] = value
+	}
+	activeFileId := db.activeFile.FileId
+	assert.Nil(t, db.Close())
+
+	encRecord, _ := data.EncodeLogRecord(&data.LogRecord{
+		Key:   logRecordKeyWithSeqNo([]byte("torn"), nonTransactionSeqNo),
+		Value: utils.RandomValue(128),
+	})
+	f, err := os.OpenFile(data.GetDataFileName(dir, activeFileId), os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = f.Write(encRecord[:len(encRecord)/2])
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+	files := readDirFiles(t, dir)
+
+	assert.Equal(t, data.ErrInvalidRecordSize, UpgradeFormat(opts, data.FormatV2))
+	assert.Equal(t, files, readDirFiles(t, dir))
+
+	opts.RepairTruncatedTail = true
+	assert.Nil(t, UpgradeFormat(opts, data.FormatV2))
+	checkUpgradeValues(t, opts, values)
+}
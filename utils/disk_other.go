@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd
+
+package utils
+
+import "errors"
+
+// AvailableDiskSize 当前平台不支持获取可用空间，返回 errors.ErrUnsupported
+func AvailableDiskSize(dirPath string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,14 @@
+//go:build linux || darwin || freebsd
+
+package utils
+
+import "syscall"
+
+// AvailableDiskSize 目录所在的文件系统中可以使用的空间大小
+func AvailableDiskSize(dirPath string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dirPath, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
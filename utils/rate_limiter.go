@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// 每次等待的最长时间，等待期间速率被修改时可以尽快生效
+const maxRateLimitWait = 100 * time.Millisecond
+
+// RateLimiter 令牌桶限速器，每秒产生 rate 个令牌，最多积攒一秒的令牌
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   int64 // 每秒的字节数，小于等于 0 时不限速
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(rate int64) *RateLimiter {
+	return &RateLimiter{rate: rate, tokens: float64(rate), last: time.Now()}
+}
+
+// SetRate 修改速率，小于等于 0 时不限速
+func (rl *RateLimiter) SetRate(rate int64) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.refill()
+	rl.rate = rate
+	if rl.tokens > float64(rate) {
+		rl.tokens = float64(rate)
+	}
+}
+
+// Wait 等待直到可以处理 n 个字节，ctx 被取消时返回对应的错误
+// n 超过一秒的令牌数时只需要等待桶满，多出的部分从之后产生的令牌中扣除
+func (rl *RateLimiter) Wait(ctx context.Context, n int64) error {
+	for {
+		rl.mu.Lock()
+		if rl.rate <= 0 {
+			rl.mu.Unlock()
+			return ctx.Err()
+		}
+		rl.refill()
+
+		need := float64(n)
+		if need > float64(rl.rate) {
+			need = float64(rl.rate)
+		}
+		if rl.tokens >= need {
+			rl.tokens -= float64(n)
+			rl.mu.Unlock()
+			return ctx.Err()
+		}
+		wait := time.Duration((need - rl.tokens) / float64(rl.rate) * float64(time.Second))
+		rl.mu.Unlock()
+
+		if wait > maxRateLimitWait {
+			wait = maxRateLimitWait
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// 根据经过的时间补充令牌
+func (rl *RateLimiter) refill() {
+	now := time.Now()
+	if rl.rate > 0 {
+		rl.tokens += now.Sub(rl.last).Seconds() * float64(rl.rate)
+		if rl.tokens > float64(rl.rate) {
+			rl.tokens = float64(rl.rate)
+		}
+	}
+	rl.last = now
+}
@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_WaitMoreThanRate(t *testing.T) {
+	rl := NewRateLimiter(10000)
+
+	// 超过一秒的令牌数时只等待桶满，多出的部分从之后产生的令牌中扣除
+	start := time.Now()
+	assert.Nil(t, rl.Wait(context.Background(), 15000))
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+
+	start = time.Now()
+	assert.Nil(t, rl.Wait(context.Background(), 1))
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+}
+
+func TestRateLimiter_SetRateWhileWaiting(t *testing.T) {
+	rl := NewRateLimiter(100)
+	assert.Nil(t, rl.Wait(context.Background(), 100))
+
+	// 等待期间取消限速，不需要等到令牌补充完成
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		rl.SetRate(0)
+	}()
+	start := time.Now()
+	assert.Nil(t, rl.Wait(context.Background(), 100))
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+
+	start = time.Now()
+	assert.Nil(t, rl.Wait(context.Background(), 1<<30))
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+}
+
+func TestRateLimiter_WaitCanceled(t *testing.T) {
+	rl := NewRateLimiter(100)
+	assert.Nil(t, rl.Wait(context.Background(), 100))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	assert.Equal(t, context.DeadlineExceeded, rl.Wait(ctx, 100))
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+
+	// 已经取消的 ctx 即使不需要等待也返回错误
+	rl.SetRate(0)
+	assert.Equal(t, context.DeadlineExceeded, rl.Wait(ctx, 1))
+}
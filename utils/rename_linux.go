@@ -0,0 +1,17 @@
+//go:build linux
+
+package utils
+
+import (
+	"errors"
+	"golang.org/x/sys/unix"
+)
+
+// ExchangeDirs 原子地交换两个目录，文件系统不支持时返回 errors.ErrUnsupported
+func ExchangeDirs(oldPath, newPath string) error {
+	err := unix.Renameat2(unix.AT_FDCWD, oldPath, unix.AT_FDCWD, newPath, unix.RENAME_EXCHANGE)
+	if err == unix.EINVAL || err == unix.ENOSYS {
+		return errors.ErrUnsupported
+	}
+	return err
+}
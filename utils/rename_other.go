@@ -0,0 +1,10 @@
+//go:build !linux
+
+package utils
+
+import "errors"
+
+// ExchangeDirs 当前平台不支持原子地交换两个目录，返回 errors.ErrUnsupported
+func ExchangeDirs(oldPath, newPath string) error {
+	return errors.ErrUnsupported
+}